@@ -0,0 +1,34 @@
+package codec
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// ActivityConn is a connection that keeps track of when data has last been
+// received on it. It lets WebSocket keepalive notice pongs, which
+// golang.org/x/net/websocket consumes internally.
+type ActivityConn struct {
+	net.Conn
+	// Unix time in nanoseconds, accessed atomically.
+	lastRead int64
+}
+
+// NewActivityConn wraps the connection. Creation counts as activity.
+func NewActivityConn(conn net.Conn) *ActivityConn {
+	return &ActivityConn{Conn: conn, lastRead: time.Now().UnixNano()}
+}
+
+func (c *ActivityConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		atomic.StoreInt64(&c.lastRead, time.Now().UnixNano())
+	}
+	return n, err
+}
+
+// LastRead returns the time data has last been received.
+func (c *ActivityConn) LastRead() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&c.lastRead))
+}
@@ -36,6 +36,12 @@ type ConnectionInfo struct {
 	RemoteAddr string
 	// PeerCertificates is the certificate chain presented by the peer.
 	PeerCertificates []*x509.Certificate
+	// CorruptFrames is the number of frames that have been dropped because
+	// their checksum did not match.
+	CorruptFrames uint64
+	// Ordered is set if frames arrive in the order they have been sent.
+	// Devices serve the requests that arrive over one connection in order.
+	Ordered bool
 }
 
 // IsEOF returns true when err means "end of file".
@@ -0,0 +1,79 @@
+package codec
+
+import (
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"github.com/cesanta/errors"
+	"github.com/golang/glog"
+)
+
+type execCodec struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout io.ReadCloser
+
+	closeOnce sync.Once
+}
+
+// Exec starts the command and creates a codec which talks to it over its
+// stdin and stdout. The command's stderr goes to ours. The command is killed
+// when the codec is closed.
+func Exec(args []string, opts StreamOptions) (Codec, error) {
+	if len(args) == 0 {
+		return nil, errors.Errorf("no command specified")
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	glog.Infof("Starting %q...", args)
+	if err := cmd.Start(); err != nil {
+		return nil, errors.Annotatef(err, "failed to start %q", args)
+	}
+	return StreamConn(&execCodec{
+		cmd:    cmd,
+		stdin:  stdin,
+		stdout: stdout,
+	}, opts), nil
+}
+
+func (c *execCodec) Read(b []byte) (n int, err error) {
+	return c.stdout.Read(b)
+}
+
+func (c *execCodec) Write(b []byte) (n int, err error) {
+	return c.stdin.Write(b)
+}
+
+func (c *execCodec) Close() error {
+	c.closeOnce.Do(func() {
+		c.stdin.Close()
+		// The process may have exited already.
+		if err := c.cmd.Process.Kill(); err != nil {
+			glog.V(1).Infof("failed to kill %s: %s", c.RemoteAddr(), err)
+		}
+		// Reap the process.
+		go func() {
+			glog.V(1).Infof("%s exited: %v", c.RemoteAddr(), c.cmd.Wait())
+		}()
+	})
+	return nil
+}
+
+func (c *execCodec) RemoteAddr() string {
+	return strings.Join(c.cmd.Args, " ")
+}
+
+func (c *execCodec) PreprocessFrame(frameData []byte) (bool, error) {
+	return false, nil
+}
@@ -0,0 +1,224 @@
+package codec
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"cesanta.com/common/go/mgrpc/frame"
+	"github.com/cesanta/errors"
+	"github.com/golang/glog"
+)
+
+const (
+	// Reassembled frames can't be bigger than this.
+	maxReassembledFrameSize = 16 * 1024 * 1024
+	// All fragments but the last are at least this big, which limits the
+	// number of fragments of a frame.
+	minFragmentSize  = 128
+	maxFragmentCount = maxReassembledFrameSize / minFragmentSize
+	// Limits on the frames being reassembled at the same time on one
+	// connection.
+	maxPartialFrames = 8
+	maxPartialSize   = 2 * maxReassembledFrameSize
+	// Partially received frames are dropped if no fragment arrives for this
+	// long.
+	fragmentTimeout = time.Minute
+)
+
+// FragmentingCodec splits frames bigger than MTU into fragments, and
+// reassembles fragmented frames received from the peer. See Fragmenting.
+type FragmentingCodec struct {
+	Codec
+	// Accessed atomically.
+	mtu int64
+
+	// Frames being reassembled, the total size of their data, and their lock.
+	partial     map[string]*partialFrame
+	partialSize int
+	lock        sync.Mutex
+}
+
+type partialFrame struct {
+	count      int
+	pieces     map[int][]byte
+	size       int
+	lastUpdate time.Time
+}
+
+// Fragmenting wraps the codec so that frames that are encoded into more than
+// mtu bytes of JSON are sent in fragments. Zero mtu disables fragmentation,
+// but fragments received from the peer are always reassembled. Codecs that
+// limit the number of frames in flight, like HTTP, never fragment.
+func Fragmenting(c Codec, mtu int) *FragmentingCodec {
+	return &FragmentingCodec{
+		Codec:   c,
+		mtu:     int64(mtu),
+		partial: make(map[string]*partialFrame),
+	}
+}
+
+func (c *FragmentingCodec) String() string {
+	return fmt.Sprintf("%v", c.Codec)
+}
+
+// SetMTU changes the size limit of frames sent from now on.
+func (c *FragmentingCodec) SetMTU(mtu int) {
+	atomic.StoreInt64(&c.mtu, int64(mtu))
+}
+
+// MTU returns the size limit of frames being sent.
+func (c *FragmentingCodec) MTU() int {
+	return int(atomic.LoadInt64(&c.mtu))
+}
+
+func (c *FragmentingCodec) Send(ctx context.Context, f *frame.Frame) error {
+	mtu := c.MTU()
+	if mtu <= 0 || c.Codec.MaxNumFrames() >= 0 {
+		return c.Codec.Send(ctx, f)
+	}
+	data, err := frame.MarshalJSON(f)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if len(data) <= mtu {
+		return c.Codec.Send(ctx, f)
+	}
+	pieceSize, err := fragmentPieceSize(f, len(data), mtu)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	count := (len(data) + pieceSize - 1) / pieceSize
+	glog.V(2).Infof("%s: sending frame %d (%d bytes) in %d fragments", c, f.ID, len(data), count)
+	for i := 0; i < count; i++ {
+		end := (i + 1) * pieceSize
+		if end > len(data) {
+			end = len(data)
+		}
+		ff := fragmentFrame(f, &frame.Fragment{
+			Index: i, Count: count, Request: f.IsRequest(), Data: data[i*pieceSize : end],
+		})
+		if err := c.Codec.Send(ctx, ff); err != nil {
+			return errors.Annotatef(err, "fragment %d of %d", i, count)
+		}
+	}
+	return nil
+}
+
+// fragmentFrame returns a frame that carries the given fragment of f.
+func fragmentFrame(f *frame.Frame, frag *frame.Fragment) *frame.Frame {
+	return &frame.Frame{
+		Version: f.Version,
+		Src:     f.Src,
+		Dst:     f.Dst,
+		Key:     f.Key,
+		ID:      f.ID,
+		Frag:    frag,
+	}
+}
+
+// fragmentPieceSize returns how much of the encoded frame fits into one
+// fragment. Data is base64-encoded, and the rest of the fragment is at most
+// as big as it is with both numbers equal to the size of the frame.
+func fragmentPieceSize(f *frame.Frame, size, mtu int) (int, error) {
+	hdr, err := frame.MarshalJSON(fragmentFrame(f, &frame.Fragment{
+		Index: size, Count: size, Request: f.IsRequest(), Data: []byte{},
+	}))
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	n := (mtu - len(hdr)) / 4 * 3
+	if n < minFragmentSize {
+		return 0, errors.Errorf("MTU %d is too small for frame %d", mtu, f.ID)
+	}
+	return n, nil
+}
+
+func (c *FragmentingCodec) Recv(ctx context.Context) (*frame.Frame, error) {
+	for {
+		f, err := c.Codec.Recv(ctx)
+		if err != nil || f.Frag == nil {
+			return f, err
+		}
+		if rf := c.reassemble(f); rf != nil {
+			return rf, nil
+		}
+	}
+}
+
+// reassemble stores the fragment and returns the frame once all of its
+// fragments have been received.
+func (c *FragmentingCodec) reassemble(f *frame.Frame) *frame.Frame {
+	frag := f.Frag
+	if frag.Count <= 0 || frag.Index < 0 || frag.Index >= frag.Count || frag.Count > maxFragmentCount {
+		glog.Errorf("%s: invalid fragment %d of %d of frame %d, dropping", c, frag.Index, frag.Count, f.ID)
+		return nil
+	}
+	key := fmt.Sprintf("%s %d %t", f.Src, f.ID, frag.Request)
+	now := time.Now()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for k, pf := range c.partial {
+		if now.Sub(pf.lastUpdate) > fragmentTimeout {
+			glog.Errorf("%s: frame %q has not been received in full, dropping", c, k)
+			c.dropPartialLocked(k)
+		}
+	}
+	pf := c.partial[key]
+	if pf != nil && pf.count != frag.Count {
+		c.dropPartialLocked(key)
+		pf = nil
+	}
+	if pf == nil {
+		if len(c.partial) >= maxPartialFrames {
+			glog.Errorf("%s: too many frames being reassembled, dropping fragment of frame %q", c, key)
+			return nil
+		}
+		pf = &partialFrame{count: frag.Count, pieces: make(map[int][]byte)}
+		c.partial[key] = pf
+	}
+	pf.lastUpdate = now
+	if old, ok := pf.pieces[frag.Index]; ok {
+		pf.size -= len(old)
+		c.partialSize -= len(old)
+	}
+	pf.pieces[frag.Index] = frag.Data
+	pf.size += len(frag.Data)
+	c.partialSize += len(frag.Data)
+	if pf.size > maxReassembledFrameSize {
+		glog.Errorf("%s: frame %q is too big, dropping", c, key)
+		c.dropPartialLocked(key)
+		return nil
+	}
+	if c.partialSize > maxPartialSize {
+		glog.Errorf("%s: too much data being reassembled, dropping frame %q", c, key)
+		c.dropPartialLocked(key)
+		return nil
+	}
+	if len(pf.pieces) < frag.Count {
+		return nil
+	}
+	c.dropPartialLocked(key)
+	data := make([]byte, 0, pf.size)
+	for i := 0; i < pf.count; i++ {
+		data = append(data, pf.pieces[i]...)
+	}
+	rf := &frame.Frame{SizeHint: len(data)}
+	if err := json.Unmarshal(data, rf); err != nil {
+		glog.Errorf("%s: failed to parse reassembled frame %q: %s", c, key, err)
+		return nil
+	}
+	return rf
+}
+
+// dropPartialLocked forgets the frame being reassembled. Must be called with
+// the lock held.
+func (c *FragmentingCodec) dropPartialLocked(key string) {
+	if pf := c.partial[key]; pf != nil {
+		c.partialSize -= pf.size
+		delete(c.partial, key)
+	}
+}
@@ -0,0 +1,182 @@
+package codec
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"cesanta.com/common/go/mgrpc/frame"
+	"cesanta.com/common/go/ourjson"
+)
+
+func TestFragmenting(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	a, b := Pipe()
+	fa, fb := Fragmenting(a, 300), Fragmenting(b, 0)
+
+	blob := `"` + strings.Repeat("0123456789", 100) + `"`
+	sent := []*frame.Frame{
+		{Src: "host", Dst: "dev", Key: "secret", ID: 1, Method: "Config.Set", Args: ourjson.RawJSON([]byte(blob))},
+		{Src: "host", Dst: "dev", ID: 2, Method: "Sys.Reboot"},
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		for _, f := range sent {
+			if err := fa.Send(ctx, f); err != nil {
+				errCh <- err
+				return
+			}
+		}
+		errCh <- nil
+	}()
+
+	// Fragments are observed on the underlying codec, then reassembled.
+	var frags []*frame.Frame
+	for {
+		f, err := b.Recv(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.Frag == nil || !f.Frag.Request || f.IsRequest() || f.Key != "secret" {
+			t.Fatalf("got %s, want a fragment of a request with the key", f)
+		}
+		if l, _ := frame.MarshalJSON(f); len(l) > 300 {
+			t.Errorf("fragment %d is %d bytes long", f.Frag.Index, len(l))
+		}
+		frags = append(frags, f)
+		if f.Frag.Index == f.Frag.Count-1 {
+			break
+		}
+	}
+	if len(frags) < 2 {
+		t.Fatalf("got %d fragments", len(frags))
+	}
+	// Fragments may arrive out of order.
+	frags[0], frags[1] = frags[1], frags[0]
+	var got *frame.Frame
+	for _, f := range frags {
+		if got != nil {
+			t.Fatalf("frame has been reassembled before all the fragments arrived")
+		}
+		got = fb.reassemble(f)
+	}
+	if got == nil || got.ID != 1 || got.Method != "Config.Set" || got.Dst != "dev" || rawString(got.Args) != blob {
+		t.Errorf("got %s", got)
+	}
+
+	// Small frames are sent as is.
+	got, err := fb.Recv(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != 2 || got.Method != "Sys.Reboot" {
+		t.Errorf("got %s", got)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+
+	fa.SetMTU(20)
+	if err := fa.Send(ctx, sent[0]); err == nil {
+		t.Errorf("sending with a tiny MTU should fail")
+	}
+}
+
+func TestFragmentLimits(t *testing.T) {
+	_, b := Pipe()
+	c := Fragmenting(b, 0)
+	frag := func(id int64, count int, data string) *frame.Frame {
+		return &frame.Frame{Src: "host", ID: id, Frag: &frame.Fragment{Index: 0, Count: count, Request: true, Data: []byte(data)}}
+	}
+
+	// Too many fragments are not expected, or allocated for.
+	c.reassemble(frag(1, maxFragmentCount+1, "x"))
+	if len(c.partial) != 0 {
+		t.Errorf("frame with %d fragments is being reassembled", maxFragmentCount+1)
+	}
+
+	// The number of frames being reassembled is limited.
+	for id := int64(1); id <= maxPartialFrames+1; id++ {
+		c.reassemble(frag(id, 2, "x"))
+	}
+	if len(c.partial) != maxPartialFrames || c.partialSize != maxPartialFrames {
+		t.Errorf("got %d frames, %d bytes being reassembled", len(c.partial), c.partialSize)
+	}
+
+	// So is the size of their data.
+	c = Fragmenting(b, 0)
+	big := strings.Repeat("x", maxPartialSize/4+1)
+	for id := int64(1); id <= 4; id++ {
+		c.reassemble(frag(id, 2, big))
+	}
+	if len(c.partial) != 3 || c.partialSize != 3*len(big) {
+		t.Errorf("got %d frames, %d bytes being reassembled", len(c.partial), c.partialSize)
+	}
+}
+
+func TestFragmentingUDP(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := ListenUDP(conn, UDPOptions{RetransmitInterval: 20 * time.Millisecond})
+	defer l.Close()
+	cc, err := net.DialUDP("udp", nil, l.Addr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	uc := UDP(cc, UDPOptions{RetransmitInterval: 20 * time.Millisecond}).(*udpCodec)
+	// The first copy of the second fragment gets lost.
+	write, lost := uc.write, false
+	uc.write = func(b []byte) error {
+		if !lost && strings.Contains(string(b), `"i":1,`) {
+			lost = true
+			return nil
+		}
+		return write(b)
+	}
+	client := Fragmenting(uc, 300)
+	defer client.Close()
+
+	blob := `"` + strings.Repeat("0123456789", 200) + `"`
+	if err := client.Send(ctx, &frame.Frame{ID: 1, Method: "Echo", Args: ourjson.RawJSON([]byte(blob))}); err != nil {
+		t.Fatal(err)
+	}
+	sc, err := l.Accept(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := Fragmenting(sc, 300)
+	f, err := server.Recv(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.ID != 1 || f.Method != "Echo" || rawString(f.Args) != blob {
+		t.Fatalf("got %s", f)
+	}
+	if err := server.Send(ctx, &frame.Frame{ID: f.ID, Result: f.Args}); err != nil {
+		t.Fatal(err)
+	}
+	rf, err := client.Recv(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rf.ID != 1 || rawString(rf.Result) != blob {
+		t.Errorf("got %s", rf)
+	}
+	if !lost {
+		t.Errorf("no fragment has been lost")
+	}
+
+	// Retransmitted fragments are not reassembled into another request.
+	sctx, scancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer scancel()
+	if f, err := server.Recv(sctx); err == nil {
+		t.Errorf("duplicate request has been received: %s", f)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"strconv"
 	"strings"
@@ -25,6 +26,55 @@ type inboundHttpCodec struct {
 	closeNotifier chan struct{}
 	closeOnce     sync.Once
 	isSingleShot  bool
+
+	// In JSON-RPC mode, there may be a batch of requests and responses.
+	jsonRPC    bool
+	jsonRPCIDs *frame.JSONRPCIDs
+	batch      bool
+	inQueue    []*frame.Frame
+	outs       []*frame.Frame
+}
+
+// InboundJSONRPCHTTP creates a codec for an HTTP POST request with a JSON-RPC
+// 2.0 request or a batch of them in the body. Basic auth credentials, if any,
+// are taken as source and key of the requests. The responses are sent when
+// the codec is closed, as a batch if the requests came in one.
+func InboundJSONRPCHTTP(rw http.ResponseWriter, req *http.Request) Codec {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("Failed to read the request: %s", err), http.StatusBadRequest)
+		return nil
+	}
+	ids := &frame.JSONRPCIDs{}
+	fs, invalid, batch, err := frame.UnmarshalJSONRPC(body, ids)
+	if err != nil {
+		glog.Infof("Invalid JSON-RPC request (%s): %+v", err, req)
+		b, _ := frame.MarshalJSONRPC(&frame.Frame{Error: &frame.Error{Code: frame.JSONRPCParseError, Message: err.Error()}}, nil)
+		rw.Header().Set("Content-Type", "application/json")
+		rw.Write(b)
+		return nil
+	}
+	src, key, _ := req.BasicAuth()
+	for _, f := range fs {
+		f.Src, f.Key = src, key
+	}
+	c := &inboundHttpCodec{
+		req:           req,
+		rw:            rw,
+		closeNotifier: make(chan struct{}),
+		jsonRPC:       true,
+		jsonRPCIDs:    ids,
+		batch:         batch,
+		inQueue:       fs,
+		// Invalid requests are answered along with the valid ones.
+		outs: invalid,
+	}
+	var httpCloseNotifier <-chan bool
+	if cn, ok := c.rw.(http.CloseNotifier); ok {
+		httpCloseNotifier = cn.CloseNotify()
+	}
+	go c.monitorHTTPConnection(httpCloseNotifier)
+	return c
 }
 
 func InboundHTTP(rw http.ResponseWriter, req *http.Request, cloudHost string) Codec {
@@ -45,7 +95,7 @@ func InboundHTTP(rw http.ResponseWriter, req *http.Request, cloudHost string) Co
 		if cloudHost != "" && strings.HasSuffix(req.Host, cloudHost) {
 			f.Dst = strings.TrimSuffix(strings.TrimSuffix(req.Host, cloudHost), ".")
 		}
-		f.Method = req.URL.Path
+		f.Method = strings.TrimPrefix(req.URL.Path, "/")
 		if req.ContentLength > 0 {
 			if err := json.NewDecoder(req.Body).Decode(&f.Args); err != nil {
 				http.Error(rw, fmt.Sprintf("Invalid args: %s", err), http.StatusBadRequest)
@@ -112,12 +162,23 @@ func (c *inboundHttpCodec) monitorHTTPConnection(httpCloseNotifier <-chan bool)
 }
 
 func (c *inboundHttpCodec) String() string {
+	if c.jsonRPC {
+		return fmt.Sprintf("[inboundHttpCodec from %s, JSON-RPC]", c.req.RemoteAddr)
+	}
 	return fmt.Sprintf("[inboundHttpCodec from %s]", c.req.RemoteAddr)
 }
 
 func (c *inboundHttpCodec) Recv(ctx context.Context) (*frame.Frame, error) {
 	c.Lock()
 	defer c.Unlock()
+	if c.jsonRPC {
+		if len(c.inQueue) == 0 {
+			return nil, errors.Trace(io.EOF)
+		}
+		f := c.inQueue[0]
+		c.inQueue = c.inQueue[1:]
+		return f, nil
+	}
 	if c.in == nil {
 		return nil, errors.Trace(io.EOF)
 	}
@@ -133,8 +194,21 @@ func (c *inboundHttpCodec) Send(ctx context.Context, f *frame.Frame) error {
 		return errors.Trace(io.EOF)
 	default:
 	}
+	if f.IsProgress() {
+		// Only the response fits into the HTTP response.
+		glog.V(2).Infof("%s: dropping progress %d", c, f.ID)
+		return nil
+	}
 	c.Lock()
 	defer c.Unlock()
+	if c.jsonRPC {
+		if !f.IsRequest() && f.ID == 0 {
+			glog.V(2).Infof("%s: not responding to a notification", c)
+			return nil
+		}
+		c.outs = append(c.outs, f)
+		return nil
+	}
 	if c.out != nil {
 		return errors.Errorf("Trying to send more than one frame. Existing: %v, new: %v", c.out, f)
 	}
@@ -145,6 +219,11 @@ func (c *inboundHttpCodec) Send(ctx context.Context, f *frame.Frame) error {
 func (c *inboundHttpCodec) Close() {
 	c.Lock()
 	defer c.Unlock()
+	if c.jsonRPC {
+		c.writeJSONRPC()
+		c.closeOnce.Do(c.sendAndClose)
+		return
+	}
 	if c.rw != nil {
 		glog.V(2).Infof("Response finished, frame: %v", c.out)
 		if c.out != nil {
@@ -174,6 +253,38 @@ func (c *inboundHttpCodec) Close() {
 	c.closeOnce.Do(c.sendAndClose)
 }
 
+// writeJSONRPC writes the responses collected in JSON-RPC mode.
+func (c *inboundHttpCodec) writeJSONRPC() {
+	if c.rw == nil {
+		if len(c.outs) > 0 {
+			glog.Warningf("HTTP connection to %s closed before response was sent, lost %d frames.", c.req.RemoteAddr, len(c.outs))
+		}
+		return
+	}
+	var b []byte
+	var err error
+	switch {
+	case len(c.outs) == 0:
+		// Only notifications, or nothing has been served.
+		c.rw.WriteHeader(http.StatusNoContent)
+		c.rw = nil
+		return
+	case c.batch:
+		b, err = frame.MarshalJSONRPCBatch(c.outs, c.jsonRPCIDs)
+	default:
+		b, err = frame.MarshalJSONRPC(c.outs[0], c.jsonRPCIDs)
+	}
+	if err != nil {
+		glog.Errorf("Failed to serialize the response (%s): %+v", err, c.outs)
+		http.Error(c.rw, "Internal error.", http.StatusInternalServerError)
+	} else {
+		c.rw.Header().Set("Content-Type", "application/json")
+		c.rw.Write(b)
+	}
+	// Close may be called more than once.
+	c.rw = nil
+}
+
 func (c *inboundHttpCodec) sendAndClose() {
 	close(c.closeNotifier)
 }
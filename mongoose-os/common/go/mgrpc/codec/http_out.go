@@ -7,10 +7,15 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 	"sync"
 
 	"cesanta.com/common/go/mgrpc/frame"
+	"cesanta.com/common/go/ourjson"
 	"github.com/cesanta/errors"
 	"github.com/golang/glog"
 )
@@ -23,6 +28,8 @@ type outboundHttpCodec struct {
 	queue         []*frame.Frame
 	cond          *sync.Cond
 	client        *http.Client
+	rest          bool
+	jsonRPC       bool
 }
 
 // OutboundHTTP sends outbound frames in HTTP POST requests and
@@ -38,16 +45,111 @@ func OutboundHTTP(url string, tlsConfig *tls.Config) Codec {
 	return r
 }
 
+// OutboundRESTHTTP is like OutboundHTTP, but sends requests in the REST form
+// accepted by InboundHTTP: POST <url>/<method>?id=...&deadline=...&timeout=...
+// with args as the body and src and key as basic auth credentials.
+// Destination is implied by the URL. Responses to the peer's requests can't
+// be sent this way.
+func OutboundRESTHTTP(url string, tlsConfig *tls.Config) Codec {
+	r := OutboundHTTP(url, tlsConfig).(*outboundHttpCodec)
+	r.rest = true
+	return r
+}
+
+// OutboundJSONRPCHTTP is like OutboundHTTP, but sends JSON-RPC 2.0 requests.
+// Source and key are sent as basic auth credentials, destination is implied
+// by the URL.
+func OutboundJSONRPCHTTP(url string, tlsConfig *tls.Config) Codec {
+	r := OutboundHTTP(url, tlsConfig).(*outboundHttpCodec)
+	r.jsonRPC = true
+	return r
+}
+
 func (c *outboundHttpCodec) String() string {
+	switch {
+	case c.rest:
+		return fmt.Sprintf("[outboundHttpCodec to %q, REST]", c.url)
+	case c.jsonRPC:
+		return fmt.Sprintf("[outboundHttpCodec to %q, JSON-RPC]", c.url)
+	}
 	return fmt.Sprintf("[outboundHttpCodec to %q]", c.url)
 }
 
+// restRequest creates a REST-style HTTP request from the request frame.
+func (c *outboundHttpCodec) restRequest(f *frame.Frame) (*http.Request, error) {
+	if !f.IsRequest() {
+		return nil, errors.Errorf("only requests can be sent in REST form, got %v", f)
+	}
+	u, err := url.Parse(c.url)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + strings.TrimPrefix(f.Method, "/")
+	q := u.Query()
+	if f.ID != 0 {
+		q.Set("id", strconv.FormatInt(f.ID, 10))
+	}
+	if f.Deadline != 0 {
+		q.Set("deadline", strconv.FormatInt(f.Deadline, 10))
+	}
+	if f.Timeout != 0 {
+		q.Set("timeout", strconv.FormatInt(f.Timeout, 10))
+	}
+	u.RawQuery = q.Encode()
+	var body []byte
+	if f.Args.IsInitialized() {
+		if body, err = f.Args.MarshalJSON(); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	glog.V(2).Infof("Sending to %q over HTTP POST: %q", u, body)
+	req, err := http.NewRequest(http.MethodPost, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if len(body) > 0 {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if f.Src != "" || f.Key != "" {
+		req.SetBasicAuth(f.Src, f.Key)
+	}
+	return req, nil
+}
+
+// restResponseFrame makes a response frame to the request out of the body of
+// a REST response. The body is normally a frame with src and dst elided, but
+// plain results are accepted too.
+func restResponseFrame(f *frame.Frame, body []byte) (*frame.Frame, error) {
+	rf := &frame.Frame{}
+	if len(bytes.TrimSpace(body)) == 0 {
+		// Empty result.
+	} else if err := json.Unmarshal(body, rf); err != nil || (!rf.Result.IsInitialized() && rf.Error == nil) {
+		var v interface{}
+		if err := json.Unmarshal(body, &v); err != nil {
+			return nil, errors.Annotatef(err, "invalid response %q", body)
+		}
+		rf = &frame.Frame{Result: ourjson.RawJSON(body)}
+	}
+	if rf.ID == 0 {
+		rf.ID = f.ID
+	}
+	rf.Src, rf.Dst = f.Dst, f.Src
+	rf.SizeHint = len(body)
+	return rf, nil
+}
+
 func (c *outboundHttpCodec) Send(ctx context.Context, f *frame.Frame) error {
 	select {
 	case <-c.closeNotifier:
 		return errors.Trace(io.EOF)
 	default:
 	}
+	if c.rest {
+		return errors.Trace(c.sendREST(f))
+	}
+	if c.jsonRPC {
+		return errors.Trace(c.sendJSONRPC(f))
+	}
 	b, err := frame.MarshalJSON(f)
 	if err != nil {
 		return errors.Trace(err)
@@ -67,11 +169,88 @@ func (c *outboundHttpCodec) Send(ctx context.Context, f *frame.Frame) error {
 		// Return it from Recv?
 		return errors.Trace(err)
 	}
+	c.enqueue(rfs)
+	return nil
+}
+
+func (c *outboundHttpCodec) sendREST(f *frame.Frame) error {
+	req, err := c.restRequest(f)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("server returned an error: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	rf, err := restResponseFrame(f, body)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	c.enqueue(rf)
+	return nil
+}
+
+func (c *outboundHttpCodec) sendJSONRPC(f *frame.Frame) error {
+	if !f.IsRequest() {
+		return errors.Errorf("responses can't be sent in JSON-RPC mode")
+	}
+	b, err := frame.MarshalJSONRPC(f, nil)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	glog.V(2).Infof("Sending to %q over HTTP POST: %q", c.url, string(b))
+	req, err := http.NewRequest(http.MethodPost, c.url, bytes.NewReader(b))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if f.Src != "" || f.Key != "" {
+		req.SetBasicAuth(f.Src, f.Key)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		return errors.Errorf("server returned an error: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		// Notifications are not responded to.
+		return nil
+	}
+	rfs, invalid, _, err := frame.UnmarshalJSONRPC(body, nil)
+	if err != nil {
+		return errors.Annotatef(err, "invalid response")
+	}
+	if len(invalid) > 0 {
+		return errors.Errorf("invalid response: %s", invalid[0].Error.Message)
+	}
+	for _, rf := range rfs {
+		rf.Src, rf.Dst = f.Dst, f.Src
+		c.enqueue(rf)
+	}
+	return nil
+}
+
+// enqueue makes the response frame available to Recv.
+func (c *outboundHttpCodec) enqueue(rfs *frame.Frame) {
 	c.Lock()
 	c.queue = append(c.queue, rfs)
 	c.Unlock()
 	c.cond.Signal()
-	return nil
 }
 
 func (c *outboundHttpCodec) Recv(ctx context.Context) (*frame.Frame, error) {
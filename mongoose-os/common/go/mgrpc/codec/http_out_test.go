@@ -0,0 +1,83 @@
+package codec
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"cesanta.com/common/go/mgrpc/frame"
+	"cesanta.com/common/go/ourjson"
+)
+
+func rawString(m ourjson.RawMessage) string {
+	b, _ := m.MarshalJSON()
+	return string(b)
+}
+
+func TestOutboundRESTHTTP(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var got *frame.Frame
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/rpc/Plain":
+			// Firmware may respond with just the result.
+			fmt.Fprint(w, `{"a":1}`)
+			return
+		case "/rpc/Fail":
+			http.Error(w, "no such method", http.StatusNotFound)
+			return
+		}
+		c := InboundHTTP(w, req, "")
+		if c == nil {
+			return
+		}
+		defer c.Close()
+		got, _ = c.Recv(ctx)
+		c.Send(ctx, &frame.Frame{ID: got.ID, Result: got.Args})
+	}))
+	defer s.Close()
+
+	c := OutboundRESTHTTP(s.URL+"/rpc/", nil)
+	defer c.Close()
+	req := &frame.Frame{
+		Src: "mos", Key: "secret", Dst: "dev1", ID: 123, Method: "Echo",
+		Args: ourjson.RawJSON([]byte(`{"x":"y"}`)), Deadline: 1500000000, Timeout: 5,
+	}
+	if err := c.Send(ctx, req); err != nil {
+		t.Fatal(err)
+	}
+	if got.Method != "rpc/Echo" || got.ID != 123 || got.Src != "mos" || got.Key != "secret" ||
+		got.Deadline != 1500000000 || got.Timeout != 5 || rawString(got.Args) != `{"x":"y"}` {
+		t.Errorf("server got %+v", got)
+	}
+	rf, err := c.Recv(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rf.ID != 123 || rf.Src != "dev1" || rf.Dst != "mos" || rawString(rf.Result) != `{"x":"y"}` {
+		t.Errorf("got response %+v", rf)
+	}
+
+	if err := c.Send(ctx, &frame.Frame{ID: 124, Method: "Plain"}); err != nil {
+		t.Fatal(err)
+	}
+	if rf, err = c.Recv(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if rf.ID != 124 || rawString(rf.Result) != `{"a":1}` {
+		t.Errorf("got response %+v", rf)
+	}
+
+	err = c.Send(ctx, &frame.Frame{ID: 125, Method: "Fail"})
+	if err == nil || !strings.Contains(err.Error(), "no such method") {
+		t.Errorf("got %v, want an error with the body", err)
+	}
+	if err := c.Send(ctx, &frame.Frame{ID: 126, Result: ourjson.RawJSON([]byte(`1`))}); err == nil {
+		t.Errorf("sending a response should fail")
+	}
+}
@@ -0,0 +1,95 @@
+package codec
+
+import (
+	"sync"
+
+	"cesanta.com/common/go/mgrpc/frame"
+	"github.com/cesanta/errors"
+)
+
+// jsonRPCSession is the state of a connection that receives JSON-RPC requests
+// and sends responses to them. Responses to a batch of requests are held until
+// all of them are ready, and then sent as one batch, as the specification
+// requires.
+type jsonRPCSession struct {
+	ids frame.JSONRPCIDs
+
+	lock    sync.Mutex
+	batches []*jsonRPCBatch
+}
+
+type jsonRPCBatch struct {
+	// Number of the responses that are not ready yet, by ID.
+	pending map[int64]int
+	resps   []*frame.Frame
+}
+
+// unmarshal decodes the received message and returns the frames in it, along
+// with the data to send back right away, if any: the errors for invalid
+// messages which are not waiting for anything.
+func (s *jsonRPCSession) unmarshal(data []byte) ([]*frame.Frame, []byte, error) {
+	fs, invalid, batch, err := frame.UnmarshalJSONRPC(data, &s.ids)
+	if err != nil {
+		b, _ := frame.MarshalJSONRPC(&frame.Frame{Error: &frame.Error{Code: frame.JSONRPCParseError, Message: err.Error()}}, nil)
+		return nil, b, errors.Trace(err)
+	}
+	if !batch {
+		if len(invalid) == 0 {
+			return fs, nil, nil
+		}
+		b, err := frame.MarshalJSONRPC(invalid[0], nil)
+		return fs, b, errors.Trace(err)
+	}
+	pending := map[int64]int{}
+	for _, f := range fs {
+		if f.IsRequest() && f.ID != 0 {
+			pending[f.ID]++
+		}
+	}
+	if len(pending) == 0 {
+		if len(invalid) == 0 {
+			// Only notifications and responses.
+			return fs, nil, nil
+		}
+		b, err := frame.MarshalJSONRPCBatch(invalid, nil)
+		return fs, b, errors.Trace(err)
+	}
+	s.lock.Lock()
+	s.batches = append(s.batches, &jsonRPCBatch{pending: pending, resps: invalid})
+	s.lock.Unlock()
+	return fs, nil, nil
+}
+
+// marshal encodes the frame, or returns nil if there is nothing to send yet.
+// Responses to notifications are never sent, responses to batches are sent
+// with the last of them.
+func (s *jsonRPCSession) marshal(f *frame.Frame) ([]byte, error) {
+	if f.IsRequest() {
+		b, err := frame.MarshalJSONRPC(f, nil)
+		return b, errors.Trace(err)
+	}
+	if f.ID == 0 {
+		return nil, nil
+	}
+	s.lock.Lock()
+	for i, b := range s.batches {
+		if b.pending[f.ID] == 0 {
+			continue
+		}
+		b.resps = append(b.resps, f)
+		if b.pending[f.ID]--; b.pending[f.ID] == 0 {
+			delete(b.pending, f.ID)
+		}
+		if len(b.pending) > 0 {
+			s.lock.Unlock()
+			return nil, nil
+		}
+		s.batches = append(s.batches[:i], s.batches[i+1:]...)
+		s.lock.Unlock()
+		data, err := frame.MarshalJSONRPCBatch(b.resps, &s.ids)
+		return data, errors.Trace(err)
+	}
+	s.lock.Unlock()
+	data, err := frame.MarshalJSONRPC(f, &s.ids)
+	return data, errors.Trace(err)
+}
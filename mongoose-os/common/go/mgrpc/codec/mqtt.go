@@ -7,6 +7,9 @@ import (
 	"fmt"
 	"io"
 	"net/url"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"cesanta.com/common/go/mgrpc/frame"
@@ -16,46 +19,138 @@ import (
 	"github.com/golang/glog"
 )
 
+const (
+	// Number of received frames that may wait for Recv, the rest is dropped.
+	mqttRxQueueLen = 100
+)
+
+// MQTTOptions configure the MQTT codec. Most of them can also be set with
+// the query parameters of the broker URL, which take precedence:
+// password, client_id, topic_prefix, topic_suffix, qos, clean_session.
+type MQTTOptions struct {
+	// Credentials. Those in the URL take precedence.
+	User     string
+	Password string
+	// Client ID, also used as the source of the frames.
+	// Defaults to mos-<unix time>.
+	ClientID string
+	// Frames to a node with ID x are published to TopicPrefix + x + TopicSuffix.
+	// Frames to us are received on the topic constructed the same way from
+	// ClientID. By default, the prefix is empty and the suffix is "/rpc".
+	TopicPrefix string
+	TopicSuffix string
+	// QoS of the subscription and of the published messages.
+	QoS byte
+	// CleanSession makes the broker discard the session state on connect.
+	CleanSession bool
+}
+
+// DefaultMQTTOptions returns the options used by MQTT when nothing else is
+// specified.
+func DefaultMQTTOptions() MQTTOptions {
+	return MQTTOptions{
+		TopicSuffix:  "/rpc",
+		QoS:          1,
+		CleanSession: true,
+	}
+}
+
+// topic returns the RPC topic of the node with the given ID.
+func (o *MQTTOptions) topic(id string) string {
+	return o.TopicPrefix + id + o.TopicSuffix
+}
+
+// setFromQuery overrides the options with those specified in the query.
+func (o *MQTTOptions) setFromQuery(q url.Values) error {
+	for k, vs := range q {
+		v := vs[len(vs)-1]
+		switch k {
+		case "password":
+			o.Password = v
+		case "client_id":
+			o.ClientID = v
+		case "topic_prefix":
+			o.TopicPrefix = v
+		case "topic_suffix":
+			o.TopicSuffix = v
+		case "qos":
+			qos, err := strconv.Atoi(v)
+			if err != nil || qos < 0 || qos > 2 {
+				return errors.Errorf("invalid qos %q, must be 0, 1 or 2", v)
+			}
+			o.QoS = byte(qos)
+		case "clean_session":
+			cs, err := strconv.ParseBool(v)
+			if err != nil {
+				return errors.Errorf("invalid clean_session %q", v)
+			}
+			o.CleanSession = cs
+		default:
+			return errors.Errorf("unknown MQTT option %q", k)
+		}
+	}
+	return nil
+}
+
 type mqttCodec struct {
 	dst         string
+	broker      string
+	opts        MQTTOptions
 	closeNotify chan struct{}
-	ready       chan struct{}
-	rchan       chan frame.Frame
-	clientID    string
+	closeOnce   sync.Once
+	rchan       chan *frame.Frame
 	cli         mqtt.Client
 }
 
-func MQTT(dst string, tlsConfig *tls.Config) (Codec, error) {
+// MQTT connects to the broker specified by dst, which looks like
+// mqtt[s]://[user[:password]@]host:port/device_id[?options], and creates
+// a codec which exchanges frames with the device via the broker. See
+// MQTTOptions for the supported options.
+// Frames with Dst set go to that node instead. If device_id is omitted, all
+// the requests must have Dst, so a single broker connection can serve calls to
+// many devices.
+func MQTT(dst string, tlsConfig *tls.Config, mopts MQTTOptions) (Codec, error) {
 	u, err := url.Parse(dst)
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
-
-	clientID := fmt.Sprintf("mos-%v", time.Now().Unix())
+	if err := mopts.setFromQuery(u.Query()); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if mopts.ClientID == "" {
+		mopts.ClientID = fmt.Sprintf("mos-%v", time.Now().Unix())
+	}
+	if u.User != nil {
+		mopts.User = u.User.Username()
+		if pass, ok := u.User.Password(); ok {
+			mopts.Password = pass
+		}
+	}
 
 	c := &mqttCodec{
-		dst:         u.Path[1:],
+		dst:         strings.TrimPrefix(u.Path, "/"),
+		opts:        mopts,
 		closeNotify: make(chan struct{}),
-		ready:       make(chan struct{}),
-		rchan:       make(chan frame.Frame),
-		clientID:    clientID,
+		rchan:       make(chan *frame.Frame, mqttRxQueueLen),
 	}
 
 	u.Path = ""
+	u.RawQuery = ""
+	u.User = nil
 	if u.Scheme == "mqtts" {
 		u.Scheme = "tcps"
 	} else {
 		u.Scheme = "tcp"
 	}
-	broker := u.String()
-	glog.V(1).Infof("Connecting %s to %s", clientID, broker)
+	c.broker = u.String()
+	glog.V(1).Infof("Connecting %s to %s", mopts.ClientID, c.broker)
 
 	opts := mqtt.NewClientOptions()
-	opts.AddBroker(broker)
-	opts.SetClientID(clientID)
-	if u.User != nil {
-		opts.SetUsername(u.User.Username())
-	}
+	opts.AddBroker(c.broker)
+	opts.SetClientID(mopts.ClientID)
+	opts.SetUsername(mopts.User)
+	opts.SetPassword(mopts.Password)
+	opts.SetCleanSession(mopts.CleanSession)
 	if tlsConfig != nil {
 		opts.SetTLSConfig(tlsConfig)
 	}
@@ -68,11 +163,12 @@ func MQTT(dst string, tlsConfig *tls.Config) (Codec, error) {
 		return nil, errors.Annotatef(err, "MQTT connect error")
 	}
 
-	topic := fmt.Sprintf("%s/rpc", clientID)
+	topic := mopts.topic(mopts.ClientID)
 	glog.V(1).Infof("Subscribing to [%s]", topic)
-	token = c.cli.Subscribe(topic, 1 /* qos */, c.onMessage)
+	token = c.cli.Subscribe(topic, mopts.QoS, c.onMessage)
 	token.Wait()
 	if err := token.Error(); err != nil {
+		c.cli.Disconnect(0)
 		return nil, errors.Annotatef(err, "MQTT subscribe error")
 	}
 
@@ -81,22 +177,31 @@ func MQTT(dst string, tlsConfig *tls.Config) (Codec, error) {
 
 func (c *mqttCodec) onMessage(cli mqtt.Client, msg mqtt.Message) {
 	glog.V(4).Infof("Got MQTT message, topic [%s], message [%s]", msg.Topic(), msg.Payload())
-	f := &frame.Frame{}
-	if err := json.Unmarshal(msg.Payload(), &f); err != nil {
+	f := &frame.Frame{SizeHint: len(msg.Payload())}
+	if err := json.Unmarshal(msg.Payload(), f); err != nil {
 		glog.Errorf("Invalid json (%s): %+v", err, msg.Payload())
 		return
 	}
-	c.rchan <- *f
+	// Blocking here would stall the MQTT client, so if nobody is receiving,
+	// the frame is dropped.
+	select {
+	case c.rchan <- f:
+	case <-c.closeNotify:
+	default:
+		glog.Errorf("%s: rx queue is full, dropping %s", c, f)
+	}
 }
 
 func (c *mqttCodec) onConnectionLost(cli mqtt.Client, err error) {
 	glog.Errorf("Lost conection to MQTT broker: %s", err)
-	close(c.closeNotify)
+	c.closeOnce.Do(func() { close(c.closeNotify) })
 }
 
 func (c *mqttCodec) Close() {
-	c.cli.Disconnect(0)
-	close(c.closeNotify)
+	c.closeOnce.Do(func() {
+		c.cli.Disconnect(0)
+		close(c.closeNotify)
+	})
 }
 
 func (c *mqttCodec) CloseNotify() <-chan struct{} {
@@ -108,7 +213,7 @@ func (c *mqttCodec) String() string {
 }
 
 func (c *mqttCodec) Info() ConnectionInfo {
-	return ConnectionInfo{}
+	return ConnectionInfo{RemoteAddr: c.broker}
 }
 
 func (c *mqttCodec) MaxNumFrames() int {
@@ -118,24 +223,30 @@ func (c *mqttCodec) MaxNumFrames() int {
 func (c *mqttCodec) Recv(ctx context.Context) (*frame.Frame, error) {
 	select {
 	case f := <-c.rchan:
-		return &f, nil
+		return f, nil
 	case <-c.closeNotify:
 		return nil, errors.Trace(io.EOF)
+	case <-ctx.Done():
+		return nil, errors.Trace(ctx.Err())
 	}
 }
 
 func (c *mqttCodec) Send(ctx context.Context, f *frame.Frame) error {
-	f.Src = c.clientID
+	f.Src = c.opts.ClientID
 	msg, err := json.Marshal(f)
 	if err != nil {
 		return errors.Trace(err)
 	}
-	if f.Dst == "" {
-		f.Dst = c.dst
+	dst := f.Dst
+	if dst == "" {
+		dst = c.dst
+	}
+	if dst == "" {
+		return errors.Errorf("no destination for %s: must be specified in the call or the URL", f)
 	}
-	topic := fmt.Sprintf("%s/rpc", f.Dst)
+	topic := c.opts.topic(dst)
 	glog.V(4).Infof("Sending [%s] to [%s]", msg, topic)
-	token := c.cli.Publish(topic, 1 /* qos */, false /* retained */, msg)
+	token := c.cli.Publish(topic, c.opts.QoS, false /* retained */, msg)
 	token.Wait()
 	if err := token.Error(); err != nil {
 		return errors.Annotatef(err, "MQTT publish error")
@@ -0,0 +1,51 @@
+package codec
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestMQTTOptionsFromQuery(t *testing.T) {
+	cases := []struct {
+		query     string
+		wantTopic string
+		want      MQTTOptions
+		wantErr   bool
+	}{
+		{"", "dev1/rpc", DefaultMQTTOptions(), false},
+		{
+			"password=secret&client_id=fleet&topic_prefix=devices/&qos=0&clean_session=false",
+			"devices/dev1/rpc",
+			MQTTOptions{Password: "secret", ClientID: "fleet", TopicPrefix: "devices/", TopicSuffix: "/rpc"},
+			false,
+		},
+		{"topic_suffix=/rpc/in&qos=2", "dev1/rpc/in", MQTTOptions{TopicSuffix: "/rpc/in", QoS: 2, CleanSession: true}, false},
+		{"qos=3", "", MQTTOptions{}, true},
+		{"clean_session=maybe", "", MQTTOptions{}, true},
+		{"qso=1", "", MQTTOptions{}, true},
+	}
+	for _, tc := range cases {
+		q, err := url.ParseQuery(tc.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts := DefaultMQTTOptions()
+		err = opts.setFromQuery(q)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("%q: expected an error", tc.query)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %s", tc.query, err)
+			continue
+		}
+		if opts != tc.want {
+			t.Errorf("%q: got %+v, want %+v", tc.query, opts, tc.want)
+		}
+		if topic := opts.topic("dev1"); topic != tc.wantTopic {
+			t.Errorf("%q: got topic %q, want %q", tc.query, topic, tc.wantTopic)
+		}
+	}
+}
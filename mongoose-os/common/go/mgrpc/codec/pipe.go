@@ -0,0 +1,86 @@
+package codec
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+
+	"cesanta.com/common/go/mgrpc/frame"
+	"github.com/cesanta/errors"
+)
+
+type pipeCodec struct {
+	name string
+	in   <-chan *frame.Frame
+	out  chan<- *frame.Frame
+	peer *pipeCodec
+
+	closeNotifier chan struct{}
+	closeOnce     sync.Once
+}
+
+// Pipe creates two connected in-memory codecs: frames sent to one of them are
+// received from the other. Frames are passed through JSON encoding, so the
+// receiver gets its own copy, the way it would over a real connection.
+// Closing either end closes the pipe.
+func Pipe() (Codec, Codec) {
+	ab := make(chan *frame.Frame)
+	ba := make(chan *frame.Frame)
+	a := &pipeCodec{name: "pipe:a", in: ba, out: ab, closeNotifier: make(chan struct{})}
+	b := &pipeCodec{name: "pipe:b", in: ab, out: ba, closeNotifier: make(chan struct{})}
+	a.peer, b.peer = b, a
+	return a, b
+}
+
+func (c *pipeCodec) String() string {
+	return fmt.Sprintf("[pipeCodec %s]", c.name)
+}
+
+func (c *pipeCodec) Recv(ctx context.Context) (*frame.Frame, error) {
+	select {
+	case f := <-c.in:
+		return f, nil
+	case <-c.closeNotifier:
+		return nil, errors.Trace(io.EOF)
+	case <-ctx.Done():
+		return nil, errors.Trace(ctx.Err())
+	}
+}
+
+func (c *pipeCodec) Send(ctx context.Context, f *frame.Frame) error {
+	b, err := frame.MarshalJSON(f)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	rf := &frame.Frame{SizeHint: len(b)}
+	if err := json.Unmarshal(b, rf); err != nil {
+		return errors.Trace(err)
+	}
+	select {
+	case c.out <- rf:
+		return nil
+	case <-c.closeNotifier:
+		return errors.Trace(io.EOF)
+	case <-ctx.Done():
+		return errors.Trace(ctx.Err())
+	}
+}
+
+func (c *pipeCodec) Close() {
+	c.closeOnce.Do(func() { close(c.closeNotifier) })
+	c.peer.closeOnce.Do(func() { close(c.peer.closeNotifier) })
+}
+
+func (c *pipeCodec) CloseNotify() <-chan struct{} {
+	return c.closeNotifier
+}
+
+func (c *pipeCodec) MaxNumFrames() int {
+	return -1
+}
+
+func (c *pipeCodec) Info() ConnectionInfo {
+	return ConnectionInfo{RemoteAddr: c.peer.name, Ordered: true}
+}
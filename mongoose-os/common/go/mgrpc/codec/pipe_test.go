@@ -0,0 +1,63 @@
+package codec
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"cesanta.com/common/go/mgrpc/frame"
+	"cesanta.com/common/go/ourjson"
+)
+
+func TestPipe(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	a, b := Pipe()
+
+	for _, c := range []struct {
+		from, to Codec
+	}{
+		{a, b},
+		{b, a},
+	} {
+		sent := &frame.Frame{ID: 123, Method: "Foo.Bar", Args: ourjson.DelayMarshaling(map[string]int{"x": 1})}
+		go c.from.Send(ctx, sent)
+		got, err := c.to.Recv(ctx)
+		if err != nil {
+			t.Fatalf("%s: Recv: %s", c.to, err)
+		}
+		if got == sent {
+			t.Errorf("%s: got the same frame that has been sent, want a copy", c.to)
+		}
+		var args map[string]int
+		if err := got.Args.UnmarshalInto(&args); err != nil {
+			t.Fatalf("%s: bad args: %s", c.to, err)
+		}
+		if got.ID != 123 || got.Method != "Foo.Bar" || args["x"] != 1 {
+			t.Errorf("%s: got %s, want %s", c.to, got, sent)
+		}
+	}
+
+	a.Close()
+	select {
+	case <-b.CloseNotify():
+	default:
+		t.Errorf("closing one end must close the other")
+	}
+	if _, err := b.Recv(ctx); !IsEOF(err) {
+		t.Errorf("Recv on a closed pipe: want EOF, got %v", err)
+	}
+	if err := b.Send(ctx, &frame.Frame{ID: 1}); !IsEOF(err) {
+		t.Errorf("Send on a closed pipe: want EOF, got %v", err)
+	}
+}
+
+func TestPipeSendContext(t *testing.T) {
+	a, _ := Pipe()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	// Nobody is receiving, so Send must give up when the context is done.
+	if err := a.Send(ctx, &frame.Frame{ID: 1}); err == nil {
+		t.Errorf("Send with nobody receiving: want error, got nil")
+	}
+}
@@ -3,6 +3,8 @@ package codec
 import (
 	"context"
 	"fmt"
+	"io"
+	"math/rand"
 	"sync"
 	"time"
 
@@ -14,23 +16,111 @@ import (
 
 type ConnectFunc func(addr string) (Codec, error)
 
+// ConnState is the state of the connection maintained by the reconnect
+// wrapper.
+type ConnState int
+
+const (
+	ConnStateConnecting ConnState = iota
+	ConnStateConnected
+	ConnStateDisconnected
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case ConnStateConnecting:
+		return "connecting"
+	case ConnStateConnected:
+		return "connected"
+	case ConnStateDisconnected:
+		return "disconnected"
+	}
+	return fmt.Sprintf("ConnState(%d)", int(s))
+}
+
+// ConnStateEvent describes a change of the connection state.
+type ConnStateEvent struct {
+	State ConnState
+	// Addr is the address of the remote peer.
+	Addr string
+	// Err is the reason of disconnection or of a failed connection attempt.
+	Err error
+}
+
+func (e ConnStateEvent) String() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%s %s: %s", e.Addr, e.State, e.Err)
+	}
+	return fmt.Sprintf("%s %s", e.Addr, e.State)
+}
+
+// ReconnectOptions control how the reconnect wrapper re-establishes the
+// connection. Zero values are replaced with defaults.
+type ReconnectOptions struct {
+	// Delay after the first failed connection attempt, or after losing a
+	// connection.
+	InitialBackoff time.Duration
+	// The delay is multiplied by this factor after each failed attempt, or
+	// each connection that is lost soon after it has been established...
+	Multiplier float64
+	// ...but does not exceed this value.
+	MaxBackoff time.Duration
+	// Each delay is randomly adjusted by up to this fraction of it, in either
+	// direction, so that many clients don't reconnect at the same time.
+	Jitter float64
+	// If set, invoked on every change of the connection state.
+	OnStateChange func(ConnStateEvent)
+}
+
+const (
+	defaultInitialBackoff = 1 * time.Second
+	defaultBackoffFactor  = 2
+	defaultMaxBackoff     = 16 * time.Second
+	defaultBackoffJitter  = 0.1
+)
+
+func (o *ReconnectOptions) setDefaults() {
+	if o.InitialBackoff <= 0 {
+		o.InitialBackoff = defaultInitialBackoff
+	}
+	if o.Multiplier < 1 {
+		o.Multiplier = defaultBackoffFactor
+	}
+	if o.MaxBackoff <= 0 {
+		o.MaxBackoff = defaultMaxBackoff
+	}
+	if o.MaxBackoff < o.InitialBackoff {
+		o.MaxBackoff = o.InitialBackoff
+	}
+	if o.Jitter <= 0 || o.Jitter > 1 {
+		o.Jitter = defaultBackoffJitter
+	}
+}
+
 type reconnectWrapperCodec struct {
 	addr    string
 	connect ConnectFunc
+	opts    ReconnectOptions
 
 	lock        sync.Mutex
 	conn        Codec
 	connEstd    chan struct{}
 	nextAttempt time.Time
+	backoff     time.Duration
+	connectedAt time.Time
+	// Error which caused the current connection to be closed.
+	connErr error
 
 	closeNotifier chan struct{}
 	closeOnce     sync.Once
 }
 
-func NewReconnectWrapperCodec(addr string, connect ConnectFunc) Codec {
+func NewReconnectWrapperCodec(addr string, connect ConnectFunc, opts ReconnectOptions) Codec {
+	opts.setDefaults()
 	rwc := &reconnectWrapperCodec{
 		addr:          addr,
 		connect:       connect,
+		opts:          opts,
 		nextAttempt:   time.Now(),
 		connEstd:      make(chan struct{}), // Closed when a new connection is established.
 		closeNotifier: make(chan struct{}),
@@ -73,7 +163,19 @@ func (rwc *reconnectWrapperCodec) maintainConnection() {
 				rwc.lock.Lock()
 				rwc.conn = nil
 				rwc.connEstd = make(chan struct{})
+				err := rwc.connErr
+				rwc.connErr = nil
+				// Connections that do not last are retried with increasing
+				// delays, like failed attempts.
+				if time.Since(rwc.connectedAt) >= rwc.opts.MaxBackoff {
+					rwc.backoff = 0
+				}
+				rwc.nextAttempt = time.Now().Add(rwc.nextBackoffLocked())
 				rwc.lock.Unlock()
+				if err == nil {
+					err = io.EOF
+				}
+				rwc.notify(ConnStateDisconnected, err)
 			}
 		}
 		glog.V(2).Infof("Next attempt: %s, Now: %s, Diff: %s", rwc.nextAttempt, time.Now(), rwc.nextAttempt.Sub(time.Now()))
@@ -85,19 +187,42 @@ func (rwc *reconnectWrapperCodec) maintainConnection() {
 		}
 
 		glog.V(1).Infof("%s connecting", rwc)
+		rwc.notify(ConnStateConnecting, nil)
 		conn, err := rwc.connect(rwc.addr)
 		rwc.lock.Lock()
-		// TODO(rojer): implement backoff.
-		rwc.nextAttempt = time.Now().Add(2 * time.Second)
 		if err != nil {
+			rwc.nextAttempt = time.Now().Add(rwc.nextBackoffLocked())
 			glog.Errorf("%s connection error: %+v", rwc.stringLocked(), err)
 			rwc.lock.Unlock()
+			rwc.notify(ConnStateDisconnected, err)
 			continue
 		}
+		rwc.connectedAt = time.Now()
 		rwc.conn = conn
 		glog.Infof("%s connected", rwc.stringLocked())
 		close(rwc.connEstd)
 		rwc.lock.Unlock()
+		rwc.notify(ConnStateConnected, nil)
+	}
+}
+
+// nextBackoffLocked returns the delay before the next connection attempt.
+func (rwc *reconnectWrapperCodec) nextBackoffLocked() time.Duration {
+	if rwc.backoff == 0 {
+		rwc.backoff = rwc.opts.InitialBackoff
+	} else {
+		rwc.backoff = time.Duration(float64(rwc.backoff) * rwc.opts.Multiplier)
+		if rwc.backoff > rwc.opts.MaxBackoff {
+			rwc.backoff = rwc.opts.MaxBackoff
+		}
+	}
+	jitter := (rand.Float64()*2 - 1) * rwc.opts.Jitter
+	return time.Duration(float64(rwc.backoff) * (1 + jitter))
+}
+
+func (rwc *reconnectWrapperCodec) notify(state ConnState, err error) {
+	if rwc.opts.OnStateChange != nil {
+		rwc.opts.OnStateChange(ConnStateEvent{State: state, Addr: rwc.addr, Err: err})
 	}
 }
 
@@ -117,10 +242,11 @@ func (rwc *reconnectWrapperCodec) getConn(ctx context.Context) (Codec, error) {
 	}
 }
 
-func (rwc *reconnectWrapperCodec) closeConn() {
+func (rwc *reconnectWrapperCodec) closeConn(err error) {
 	rwc.lock.Lock()
 	defer rwc.lock.Unlock()
 	if rwc.conn != nil {
+		rwc.connErr = err
 		rwc.conn.Close()
 		rwc.conn = nil
 	}
@@ -140,7 +266,7 @@ func (rwc *reconnectWrapperCodec) Recv(ctx context.Context) (*frame.Frame, error
 		case err == nil:
 			return frame, nil
 		case IsEOF(err):
-			rwc.closeConn()
+			rwc.closeConn(err)
 		default:
 			return nil, errors.Trace(err)
 		}
@@ -156,7 +282,7 @@ func (rwc *reconnectWrapperCodec) Send(ctx context.Context, frame *frame.Frame)
 		err = conn.Send(ctx, frame)
 		if err != nil {
 			glog.V(1).Infof("%s send error: %s", rwc, err)
-			rwc.closeConn()
+			rwc.closeConn(err)
 			continue
 		}
 		return nil
@@ -165,9 +291,11 @@ func (rwc *reconnectWrapperCodec) Send(ctx context.Context, frame *frame.Frame)
 
 func (rwc *reconnectWrapperCodec) Close() {
 	rwc.closeOnce.Do(func() {
+		rwc.lock.Lock()
 		if rwc.conn != nil {
 			rwc.conn.Close()
 		}
+		rwc.lock.Unlock()
 		close(rwc.closeNotifier)
 	})
 }
@@ -177,7 +305,14 @@ func (rwc *reconnectWrapperCodec) CloseNotify() <-chan struct{} {
 }
 
 func (rwc *reconnectWrapperCodec) MaxNumFrames() int {
-	return -1
+	rwc.lock.Lock()
+	c := rwc.conn
+	rwc.lock.Unlock()
+	if c == nil {
+		// Send waits for the connection anyway.
+		return -1
+	}
+	return c.MaxNumFrames()
 }
 
 func (rwc *reconnectWrapperCodec) Info() ConnectionInfo {
@@ -0,0 +1,160 @@
+package codec
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"cesanta.com/common/go/mgrpc/frame"
+)
+
+// fakeDialer returns pipes to a peer after failing the given number of times.
+type fakeDialer struct {
+	lock     sync.Mutex
+	failures int
+	attempts int
+	peers    chan Codec
+	// Makes the peers go away right after connecting.
+	drop bool
+}
+
+func (d *fakeDialer) connect(addr string) (Codec, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.attempts++
+	if d.failures > 0 {
+		d.failures--
+		return nil, errors.New("connection refused")
+	}
+	c, peer := Pipe()
+	if d.drop {
+		peer.Close()
+	} else {
+		d.peers <- peer
+	}
+	return c, nil
+}
+
+func TestReconnectWrapper(t *testing.T) {
+	cases := []struct {
+		name     string
+		failures int
+	}{
+		{"connects at once", 0},
+		{"retries until connected", 3},
+	}
+	for _, c := range cases {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		d := &fakeDialer{failures: c.failures, peers: make(chan Codec, 2)}
+		var lock sync.Mutex
+		var states []ConnState
+		rwc := NewReconnectWrapperCodec("fake", d.connect, ReconnectOptions{
+			InitialBackoff: time.Millisecond,
+			MaxBackoff:     5 * time.Millisecond,
+			OnStateChange: func(e ConnStateEvent) {
+				lock.Lock()
+				states = append(states, e.State)
+				lock.Unlock()
+			},
+		})
+
+		// Frames are sent once connected.
+		go rwc.Send(ctx, &frame.Frame{ID: 1})
+		peer := <-d.peers
+		if f, err := peer.Recv(ctx); err != nil || f.ID != 1 {
+			t.Fatalf("%s: got %v %v, want frame 1", c.name, f, err)
+		}
+		if d.attempts != c.failures+1 {
+			t.Errorf("%s: %d connection attempts, want %d", c.name, d.attempts, c.failures+1)
+		}
+
+		// Connection is re-established once the peer goes away.
+		peer.Close()
+		peer = <-d.peers
+		go peer.Send(ctx, &frame.Frame{ID: 2})
+		if f, err := rwc.Recv(ctx); err != nil || f.ID != 2 {
+			t.Fatalf("%s: got %v %v, want frame 2", c.name, f, err)
+		}
+
+		var want []ConnState
+		for i := 0; i < c.failures; i++ {
+			want = append(want, ConnStateConnecting, ConnStateDisconnected)
+		}
+		want = append(want, ConnStateConnecting, ConnStateConnected,
+			ConnStateDisconnected, ConnStateConnecting, ConnStateConnected)
+		// The last event may be delivered after the frame.
+		for i := 0; i < 100; i++ {
+			lock.Lock()
+			n := len(states)
+			lock.Unlock()
+			if n >= len(want) {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		rwc.Close()
+		lock.Lock()
+		if len(states) != len(want) {
+			t.Errorf("%s: states %v, want %v", c.name, states, want)
+		} else {
+			for i := range want {
+				if states[i] != want[i] {
+					t.Errorf("%s: states %v, want %v", c.name, states, want)
+					break
+				}
+			}
+		}
+		lock.Unlock()
+		cancel()
+	}
+}
+
+func TestReconnectBackoff(t *testing.T) {
+	opts := ReconnectOptions{
+		InitialBackoff: 100 * time.Millisecond,
+		Multiplier:     3,
+		MaxBackoff:     time.Second,
+		Jitter:         0.2,
+	}
+	opts.setDefaults()
+	// Delays are random, so go through the sequence a few times.
+	for run := 0; run < 50; run++ {
+		rwc := &reconnectWrapperCodec{opts: opts}
+		for _, want := range []time.Duration{100, 300, 900, 1000, 1000} {
+			want *= time.Millisecond
+			got := rwc.nextBackoffLocked()
+			if lo, hi := want*8/10, want*12/10; got < lo || got > hi {
+				t.Fatalf("got delay %s, want %s..%s", got, lo, hi)
+			}
+		}
+	}
+
+	// Zero values and out of range values are replaced with defaults.
+	opts = ReconnectOptions{MaxBackoff: time.Millisecond, Jitter: 2}
+	opts.setDefaults()
+	if opts.InitialBackoff != defaultInitialBackoff || opts.MaxBackoff != defaultInitialBackoff ||
+		opts.Multiplier != defaultBackoffFactor || opts.Jitter != defaultBackoffJitter {
+		t.Errorf("got %+v", opts)
+	}
+}
+
+func TestReconnectAfterDrop(t *testing.T) {
+	d := &fakeDialer{drop: true}
+	rwc := NewReconnectWrapperCodec("fake", d.connect, ReconnectOptions{
+		InitialBackoff: 20 * time.Millisecond,
+		Multiplier:     2,
+		MaxBackoff:     time.Second,
+		Jitter:         0.1,
+	})
+	// Connections that are lost at once are retried after 0, 20, 40, 80...
+	// ms, not in a tight loop.
+	time.Sleep(200 * time.Millisecond)
+	rwc.Close()
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.attempts < 2 || d.attempts > 5 {
+		t.Errorf("%d connection attempts in 200ms, want 4", d.attempts)
+	}
+}
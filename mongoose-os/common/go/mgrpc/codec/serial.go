@@ -14,23 +14,56 @@ import (
 const (
 	eofChar byte = 0x04
 
-	// Due to lack of flow control, we send data in chunks and wait 5 ms after
-	// each chunk.
-	chunkSize  int           = 16
-	chunkDelay time.Duration = 5 * time.Millisecond
+	defaultSerialBaudRate uint = 115200
+
+	// Due to lack of flow control, by default we send data in chunks and wait
+	// 5 ms after each chunk.
+	defaultChunkSize  int           = 16
+	defaultChunkDelay time.Duration = 5 * time.Millisecond
 
 	// Period for sending initial delimeter when opening a channel, until we
 	// receive the delimeter in response
-	handshakeInterval time.Duration = 200 * time.Millisecond
+	defaultHandshakeInterval time.Duration = 200 * time.Millisecond
 
 	// Maximum time to wait for a device to handshake with us
-	handshakeTimeout time.Duration = 7400 * time.Millisecond
+	defaultHandshakeTimeout time.Duration = 7400 * time.Millisecond
 
 	interCharacterTimeout time.Duration = 200 * time.Millisecond
 )
 
+// SerialOptions are the parameters of the serial port and of the way data is
+// sent over it.
+type SerialOptions struct {
+	// Defaults to 115200.
+	BaudRate uint
+	// Enables RTS/CTS flow control.
+	HardwareFlowControl bool
+	// Data is written in chunks of ChunkSize bytes with ChunkDelay after each
+	// chunk, so that the device can keep up without flow control. Zero
+	// ChunkSize disables chunking.
+	ChunkSize  int
+	ChunkDelay time.Duration
+	// The handshake delimiter is sent every HandshakeInterval until the device
+	// responds, or HandshakeTimeout expires.
+	HandshakeInterval time.Duration
+	HandshakeTimeout  time.Duration
+}
+
+// DefaultSerialOptions returns the parameters that work with the devices'
+// default configuration.
+func DefaultSerialOptions() SerialOptions {
+	return SerialOptions{
+		BaudRate:          defaultSerialBaudRate,
+		ChunkSize:         defaultChunkSize,
+		ChunkDelay:        defaultChunkDelay,
+		HandshakeInterval: defaultHandshakeInterval,
+		HandshakeTimeout:  defaultHandshakeTimeout,
+	}
+}
+
 type serialCodec struct {
 	portName        string
+	opts            SerialOptions
 	conn            serial.Serial
 	lastEOFTime     time.Time
 	handsShaken     bool
@@ -44,11 +77,15 @@ type serialCodec struct {
 	closeLock sync.RWMutex
 }
 
-func Serial(ctx context.Context, portName string, junkHandler func(junk []byte)) (Codec, error) {
-	glog.Infof("Opening %s...", portName)
+func Serial(ctx context.Context, portName string, opts StreamOptions, sopts SerialOptions) (Codec, error) {
+	if sopts.BaudRate == 0 {
+		sopts.BaudRate = defaultSerialBaudRate
+	}
+	glog.Infof("Opening %s at %d baud...", portName, sopts.BaudRate)
 	conn, err := serial.Open(serial.OpenOptions{
 		PortName:              portName,
-		BaudRate:              115200,
+		BaudRate:              sopts.BaudRate,
+		HardwareFlowControl:   sopts.HardwareFlowControl,
 		DataBits:              8,
 		ParityMode:            serial.PARITY_NONE,
 		StopBits:              1,
@@ -63,11 +100,25 @@ func Serial(ctx context.Context, portName string, junkHandler func(junk []byte))
 	// Flush any data that might be not yet read
 	conn.Flush()
 
+	return newSerialCodec(portName, conn, opts, sopts), nil
+}
+
+func newSerialCodec(portName string, conn serial.Serial, opts StreamOptions, sopts SerialOptions) Codec {
+	if sopts.HandshakeInterval <= 0 {
+		sopts.HandshakeInterval = defaultHandshakeInterval
+	}
+	if sopts.HandshakeTimeout <= 0 {
+		sopts.HandshakeTimeout = defaultHandshakeTimeout
+	}
+	// Devices only answer the bare EOT handshake, so capabilities are not
+	// offered until the device announces its own.
+	opts.waitForPeerCaps = true
 	return StreamConn(&serialCodec{
 		portName:    portName,
+		opts:        sopts,
 		conn:        conn,
 		handsShaken: false,
-	}, junkHandler), nil
+	}, opts)
 }
 
 func (c *serialCodec) connRead(buf []byte) (read int, err error) {
@@ -114,7 +165,7 @@ func (c *serialCodec) Read(buf []byte) (read int, err error) {
 }
 
 func (c *serialCodec) Write(b []byte) (written int, err error) {
-	tch := time.After(handshakeTimeout)
+	tch := time.After(c.opts.HandshakeTimeout)
 	c.writeLock.Lock()
 	defer c.writeLock.Unlock()
 	c.setHandsShaken(false)
@@ -129,7 +180,7 @@ func (c *serialCodec) Write(b []byte) (written int, err error) {
 			return 0, errors.Trace(err)
 		}
 		glog.V(1).Infof(" ...sent frame delimiter.")
-		time.Sleep(handshakeInterval)
+		time.Sleep(c.opts.HandshakeInterval)
 
 		select {
 		case <-tch:
@@ -138,6 +189,10 @@ func (c *serialCodec) Write(b []byte) (written int, err error) {
 		}
 	}
 	// Device is ready, send data.
+	chunkSize := c.opts.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = len(b)
+	}
 	for i := 0; i < len(b); i += chunkSize {
 		n, err := c.connWrite(b[i:min(i+chunkSize, len(b))])
 		glog.V(4).Infof("written to serial: [%s]", string(b[i:i+n]))
@@ -146,7 +201,9 @@ func (c *serialCodec) Write(b []byte) (written int, err error) {
 			c.Close()
 			return written, errors.Trace(err)
 		}
-		time.Sleep(chunkDelay)
+		if c.opts.ChunkDelay > 0 {
+			time.Sleep(c.opts.ChunkDelay)
+		}
 	}
 	return written, nil
 }
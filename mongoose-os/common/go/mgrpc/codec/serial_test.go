@@ -0,0 +1,139 @@
+package codec
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"cesanta.com/common/go/mgrpc/frame"
+	"github.com/cesanta/go-serial/serial"
+)
+
+// pipeSerial is a serial port connected to a pipe.
+type pipeSerial struct {
+	serial.Serial
+	c net.Conn
+}
+
+func (s *pipeSerial) Read(b []byte) (int, error)  { return s.c.Read(b) }
+func (s *pipeSerial) Write(b []byte) (int, error) { return s.c.Write(b) }
+func (s *pipeSerial) Close() error                { return s.c.Close() }
+func (s *pipeSerial) Flush() error                { return nil }
+
+// legacyDevice emulates the firmware which only knows the bare EOT handshake:
+// it answers a frame which is exactly EOT with EOT, and anything else is
+// taken as a request. Requests are answered with an empty result, and kept.
+type legacyDevice struct {
+	c net.Conn
+
+	lock   sync.Mutex
+	frames []string
+}
+
+func (d *legacyDevice) serve() {
+	var buf []byte
+	b := make([]byte, 1000)
+	for {
+		n, err := d.c.Read(b)
+		if err != nil {
+			return
+		}
+		buf = append(buf, b[:n]...)
+		for {
+			i := strings.Index(string(buf), streamFrameDelimiter)
+			if i < 0 {
+				break
+			}
+			f := string(buf[:i])
+			buf = buf[i+len(streamFrameDelimiter):]
+			switch {
+			case f == "":
+			case f == string(eofChar):
+				d.c.Write([]byte(streamFrameDelimiter + f + streamFrameDelimiter))
+			default:
+				d.lock.Lock()
+				d.frames = append(d.frames, f)
+				d.lock.Unlock()
+				req := &frame.Frame{}
+				if err := json.Unmarshal([]byte(f), req); err == nil {
+					fmt.Fprintf(d.c, `%s{"id":%d,"result":{}}%s`, streamFrameDelimiter, req.ID, streamFrameDelimiter)
+				}
+			}
+		}
+	}
+}
+
+func TestSerialHandshake(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	sopts := SerialOptions{HandshakeInterval: 10 * time.Millisecond}
+	opts := StreamOptions{Client: true, UBJSON: true, Checksums: true}
+
+	call := func(t *testing.T, c Codec) {
+		t.Helper()
+		go func() {
+			// The handshake is answered by the receiving side.
+			for id := int64(1); id <= 2; id++ {
+				if err := c.Send(ctx, &frame.Frame{ID: id, Method: "Test"}); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+		for id := int64(1); id <= 2; id++ {
+			f, err := c.Recv(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if f.ID != id {
+				t.Errorf("got response %+v, want ID %d", f, id)
+			}
+		}
+	}
+
+	t.Run("legacy", func(t *testing.T) {
+		cc, dc := net.Pipe()
+		c := newSerialCodec("test", &pipeSerial{c: cc}, opts, sopts)
+		defer c.Close()
+		d := &legacyDevice{c: dc}
+		go d.serve()
+		call(t, c)
+		d.lock.Lock()
+		defer d.lock.Unlock()
+		for _, f := range d.frames {
+			if !strings.HasPrefix(f, "{") {
+				t.Errorf("device got %q, want only JSON frames", f)
+			}
+		}
+	})
+
+	t.Run("caps", func(t *testing.T) {
+		cc, dc := net.Pipe()
+		c := newSerialCodec("test", &pipeSerial{c: cc}, opts, sopts)
+		defer c.Close()
+		d := TCP(dc, StreamOptions{UBJSON: true, Checksums: true})
+		defer d.Close()
+		go func() {
+			for {
+				f, err := d.Recv(ctx)
+				if err != nil {
+					return
+				}
+				d.Send(ctx, &frame.Frame{ID: f.ID, Result: f.Args})
+			}
+		}()
+		call(t, c)
+		for _, c := range []Codec{c, d} {
+			scc := c.(*streamConnectionCodec)
+			scc.encLock.Lock()
+			if !scc.ubjsonOut || !scc.checksumsOut {
+				t.Errorf("%s: got UBJSON %t, checksums %t", scc, scc.ubjsonOut, scc.checksumsOut)
+			}
+			scc.encLock.Unlock()
+		}
+	})
+}
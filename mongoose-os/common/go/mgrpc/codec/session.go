@@ -0,0 +1,288 @@
+package codec
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"cesanta.com/common/go/mgrpc/frame"
+	"cesanta.com/common/go/ourjson"
+	"github.com/cesanta/errors"
+	"github.com/golang/glog"
+)
+
+const (
+	SessionDirSend = "send"
+	SessionDirRecv = "recv"
+
+	// Maximum length of a line in a recorded session.
+	maxSessionLineSize = 16 * 1024 * 1024
+)
+
+// SessionEntry is a line of a recorded session.
+type SessionEntry struct {
+	Time time.Time `json:"t"`
+	// Dir is either SessionDirSend or SessionDirRecv.
+	Dir   string       `json:"dir"`
+	Frame *frame.Frame `json:"frame"`
+}
+
+type recordingCodec struct {
+	Codec
+	lock   sync.Mutex
+	w      io.Writer
+	enc    *json.Encoder
+	closed bool
+}
+
+// RecordSession wraps the codec so that all the frames sent and received are
+// written to w as JSON lines (see SessionEntry). The session can be played
+// back with ReplaySession. If w is an io.Closer, it's closed along with the
+// codec.
+func RecordSession(c Codec, w io.Writer) Codec {
+	return &recordingCodec{Codec: c, w: w, enc: json.NewEncoder(w)}
+}
+
+func (c *recordingCodec) String() string {
+	return fmt.Sprintf("[recordingCodec %v]", c.Codec)
+}
+
+func (c *recordingCodec) record(dir string, f *frame.Frame) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		return
+	}
+	if err := c.enc.Encode(&SessionEntry{Time: time.Now(), Dir: dir, Frame: f}); err != nil {
+		glog.Errorf("%s: failed to record a frame: %s", c, err)
+	}
+}
+
+func (c *recordingCodec) Recv(ctx context.Context) (*frame.Frame, error) {
+	f, err := c.Codec.Recv(ctx)
+	if err == nil {
+		c.record(SessionDirRecv, f)
+	}
+	return f, err
+}
+
+func (c *recordingCodec) Send(ctx context.Context, f *frame.Frame) error {
+	// Recorded before sending, so that the response never precedes it.
+	c.record(SessionDirSend, f)
+	return c.Codec.Send(ctx, f)
+}
+
+func (c *recordingCodec) Close() {
+	c.Codec.Close()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		return
+	}
+	c.closed = true
+	if wc, ok := c.w.(io.Closer); ok {
+		if err := wc.Close(); err != nil {
+			glog.Errorf("%s: failed to close the recording: %s", c, err)
+		}
+	}
+}
+
+type replayCodec struct {
+	entries []SessionEntry
+	// Number of the send entry each recv entry is a response to, -1 if it's
+	// not a response to a recorded request.
+	respondsTo []int
+	// Send entries that have been matched, recv entries that have been played.
+	done []bool
+
+	lock  sync.Mutex
+	queue []*frame.Frame
+	avail chan struct{}
+
+	closeNotifier chan struct{}
+	closeOnce     sync.Once
+}
+
+// ReplaySession creates a codec that plays back a session recorded with
+// RecordSession, acting as the peer the session was recorded with.
+// A request sent to the codec is matched against the recorded ones by method
+// and args, and the responses to the matched request are received from the
+// codec, with the ID of the request sent. Recorded requests from the peer are
+// received once all the frames sent before them have been matched.
+func ReplaySession(r io.Reader) (Codec, error) {
+	c := &replayCodec{
+		avail:         make(chan struct{}, 1),
+		closeNotifier: make(chan struct{}),
+	}
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, maxSessionLineSize)
+	for s.Scan() {
+		if len(s.Bytes()) == 0 {
+			continue
+		}
+		var e SessionEntry
+		if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+			return nil, errors.Annotatef(err, "line %d", len(c.entries)+1)
+		}
+		if e.Frame == nil || (e.Dir != SessionDirSend && e.Dir != SessionDirRecv) {
+			return nil, errors.Errorf("line %d: invalid entry", len(c.entries)+1)
+		}
+		c.entries = append(c.entries, e)
+	}
+	if err := s.Err(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	c.respondsTo = make([]int, len(c.entries))
+	c.done = make([]bool, len(c.entries))
+	for i, e := range c.entries {
+		c.respondsTo[i] = -1
+		if e.Dir != SessionDirRecv || e.Frame.IsRequest() {
+			continue
+		}
+		for j := i - 1; j >= 0; j-- {
+			se := c.entries[j]
+			if se.Dir == SessionDirSend && se.Frame.IsRequest() && se.Frame.ID == e.Frame.ID {
+				c.respondsTo[i] = j
+				break
+			}
+		}
+	}
+	c.lock.Lock()
+	c.playUnsolicitedLocked()
+	c.lock.Unlock()
+	return c, nil
+}
+
+func (c *replayCodec) String() string {
+	return "[replayCodec]"
+}
+
+// canonicalJSON returns the canonical JSON representation of the message, so
+// that equal messages compare equal regardless of formatting.
+func canonicalJSON(m ourjson.RawMessage) string {
+	if !m.IsInitialized() {
+		return ""
+	}
+	var v interface{}
+	if err := m.UnmarshalInto(&v); err != nil {
+		return m.String()
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+// playUnsolicitedLocked queues recorded frames from the peer that are not
+// responses, once all the frames sent before them have been matched.
+func (c *replayCodec) playUnsolicitedLocked() {
+	for i, e := range c.entries {
+		if c.done[i] {
+			continue
+		}
+		if e.Dir == SessionDirSend && e.Frame.IsRequest() {
+			// Not matched yet, nothing after it can be played.
+			return
+		}
+		if e.Dir == SessionDirRecv && c.respondsTo[i] < 0 {
+			c.done[i] = true
+			c.enqueueLocked(e.Frame)
+		}
+	}
+}
+
+func (c *replayCodec) enqueueLocked(f *frame.Frame) {
+	c.queue = append(c.queue, f)
+	c.signalLocked()
+}
+
+// signalLocked wakes up a receiver waiting for frames.
+func (c *replayCodec) signalLocked() {
+	select {
+	case c.avail <- struct{}{}:
+	default:
+	}
+}
+
+func (c *replayCodec) Send(ctx context.Context, f *frame.Frame) error {
+	select {
+	case <-c.closeNotifier:
+		return errors.Trace(io.EOF)
+	default:
+	}
+	if !f.IsRequest() {
+		glog.V(2).Infof("%s: ignoring response %s", c, f)
+		return nil
+	}
+	args := canonicalJSON(f.Args)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	match := -1
+	for i, e := range c.entries {
+		if !c.done[i] && e.Dir == SessionDirSend && e.Frame.Method == f.Method && canonicalJSON(e.Frame.Args) == args {
+			match = i
+			break
+		}
+	}
+	if match < 0 {
+		glog.Errorf("%s: no recorded request matches %s", c, f)
+		c.enqueueLocked(frame.NewResponseFrame(f.Dst, f.Src, "", &frame.Response{
+			ID:        f.ID,
+			Status:    404,
+			StatusMsg: fmt.Sprintf("no recorded request matches %s", f.Method),
+		}))
+		return nil
+	}
+	c.done[match] = true
+	for i, e := range c.entries {
+		if c.respondsTo[i] == match {
+			rf := *e.Frame
+			rf.ID = f.ID
+			c.done[i] = true
+			c.enqueueLocked(&rf)
+		}
+	}
+	c.playUnsolicitedLocked()
+	return nil
+}
+
+func (c *replayCodec) Recv(ctx context.Context) (*frame.Frame, error) {
+	for {
+		c.lock.Lock()
+		if len(c.queue) > 0 {
+			f := c.queue[0]
+			c.queue = c.queue[1:]
+			if len(c.queue) > 0 {
+				c.signalLocked()
+			}
+			c.lock.Unlock()
+			return f, nil
+		}
+		c.lock.Unlock()
+		select {
+		case <-c.avail:
+		case <-c.closeNotifier:
+			return nil, errors.Trace(io.EOF)
+		case <-ctx.Done():
+			return nil, errors.Trace(ctx.Err())
+		}
+	}
+}
+
+func (c *replayCodec) Close() {
+	c.closeOnce.Do(func() { close(c.closeNotifier) })
+}
+
+func (c *replayCodec) CloseNotify() <-chan struct{} {
+	return c.closeNotifier
+}
+
+func (c *replayCodec) MaxNumFrames() int {
+	return -1
+}
+
+func (c *replayCodec) Info() ConnectionInfo {
+	return ConnectionInfo{RemoteAddr: "replay"}
+}
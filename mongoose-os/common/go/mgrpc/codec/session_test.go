@@ -0,0 +1,112 @@
+package codec
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"cesanta.com/common/go/mgrpc/frame"
+	"cesanta.com/common/go/ourjson"
+)
+
+type closeBuffer struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (b *closeBuffer) Close() error {
+	b.closed = true
+	return nil
+}
+
+func TestRecordAndReplaySession(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Record a session with a peer which answers requests with their args
+	// and sends a notification in response to the first request.
+	buf := &closeBuffer{}
+	host, dev := Pipe()
+	rc := RecordSession(host, buf)
+	go func() {
+		for i := 0; ; i++ {
+			f, err := dev.Recv(ctx)
+			if err != nil {
+				return
+			}
+			if i == 0 {
+				dev.Send(ctx, &frame.Frame{ID: 777, Method: "Notify"})
+			}
+			dev.Send(ctx, &frame.Frame{ID: f.ID, Result: f.Args})
+		}
+	}()
+	requests := []*frame.Frame{
+		{ID: 1, Method: "Config.Get", Args: ourjson.RawJSON([]byte(`{"key": "a"}`))},
+		{ID: 2, Method: "Config.Get", Args: ourjson.RawJSON([]byte(`{"key": "b"}`))},
+	}
+	for _, f := range requests {
+		if err := rc.Send(ctx, f); err != nil {
+			t.Fatal(err)
+		}
+		for {
+			rf, err := rc.Recv(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !rf.IsRequest() {
+				break
+			}
+		}
+	}
+	rc.Close()
+	if !buf.closed {
+		t.Errorf("recording has not been closed along with the codec")
+	}
+
+	c, err := ReplaySession(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("ReplaySession: %s\n%s", err, buf)
+	}
+	cases := []struct {
+		id         int64
+		method     string
+		args       string
+		wantResult string
+		wantStatus int
+	}{
+		// Order and IDs differ from the recorded ones, so does formatting.
+		{100, "Config.Get", `{"key":"b"}`, `{"key":"b"}`, 0},
+		{101, "Config.Get", `{ "key" : "a" }`, `{"key":"a"}`, 0},
+		// Recorded requests are only matched once.
+		{102, "Config.Get", `{"key":"a"}`, "", 404},
+		{103, "Config.Set", `{"key":"a"}`, "", 404},
+	}
+	gotNotify := false
+	for _, tc := range cases {
+		err := c.Send(ctx, &frame.Frame{ID: tc.id, Method: tc.method, Args: ourjson.RawJSON([]byte(tc.args))})
+		if err != nil {
+			t.Fatal(err)
+		}
+		rf, err := c.Recv(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rf.Method == "Notify" {
+			gotNotify = true
+			if rf, err = c.Recv(ctx); err != nil {
+				t.Fatal(err)
+			}
+		}
+		resp := frame.NewResponseFromFrame(rf)
+		if resp.ID != tc.id || resp.Status != tc.wantStatus {
+			t.Errorf("%d: got %s, want status %d", tc.id, resp, tc.wantStatus)
+		}
+		if tc.wantResult != "" && canonicalJSON(resp.Response) != tc.wantResult {
+			t.Errorf("%d: got %s, want %s", tc.id, resp.Response, tc.wantResult)
+		}
+	}
+	if !gotNotify {
+		t.Errorf("recorded notification has not been played")
+	}
+}
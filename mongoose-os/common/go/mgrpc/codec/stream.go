@@ -3,18 +3,43 @@ package codec
 import (
 	"bytes"
 	"context"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"strings"
 	"sync"
+	"sync/atomic"
 
 	"cesanta.com/common/go/mgrpc/frame"
 	"github.com/cesanta/errors"
+	"github.com/cesanta/ubjson"
 	"github.com/golang/glog"
 )
 
 const (
 	streamFrameDelimiter string = `"""`
+
+	// Frames that start with these bytes are not JSON frames. All numbers are
+	// 4 bytes big endian.
+	// """<STX><length><inverted length><UBJSON data>"""
+	ubjsonFrameMarker byte = 0x02
+	// """<SOH><length><inverted length><CRC32 of data><JSON data>"""
+	checksummedJSONFrameMarker byte = 0x01
+	// Same as above, with UBJSON data.
+	checksummedUBJSONFrameMarker byte = 0x03
+
+	// The handshake, """<EOT>cap1|cap2""", carries the capabilities the sender
+	// supports. Clients send it along with their first frame, and servers
+	// answer with the capabilities both sides support. A bare EOT is the
+	// handshake of the peers that support none; servers that support some
+	// answer it with their capabilities, and clients that wait for that
+	// (see StreamOptions.waitForPeerCaps) send theirs only then.
+	capUBJSON    = "ubjson"
+	capChecksums = "crc32"
+
+	maxBinaryFrameSize = 16 * 1024 * 1024
 )
 
 var wantRead = errors.New("wantRead")
@@ -40,8 +65,10 @@ type streamConnectionCodec struct {
 	lastFrameEof bool
 	eofLock      sync.Mutex
 
-	// Rx buffer and its lock.
+	// Rx buffer, frames received in a batch but not returned yet, and their
+	// lock.
 	rxBuf     []byte
+	rxQueue   []*frame.Frame
 	rxBufLock sync.Mutex
 
 	// A channel that gets closed once the underlying connection has been closed,
@@ -50,14 +77,61 @@ type streamConnectionCodec struct {
 	closeOnce     sync.Once
 
 	junkHandler func(junk []byte)
+
+	// Frame encoding negotiation state and its lock.
+	opts         StreamOptions
+	capsSent     bool
+	peerCaps     bool
+	ubjsonOut    bool
+	checksumsOut bool
+	encLock      sync.Mutex
+
+	// Number of frames dropped because of checksum mismatch, accessed
+	// atomically.
+	corruptFrames uint64
+
+	// Set in JSON-RPC mode.
+	jsonRPC *jsonRPCSession
+}
+
+// StreamOptions control the stream connection codec.
+type StreamOptions struct {
+	// JunkHandler is called with the data received outside of frames.
+	JunkHandler func(junk []byte)
+	// UBJSON enables binary UBJSON frames. Both sides of the connection
+	// always accept JSON frames, so if the peer does not support UBJSON,
+	// frames are sent as JSON.
+	UBJSON bool
+	// Client makes the codec send its capabilities in the handshake. The
+	// handshake is answered by the peers that are not clients. Peers that
+	// don't know about capabilities don't answer, and nothing is used.
+	Client bool
+	// Checksums enables frames with length and CRC32, which let corrupted
+	// frames be detected and dropped without losing sync. Checksummed frames
+	// are accepted regardless of this option.
+	Checksums bool
+	// JSONRPC makes the codec exchange JSON-RPC 2.0 messages, including
+	// batches, instead of frames. UBJSON is not used then.
+	JSONRPC bool
+
+	// waitForPeerCaps makes the client send its capabilities only after the
+	// peer has announced its own, so that peers which only know the bare
+	// handshake never see them.
+	waitForPeerCaps bool
 }
 
-func StreamConn(conn streamConn, junkHandler func(junk []byte)) Codec {
-	return &streamConnectionCodec{
+func StreamConn(conn streamConn, opts StreamOptions) Codec {
+	scc := &streamConnectionCodec{
 		conn:          conn,
 		closeNotifier: make(chan struct{}),
-		junkHandler:   junkHandler,
+		junkHandler:   opts.JunkHandler,
+		opts:          opts,
 	}
+	if opts.JSONRPC {
+		scc.opts.UBJSON = false
+		scc.jsonRPC = &jsonRPCSession{}
+	}
+	return scc
 }
 
 func (scc *streamConnectionCodec) String() string {
@@ -79,106 +153,240 @@ func tailMatch(haystack, needle []byte) int {
 // frameFromRxBuf tries to get frame from rx buffer, returns a frame or nil if
 // there are no valid frames received.
 func (scc *streamConnectionCodec) frameFromRxBuf() (*frame.Frame, error) {
-	var err error
-	var junk, frameData, remainder []byte
-	var junkLen, frameBegin, frameDataBegin, frameDataEnd, frameEnd int
-	remainder = scc.rxBuf
-	frameBegin = bytes.Index(remainder, []byte(streamFrameDelimiter))
-	frameEnd = -1
-	// Yield stuff before begin as junk, except suffix which can become part of a match.
-	if frameBegin >= 0 {
-		junkLen = frameBegin
-		// It's a beginning of a frame if it is followed by an opening brace.
-		frameDataBegin = frameBegin + len(streamFrameDelimiter)
-		if frameDataBegin < len(remainder) {
-			if remainder[frameDataBegin] != '{' && remainder[frameDataBegin] != eofChar {
-				// It's some random junk or maybe we lost sync, skip the thing.
-				junkLen += len(streamFrameDelimiter)
-				frameBegin = -1
-				frameDataBegin = -1
-			}
-		} else {
-			// Wait for one more byte.
-			frameBegin = -1
-			frameDataBegin = -1
-			err = wantRead
-		}
+	delim := []byte(streamFrameDelimiter)
+	frameBegin := bytes.Index(scc.rxBuf, delim)
+	if frameBegin < 0 {
+		// Yield everything as junk, except suffix which can become part of a match.
+		scc.consumeJunk(len(scc.rxBuf) - tailMatch(scc.rxBuf, delim))
+		return nil, wantRead
+	}
+	// Yield stuff before begin as junk.
+	scc.consumeJunk(frameBegin)
+	if len(scc.rxBuf) <= len(delim) {
+		// Wait for one more byte.
+		return nil, wantRead
+	}
+	switch scc.rxBuf[len(delim)] {
+	case '{', '[', eofChar:
+		return scc.textFrameFromRxBuf()
+	case ubjsonFrameMarker:
+		return scc.ubjsonFrameFromRxBuf()
+	case checksummedJSONFrameMarker, checksummedUBJSONFrameMarker:
+		return scc.checksummedFrameFromRxBuf()
+	default:
+		// It's some random junk or maybe we lost sync, skip the thing.
+		scc.consumeJunk(len(delim))
+		return nil, nil
+	}
+}
+
+// textFrameFromRxBuf parses a frame which begins at the start of rx buffer
+// and ends with a delimiter.
+func (scc *streamConnectionCodec) textFrameFromRxBuf() (*frame.Frame, error) {
+	delim := []byte(streamFrameDelimiter)
+	var frameData []byte
+	frameDataEnd := bytes.Index(scc.rxBuf[len(delim):], delim)
+	if frameDataEnd >= 0 {
+		frameData = scc.rxBuf[len(delim) : len(delim)+frameDataEnd]
+		defer scc.consume(len(delim)*2 + frameDataEnd)
 	} else {
-		junkLen = len(scc.rxBuf) - tailMatch(scc.rxBuf, []byte(streamFrameDelimiter))
-		err = wantRead
-	}
-	if junkLen > 0 {
-		junk = scc.rxBuf[:junkLen]
-		remainder = scc.rxBuf[junkLen:]
-		if scc.junkHandler != nil {
-			scc.junkHandler(junk)
-		} else {
-			glog.V(4).Infof("junk: %s", junk)
+		// We have not received frame delimeter, so let's see if we've got EOF then
+		scc.eofLock.Lock()
+		eof := scc.eof
+		if eof {
+			// Yes we have EOF. If we were waiting so we'll consider all data in the Rx buffer as a frame
+			scc.lastFrameEof = true
 		}
-	}
-	if frameBegin >= 0 && len(remainder) >= len(streamFrameDelimiter)*2 {
-		frameDataEnd = bytes.Index(scc.rxBuf[frameDataBegin:], []byte(streamFrameDelimiter))
-		if frameDataEnd >= 0 {
-			frameDataEnd += frameDataBegin
-			frameEnd = frameDataEnd + len(streamFrameDelimiter)
-		} else {
-			// We have not received frame delimeter, so let's see if we've got EOF then
-			scc.eofLock.Lock()
-			if scc.eof {
-				// Yes we have EOF. If we were waiting so we'll consider all data in the Rx buffer as a frame
-				frameEnd = len(remainder)
-				scc.lastFrameEof = true
-			}
-			scc.eofLock.Unlock()
+		scc.eofLock.Unlock()
+		if !eof {
+			return nil, wantRead
 		}
+		frameData = scc.rxBuf[len(delim):]
+		defer scc.consume(len(scc.rxBuf))
+	}
+	glog.V(4).Infof("frame: '%s'", frameData)
+	if len(frameData) == 0 {
+		return nil, nil
 	}
-	if frameDataBegin > 0 && frameDataEnd > 0 {
-		frameData = scc.rxBuf[frameDataBegin:frameDataEnd]
-		remainder = scc.rxBuf[frameEnd:]
+
+	// Check if the frame needs special treatment
+	handled, err := scc.conn.PreprocessFrame(frameData)
+	if err != nil {
+		return nil, errors.Trace(err)
 	}
-	glog.V(4).Infof("len %d junkLen %d frameBegin %d frameEnd %d remLen %d '%s' '%s' '%s'", len(scc.rxBuf), junkLen, frameBegin, frameEnd, len(remainder), junk, frameData, remainder)
-	if len(remainder) != len(scc.rxBuf) {
-		// Update rxBuf to contain only remainder of the data. We create a new slice
-		// instead of just doing "scc.rxBuf = remainder", because then underlying
-		// array of rxBuf would constantly grow, and memory for parsed data will
-		// never be reclaimed.
-		scc.rxBuf = make([]byte, len(remainder))
-		copy(scc.rxBuf, remainder)
+	if handled {
+		// The frame has been treated specially, so here we just ignore it.
+		return nil, nil
+	}
+	if frameData[0] == eofChar {
+		return nil, errors.Trace(scc.handleCapsFrame(frameData))
 	}
 
-	if len(frameData) > 0 {
-		// Check if the frame needs special treatment
-		handled, err := scc.conn.PreprocessFrame(frameData)
-		if err != nil {
+	// Try to parse frameData.
+	f, err := scc.unmarshalJSON(frameData)
+	if err != nil {
+		// There was an error during parsing, so just log the error and drop the
+		// erroneous data
+		glog.Errorf("%s: failed to parse frame: %#v %+v", scc, string(frameData), err)
+		return nil, nil
+	}
+	return f, nil
+}
+
+// unmarshalJSON decodes a JSON frame, or a JSON-RPC message in JSON-RPC mode.
+// If there is a batch of messages, the first one is returned and the rest are
+// queued. Invalid JSON-RPC messages that are not part of a batch waiting for
+// responses are answered right away.
+func (scc *streamConnectionCodec) unmarshalJSON(data []byte) (*frame.Frame, error) {
+	if scc.jsonRPC == nil {
+		f := &frame.Frame{SizeHint: len(data)}
+		if err := json.Unmarshal(data, f); err != nil {
 			return nil, errors.Trace(err)
 		}
-		if handled {
-			// The frame has been treated specially, so here we just ignore it.
-			return nil, nil
+		return f, nil
+	}
+	fs, resp, err := scc.jsonRPC.unmarshal(data)
+	if resp != nil {
+		if err := scc.sendPayload(resp); err != nil {
+			glog.Errorf("%s: failed to respond to an invalid message: %s", scc, err)
 		}
+	}
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if len(fs) == 0 {
+		return nil, nil
+	}
+	scc.rxQueue = append(scc.rxQueue, fs[1:]...)
+	return fs[0], nil
+}
 
-		// Try to parse frameData.
-		frame := &frame.Frame{SizeHint: len(frameData)}
-		err = json.Unmarshal(frameData, frame)
+// ubjsonFrameFromRxBuf parses a binary frame which begins at the start of rx
+// buffer. Binary frames may contain delimiters, so their length is sent
+// explicitly, along with its inverted copy, so that a corrupted length does
+// not make us wait for data that will never arrive.
+func (scc *streamConnectionCodec) ubjsonFrameFromRxBuf() (*frame.Frame, error) {
+	delim := []byte(streamFrameDelimiter)
+	hdrLen := len(delim) + 1 + 8
+	if len(scc.rxBuf) < hdrLen {
+		return nil, wantRead
+	}
+	hdr := scc.rxBuf[len(delim)+1:]
+	if l := binary.BigEndian.Uint32(hdr); ^l != binary.BigEndian.Uint32(hdr[4:]) || l > maxBinaryFrameSize {
+		scc.frameCorrupted("bad header")
+		scc.consumeJunk(len(delim))
+		return nil, nil
+	}
+	dataLen := int(binary.BigEndian.Uint32(hdr))
+	frameEnd := hdrLen + dataLen + len(delim)
+	if len(scc.rxBuf) < frameEnd {
+		return nil, wantRead
+	}
+	if !bytes.Equal(scc.rxBuf[hdrLen+dataLen:frameEnd], delim) {
+		// We must have lost sync, skip the delimiter and look for the next one.
+		scc.frameCorrupted("no delimiter after frame")
+		scc.consumeJunk(len(delim))
+		return nil, nil
+	}
+	frameData := scc.rxBuf[hdrLen : hdrLen+dataLen]
+	defer scc.consume(frameEnd)
 
-		if err != nil {
-			// There was an error during parsing, so just log the error and drop the
-			// erroneous data
-			glog.Errorf("%s: failed to parse frame: %#v %+v", scc, string(frameData), err)
-			return nil, nil
-		}
-		return frame, nil
+	f := &frame.Frame{SizeHint: dataLen}
+	if err := ubjson.Unmarshal(frameData, f); err != nil {
+		glog.Errorf("%s: failed to parse UBJSON frame: %+v", scc, err)
+		return nil, nil
+	}
+	return f, nil
+}
+
+// checksummedFrameFromRxBuf parses a checksummed frame which begins at the
+// start of rx buffer. The length is sent along with its inverted copy, so that
+// a corrupted length does not make us wait for data that will never arrive.
+func (scc *streamConnectionCodec) checksummedFrameFromRxBuf() (*frame.Frame, error) {
+	delim := []byte(streamFrameDelimiter)
+	hdrLen := len(delim) + 1 + 12
+	if len(scc.rxBuf) < hdrLen {
+		return nil, wantRead
+	}
+	marker := scc.rxBuf[len(delim)]
+	hdr := scc.rxBuf[len(delim)+1:]
+	dataLen := binary.BigEndian.Uint32(hdr)
+	if ^dataLen != binary.BigEndian.Uint32(hdr[4:]) || dataLen > maxBinaryFrameSize {
+		scc.frameCorrupted("bad header")
+		scc.consumeJunk(len(delim))
+		return nil, nil
+	}
+	checksum := binary.BigEndian.Uint32(hdr[8:])
+	frameEnd := hdrLen + int(dataLen) + len(delim)
+	if len(scc.rxBuf) < frameEnd {
+		return nil, wantRead
+	}
+	if !bytes.Equal(scc.rxBuf[hdrLen+int(dataLen):frameEnd], delim) {
+		scc.frameCorrupted("no delimiter after frame")
+		scc.consumeJunk(len(delim))
+		return nil, nil
+	}
+	frameData := scc.rxBuf[hdrLen : hdrLen+int(dataLen)]
+	defer scc.consume(frameEnd)
+	if crc32.ChecksumIEEE(frameData) != checksum {
+		scc.frameCorrupted("checksum mismatch")
+		return nil, nil
+	}
+
+	var f *frame.Frame
+	var err error
+	if marker == checksummedUBJSONFrameMarker {
+		f = &frame.Frame{SizeHint: int(dataLen)}
+		err = ubjson.Unmarshal(frameData, f)
 	} else {
-		if frameDataBegin > 0 {
-			err = wantRead
-		}
-		return nil, err
+		f, err = scc.unmarshalJSON(frameData)
+	}
+	if err != nil {
+		glog.Errorf("%s: failed to parse checksummed frame: %+v", scc, err)
+		return nil, nil
 	}
+	return f, nil
+}
+
+// frameCorrupted counts a corrupted frame.
+func (scc *streamConnectionCodec) frameCorrupted(reason string) {
+	n := atomic.AddUint64(&scc.corruptFrames, 1)
+	glog.Errorf("%s: dropping corrupted frame (%s), %d so far", scc, reason, n)
+}
+
+// consumeJunk removes n bytes from the beginning of rx buffer and passes them
+// to the junk handler.
+func (scc *streamConnectionCodec) consumeJunk(n int) {
+	if n <= 0 {
+		return
+	}
+	junk := scc.rxBuf[:n]
+	if scc.junkHandler != nil {
+		scc.junkHandler(junk)
+	} else {
+		glog.V(4).Infof("junk: %s", junk)
+	}
+	scc.consume(n)
+}
+
+// consume removes n bytes from the beginning of rx buffer.
+func (scc *streamConnectionCodec) consume(n int) {
+	// We create a new slice instead of just doing "scc.rxBuf = scc.rxBuf[n:]",
+	// because then underlying array of rxBuf would constantly grow, and memory
+	// for parsed data will never be reclaimed.
+	remainder := make([]byte, len(scc.rxBuf)-n)
+	copy(remainder, scc.rxBuf[n:])
+	scc.rxBuf = remainder
 }
 
 func (scc *streamConnectionCodec) Recv(ctx context.Context) (*frame.Frame, error) {
 	scc.rxBufLock.Lock()
 	defer scc.rxBufLock.Unlock()
+	if len(scc.rxQueue) > 0 {
+		f := scc.rxQueue[0]
+		scc.rxQueue = scc.rxQueue[1:]
+		return f, nil
+	}
 	buf := make([]byte, 10000)
 	var frame *frame.Frame
 	for {
@@ -219,16 +427,158 @@ func (scc *streamConnectionCodec) Recv(ctx context.Context) (*frame.Frame, error
 	}
 }
 
-func (scc *streamConnectionCodec) Send(ctx context.Context, f *frame.Frame) error {
+// caps returns the capabilities this side supports.
+func (scc *streamConnectionCodec) caps() string {
+	var caps []string
+	if scc.opts.UBJSON {
+		caps = append(caps, capUBJSON)
+	}
+	if scc.opts.Checksums {
+		caps = append(caps, capChecksums)
+	}
+	return strings.Join(caps, "|")
+}
+
+// handleCapsFrame processes the handshake of the peer.
+func (scc *streamConnectionCodec) handleCapsFrame(frameData []byte) error {
+	if len(frameData) == 1 {
+		// Bare handshake: the peer does not know about capabilities, or
+		// waits for us to announce ours.
+		if scc.opts.Client || scc.caps() == "" {
+			return nil
+		}
+		announce := fmt.Sprintf("%s%c%s%s", streamFrameDelimiter, eofChar, scc.caps(), streamFrameDelimiter)
+		if _, err := scc.conn.Write([]byte(announce)); err != nil {
+			scc.Close()
+			return errors.Trace(err)
+		}
+		return nil
+	}
+	peerCaps := map[string]bool{}
+	for _, c := range strings.Split(string(frameData[1:]), "|") {
+		peerCaps[c] = true
+	}
+	var common []string
+	for _, c := range strings.Split(scc.caps(), "|") {
+		if peerCaps[c] {
+			common = append(common, c)
+		}
+	}
+	scc.encLock.Lock()
+	defer scc.encLock.Unlock()
+	if !scc.opts.Client {
+		if scc.caps() == "" {
+			// Peers that don't answer are assumed not to support anything.
+			return nil
+		}
+		// Both sides accept frames in any encoding, so it does not matter if
+		// frames that are being sent concurrently overtake the answer.
+		answer := fmt.Sprintf("%s%c%s%s", streamFrameDelimiter, eofChar, strings.Join(common, "|"), streamFrameDelimiter)
+		if _, err := scc.conn.Write([]byte(answer)); err != nil {
+			scc.Close()
+			return errors.Trace(err)
+		}
+	}
+	// Clients that wait for the peer's capabilities send theirs with the next
+	// frame. The peer can take anything it has announced, so the common ones
+	// are used right away.
+	scc.peerCaps = true
+	scc.ubjsonOut, scc.checksumsOut = false, false
+	for _, c := range common {
+		switch c {
+		case capUBJSON:
+			scc.ubjsonOut = true
+		case capChecksums:
+			scc.checksumsOut = true
+		}
+	}
+	glog.V(1).Infof("%s: peer capabilities %q, using UBJSON: %t, checksums: %t", scc, frameData[1:], scc.ubjsonOut, scc.checksumsOut)
+	return nil
+}
+
+// marshalFrame encodes the frame with the negotiated encoding. If the
+// handshake needs to be sent, it's prepended to the frame.
+func (scc *streamConnectionCodec) marshalFrame(f *frame.Frame) ([]byte, error) {
+	scc.encLock.Lock()
+	defer scc.encLock.Unlock()
+	var payload []byte
+	var err error
+	if scc.ubjsonOut {
+		payload, err = ubjson.Marshal(f)
+	} else {
+		payload, err = frame.MarshalJSON(f)
+	}
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return scc.framePayload(payload), nil
+}
+
+// framePayload puts the encoded frame between delimiters, with a header if
+// needed. Must be called with encLock held.
+func (scc *streamConnectionCodec) framePayload(payload []byte) []byte {
 	frameData := []byte(streamFrameDelimiter)
-	framePayload, err := frame.MarshalJSON(f)
+	if scc.opts.Client && !scc.capsSent && (!scc.opts.waitForPeerCaps || scc.peerCaps) {
+		if caps := scc.caps(); caps != "" {
+			frameData = append(frameData, eofChar)
+			frameData = append(frameData, caps...)
+			frameData = append(frameData, streamFrameDelimiter...)
+			frameData = append(frameData, streamFrameDelimiter...)
+		}
+		scc.capsSent = true
+	}
+	if scc.checksumsOut {
+		marker := checksummedJSONFrameMarker
+		if scc.ubjsonOut {
+			marker = checksummedUBJSONFrameMarker
+		}
+		var hdr [13]byte
+		hdr[0] = marker
+		binary.BigEndian.PutUint32(hdr[1:], uint32(len(payload)))
+		binary.BigEndian.PutUint32(hdr[5:], ^uint32(len(payload)))
+		binary.BigEndian.PutUint32(hdr[9:], crc32.ChecksumIEEE(payload))
+		frameData = append(frameData, hdr[:]...)
+	} else if scc.ubjsonOut {
+		var hdr [9]byte
+		hdr[0] = ubjsonFrameMarker
+		binary.BigEndian.PutUint32(hdr[1:], uint32(len(payload)))
+		binary.BigEndian.PutUint32(hdr[5:], ^uint32(len(payload)))
+		frameData = append(frameData, hdr[:]...)
+	}
+	frameData = append(frameData, payload...)
+	frameData = append(frameData, streamFrameDelimiter...)
+	return frameData
+}
+
+func (scc *streamConnectionCodec) Send(ctx context.Context, f *frame.Frame) error {
+	if scc.jsonRPC != nil {
+		payload, err := scc.jsonRPC.marshal(f)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if payload == nil {
+			glog.V(2).Infof("%s: not sending response %d now", scc, f.ID)
+			return nil
+		}
+		return errors.Trace(scc.sendPayload(payload))
+	}
+	frameData, err := scc.marshalFrame(f)
 	if err != nil {
 		return errors.Trace(err)
 	}
-	frameData = append(frameData, framePayload...)
-	frameData = append(frameData, []byte(streamFrameDelimiter)...)
-	_, err = scc.conn.Write(frameData)
-	if err != nil {
+	return errors.Trace(scc.write(frameData))
+}
+
+// sendPayload sends an encoded JSON-RPC message.
+func (scc *streamConnectionCodec) sendPayload(payload []byte) error {
+	scc.encLock.Lock()
+	frameData := scc.framePayload(payload)
+	scc.encLock.Unlock()
+	return errors.Trace(scc.write(frameData))
+}
+
+func (scc *streamConnectionCodec) write(frameData []byte) error {
+	if _, err := scc.conn.Write(frameData); err != nil {
 		scc.Close()
 		return errors.Trace(err)
 	}
@@ -257,5 +607,14 @@ func (scc *streamConnectionCodec) MaxNumFrames() int {
 }
 
 func (scc *streamConnectionCodec) Info() ConnectionInfo {
-	return ConnectionInfo{RemoteAddr: scc.conn.RemoteAddr()}
+	r := ConnectionInfo{RemoteAddr: scc.conn.RemoteAddr()}
+	// Connection implementation may know more, e.g. about TLS.
+	if ip, ok := scc.conn.(interface {
+		Info() ConnectionInfo
+	}); ok {
+		r = ip.Info()
+	}
+	r.CorruptFrames = atomic.LoadUint64(&scc.corruptFrames)
+	r.Ordered = true
+	return r
 }
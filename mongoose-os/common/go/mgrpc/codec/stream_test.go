@@ -0,0 +1,187 @@
+package codec
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"cesanta.com/common/go/mgrpc/frame"
+)
+
+func TestStreamHandshake(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, tc := range []struct {
+		client, server         StreamOptions
+		wantUBJSON, wantChecks bool
+	}{
+		{StreamOptions{UBJSON: true, Checksums: true}, StreamOptions{UBJSON: true, Checksums: true}, true, true},
+		{StreamOptions{Checksums: true}, StreamOptions{UBJSON: true, Checksums: true}, false, true},
+		{StreamOptions{UBJSON: true, Checksums: true}, StreamOptions{UBJSON: true}, true, false},
+		{StreamOptions{UBJSON: true}, StreamOptions{}, false, false},
+	} {
+		cc, sc := net.Pipe()
+		tc.client.Client = true
+		client := TCP(cc, tc.client)
+		defer client.Close()
+		server := TCP(sc, tc.server)
+		defer server.Close()
+
+		go func() {
+			for {
+				f, err := server.Recv(ctx)
+				if err != nil {
+					return
+				}
+				server.Send(ctx, &frame.Frame{ID: f.ID, Result: f.Args})
+			}
+		}()
+		for id := int64(1); id <= 2; id++ {
+			if err := client.Send(ctx, &frame.Frame{ID: id, Method: "Echo"}); err != nil {
+				t.Fatal(err)
+			}
+			f, err := client.Recv(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if f.ID != id {
+				t.Errorf("got response %+v, want ID %d", f, id)
+			}
+		}
+		for _, c := range []Codec{client, server} {
+			scc := c.(*streamConnectionCodec)
+			scc.encLock.Lock()
+			if scc.ubjsonOut != tc.wantUBJSON || scc.checksumsOut != tc.wantChecks {
+				t.Errorf("%+v: %s: got UBJSON %t, checksums %t", tc, scc, scc.ubjsonOut, scc.checksumsOut)
+			}
+			scc.encLock.Unlock()
+		}
+	}
+}
+
+func TestStreamCorruptFrames(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	wc, rc := net.Pipe()
+	defer wc.Close()
+	c := TCP(rc, StreamOptions{})
+	defer c.Close()
+
+	checksummed := &streamConnectionCodec{checksumsOut: true}
+	ubjson := &streamConnectionCodec{ubjsonOut: true}
+	var data []byte
+	for id := int64(1); id <= 5; id++ {
+		enc := checksummed
+		if id >= 3 {
+			enc = ubjson
+		}
+		fd, err := enc.marshalFrame(&frame.Frame{ID: id, Method: "Test"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch id {
+		case 1:
+			// Corrupt the payload.
+			fd[len(fd)-5] ^= 0x10
+		case 2, 3:
+			// Corrupt the length.
+			fd[len(streamFrameDelimiter)+2] ^= 0x01
+		case 4:
+			// Make the length too big, along with its inverted copy.
+			fd[len(streamFrameDelimiter)+1] ^= 0x10
+			fd[len(streamFrameDelimiter)+5] ^= 0x10
+		}
+		data = append(data, fd...)
+	}
+	go wc.Write(data)
+
+	f, err := c.Recv(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.ID != 5 {
+		t.Errorf("got frame %+v, want ID 5", f)
+	}
+	if n := c.Info().CorruptFrames; n != 4 {
+		t.Errorf("got %d corrupt frames, want 4", n)
+	}
+}
+
+func TestStreamJSONRPC(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	wc, rc := net.Pipe()
+	c := TCP(rc, StreamOptions{JSONRPC: true, UBJSON: true})
+	defer c.Close()
+
+	got := make(chan string, 2)
+	go func() {
+		buf := make([]byte, 1000)
+		// An invalid message is responded to right away.
+		wc.Write([]byte(`"""{"id":1,"method":"A"}"""`))
+		n, _ := wc.Read(buf)
+		got <- string(buf[:n])
+		wc.Write([]byte(`"""[{"jsonrpc":"2.0","id":1,"method":"A"},{"jsonrpc":"2.0","method":"B"},{"id":2},{"jsonrpc":"2.0","id":"c","method":"C"}]"""`))
+		// Responses to the batch are sent together, without the notification.
+		n, _ = wc.Read(buf)
+		got <- string(buf[:n])
+		wc.Write([]byte(`"""{"jsonrpc":"2.0","id":3,"error":{"code":-32601,"message":"nope"}}"""`))
+	}()
+	type response struct {
+		ID    json.RawMessage `json:"id"`
+		Error *frame.Error    `json:"error"`
+	}
+	parse := func(s string) []response {
+		var resps []response
+		data := strings.Trim(s, `"`)
+		if data[0] != '[' {
+			data = "[" + data + "]"
+		}
+		if err := json.Unmarshal([]byte(data), &resps); err != nil {
+			t.Fatalf("%s: %s", s, err)
+		}
+		return resps
+	}
+	var reqs []*frame.Frame
+	for _, want := range []string{"A", "B", "C"} {
+		f, err := c.Recv(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.Method != want {
+			t.Errorf("got %s, want %s", f, want)
+		}
+		reqs = append(reqs, f)
+	}
+	if resps := parse(<-got); len(resps) != 1 || string(resps[0].ID) != "null" || resps[0].Error.Code != frame.JSONRPCInvalidRequest {
+		t.Errorf("got %+v", resps)
+	}
+	for _, i := range []int{2, 1, 0} {
+		if err := c.Send(ctx, &frame.Frame{ID: reqs[i].ID}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	resps := parse(<-got)
+	if len(resps) != 3 {
+		t.Fatalf("got %+v", resps)
+	}
+	var ids []string
+	for _, r := range resps {
+		ids = append(ids, string(r.ID))
+	}
+	if want := []string{"null", `"c"`, "1"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("got ids %q, want %q", ids, want)
+	}
+
+	f, err := c.Recv(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.ID != 3 || f.Error == nil || f.Error.Code != 404 {
+		t.Errorf("got %s", f)
+	}
+}
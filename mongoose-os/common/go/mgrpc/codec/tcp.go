@@ -1,15 +1,23 @@
 package codec
 
-import "net"
+import (
+	"crypto/tls"
+	"net"
+)
 
 type tcpCodec struct {
 	conn net.Conn
 }
 
-func TCP(conn net.Conn) Codec {
+func TCP(conn net.Conn, opts StreamOptions) Codec {
 	return StreamConn(&tcpCodec{
 		conn: conn,
-	}, nil)
+	}, opts)
+}
+
+// Unix creates a codec for a Unix domain socket connection.
+func Unix(conn net.Conn, opts StreamOptions) Codec {
+	return TCP(conn, opts)
 }
 
 func (c *tcpCodec) Read(b []byte) (n int, err error) {
@@ -31,3 +39,12 @@ func (c *tcpCodec) RemoteAddr() string {
 func (c *tcpCodec) PreprocessFrame(frameData []byte) (bool, error) {
 	return false, nil
 }
+
+func (c *tcpCodec) Info() ConnectionInfo {
+	r := ConnectionInfo{RemoteAddr: c.RemoteAddr()}
+	if tc, ok := c.conn.(*tls.Conn); ok {
+		r.TLS = true
+		r.PeerCertificates = tc.ConnectionState().PeerCertificates
+	}
+	return r
+}
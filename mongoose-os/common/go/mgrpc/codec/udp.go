@@ -0,0 +1,495 @@
+package codec
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"cesanta.com/common/go/mgrpc/frame"
+	"github.com/cesanta/errors"
+	"github.com/golang/glog"
+)
+
+const (
+	// Maximum payload of a UDP datagram.
+	maxUDPDatagramSize = 65507
+
+	defaultUDPRetransmitInterval = 500 * time.Millisecond
+	defaultUDPMaxRetransmits     = 5
+	defaultUDPIdleTimeout        = 5 * time.Minute
+
+	// Number of received datagrams that may wait for Recv, the rest is dropped.
+	udpRxQueueLen = 16
+
+	// Status of the response made up for a request the peer has not
+	// responded to.
+	udpNoResponseStatus = 504
+)
+
+// UDPOptions control the datagram codec. Zero values are replaced with
+// defaults.
+type UDPOptions struct {
+	// Requests that haven't been responded to are sent again after this
+	// interval...
+	RetransmitInterval time.Duration
+	// ...up to this many times.
+	MaxRetransmits int
+	// Frames larger than this are not sent. Can't exceed the maximum UDP
+	// payload size, which is also the default.
+	MaxDatagramSize int
+	// Connections accepted by UDPListener are closed if nothing has been
+	// received from the peer for this long.
+	IdleTimeout time.Duration
+}
+
+func (o *UDPOptions) setDefaults() {
+	if o.RetransmitInterval <= 0 {
+		o.RetransmitInterval = defaultUDPRetransmitInterval
+	}
+	if o.MaxRetransmits <= 0 {
+		o.MaxRetransmits = defaultUDPMaxRetransmits
+	}
+	if o.MaxDatagramSize <= 0 || o.MaxDatagramSize > maxUDPDatagramSize {
+		o.MaxDatagramSize = maxUDPDatagramSize
+	}
+	if o.IdleTimeout <= 0 {
+		o.IdleTimeout = defaultUDPIdleTimeout
+	}
+}
+
+// dedupWindow is for how long IDs of the completed requests are remembered.
+// Must be longer than the peer keeps retransmitting.
+func (o *UDPOptions) dedupWindow() time.Duration {
+	return 2 * time.Duration(o.MaxRetransmits+1) * o.RetransmitInterval
+}
+
+// udpCodec sends each frame in a separate datagram. Since datagrams can be
+// lost or duplicated, requests are retransmitted until a response arrives,
+// and duplicate requests and responses are suppressed. Fragments of a request
+// are retransmitted and deduplicated together, by the request ID and the
+// fragment index.
+type udpCodec struct {
+	remoteAddr string
+	opts       UDPOptions
+	write      func(b []byte) error
+	in         chan []byte
+	onClose    func()
+	idleTimer  *time.Timer
+	// Responses made up for the requests that have not been responded to.
+	failed chan *frame.Frame
+
+	lock sync.Mutex
+	// Requests sent to the peer which haven't been responded to yet.
+	pending map[int64]*udpPendingRequest
+	// Requests sent to the peer which have been responded to.
+	completed map[int64]*udpCompletedRequest
+	// Requests received from the peer.
+	served map[int64]*udpServedRequest
+
+	closeNotifier chan struct{}
+	closeOnce     sync.Once
+}
+
+type udpPendingRequest struct {
+	// Source and destination of the request.
+	src, dst string
+	// Datagrams of the request, more than one if it's fragmented.
+	data        [][]byte
+	retransmits int
+	timer       *time.Timer
+}
+
+type udpCompletedRequest struct {
+	completed time.Time
+	// Indices of the fragments received, if the response is fragmented.
+	frags map[int]bool
+}
+
+type udpServedRequest struct {
+	received time.Time
+	// Indices of the fragments received, if the request is fragmented.
+	frags map[int]bool
+	// Response, once it's been sent, possibly in fragments.
+	resp [][]byte
+}
+
+// isDuplicate returns true if f, a request or a fragment of it, has already
+// been received.
+func (s *udpServedRequest) isDuplicate(f *frame.Frame) bool {
+	if f.Frag == nil || s.resp != nil {
+		return true
+	}
+	return s.frags[f.Frag.Index]
+}
+
+// isRequestPart returns true if f is a request or a fragment of one.
+func isRequestPart(f *frame.Frame) bool {
+	return f.IsRequest() || (f.Frag != nil && f.Frag.Request)
+}
+
+func newUDPCodec(remoteAddr string, write func(b []byte) error, opts UDPOptions) *udpCodec {
+	opts.setDefaults()
+	return &udpCodec{
+		remoteAddr:    remoteAddr,
+		opts:          opts,
+		write:         write,
+		in:            make(chan []byte, udpRxQueueLen),
+		failed:        make(chan *frame.Frame),
+		pending:       make(map[int64]*udpPendingRequest),
+		completed:     make(map[int64]*udpCompletedRequest),
+		served:        make(map[int64]*udpServedRequest),
+		closeNotifier: make(chan struct{}),
+	}
+}
+
+// UDP creates a codec which exchanges frames with the peer conn is connected
+// to.
+func UDP(conn *net.UDPConn, opts UDPOptions) Codec {
+	c := newUDPCodec(conn.RemoteAddr().String(), func(b []byte) error {
+		_, err := conn.Write(b)
+		return errors.Trace(err)
+	}, opts)
+	c.onClose = func() { conn.Close() }
+	go func() {
+		buf := make([]byte, maxUDPDatagramSize)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				select {
+				case <-c.closeNotifier:
+					return
+				default:
+				}
+				// E.g. ICMP port unreachable, the peer may come up later.
+				glog.V(1).Infof("%s: read error: %s", c, err)
+				continue
+			}
+			c.deliver(append([]byte(nil), buf[:n]...))
+		}
+	}()
+	return c
+}
+
+func (c *udpCodec) String() string {
+	return fmt.Sprintf("[udpCodec to %s]", c.remoteAddr)
+}
+
+// deliver queues a datagram received from the peer.
+func (c *udpCodec) deliver(b []byte) {
+	if c.idleTimer != nil {
+		c.idleTimer.Reset(c.opts.IdleTimeout)
+	}
+	select {
+	case c.in <- b:
+	default:
+		glog.V(1).Infof("%s: rx queue is full, dropping a datagram", c)
+	}
+}
+
+// pruneLocked forgets requests that are too old to be duplicated.
+func (c *udpCodec) pruneLocked() {
+	cutoff := time.Now().Add(-c.opts.dedupWindow())
+	for id, r := range c.completed {
+		if r.completed.Before(cutoff) {
+			delete(c.completed, id)
+		}
+	}
+	for id, s := range c.served {
+		if s.received.Before(cutoff) {
+			delete(c.served, id)
+		}
+	}
+}
+
+func (c *udpCodec) Recv(ctx context.Context) (*frame.Frame, error) {
+	for {
+		var b []byte
+		select {
+		case b = <-c.in:
+		case f := <-c.failed:
+			return f, nil
+		case <-c.closeNotifier:
+			return nil, errors.Trace(io.EOF)
+		case <-ctx.Done():
+			return nil, errors.Trace(ctx.Err())
+		}
+		f := &frame.Frame{SizeHint: len(b)}
+		if err := json.Unmarshal(b, f); err != nil {
+			glog.Errorf("%s: failed to parse frame: %q %s", c, b, err)
+			continue
+		}
+		c.lock.Lock()
+		c.pruneLocked()
+		if isRequestPart(f) {
+			s, ok := c.served[f.ID]
+			if ok && s.isDuplicate(f) {
+				resp := s.resp
+				c.lock.Unlock()
+				glog.V(2).Infof("%s: duplicate request %d", c, f.ID)
+				// Our response must have been lost, send it again.
+				for _, b := range resp {
+					c.write(b)
+				}
+				continue
+			}
+			if !ok {
+				s = &udpServedRequest{received: time.Now(), frags: make(map[int]bool)}
+				c.served[f.ID] = s
+			}
+			if f.Frag != nil {
+				s.frags[f.Frag.Index] = true
+			}
+			c.lock.Unlock()
+			return f, nil
+		}
+		if f.IsProgress() {
+			// The request is still being served, keep retransmitting it until
+			// the response arrives.
+			c.lock.Unlock()
+			return f, nil
+		}
+		// Once the response starts to arrive, the request is not retransmitted
+		// anymore, but the rest of the fragments, if any, are still expected.
+		if p, ok := c.pending[f.ID]; ok {
+			p.timer.Stop()
+			delete(c.pending, f.ID)
+			r := &udpCompletedRequest{completed: time.Now(), frags: make(map[int]bool)}
+			if f.Frag != nil {
+				r.frags[f.Frag.Index] = true
+			}
+			c.completed[f.ID] = r
+		} else if r, ok := c.completed[f.ID]; ok {
+			if f.Frag == nil || r.frags[f.Frag.Index] {
+				c.lock.Unlock()
+				glog.V(2).Infof("%s: duplicate response %d", c, f.ID)
+				continue
+			}
+			r.frags[f.Frag.Index] = true
+		}
+		c.lock.Unlock()
+		return f, nil
+	}
+}
+
+func (c *udpCodec) Send(ctx context.Context, f *frame.Frame) error {
+	select {
+	case <-c.closeNotifier:
+		return errors.Trace(io.EOF)
+	default:
+	}
+	b, err := frame.MarshalJSON(f)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if len(b) > c.opts.MaxDatagramSize {
+		return errors.Errorf("frame %d is too big for a datagram: %d bytes, max %d", f.ID, len(b), c.opts.MaxDatagramSize)
+	}
+	c.lock.Lock()
+	if isRequestPart(f) {
+		// Fragments after the first one are added to the pending request.
+		p := c.pending[f.ID]
+		if p == nil || f.Frag == nil || f.Frag.Index == 0 {
+			if p != nil {
+				p.timer.Stop()
+			}
+			p = &udpPendingRequest{src: f.Src, dst: f.Dst}
+			p.timer = time.AfterFunc(c.opts.RetransmitInterval, func() { c.retransmit(f.ID, p) })
+			c.pending[f.ID] = p
+		}
+		p.data = append(p.data, b)
+	} else if s, ok := c.served[f.ID]; ok && !f.IsProgress() {
+		if f.Frag == nil || f.Frag.Index == 0 {
+			s.resp = nil
+		}
+		s.resp = append(s.resp, b)
+	}
+	c.lock.Unlock()
+	return errors.Trace(c.write(b))
+}
+
+func (c *udpCodec) retransmit(id int64, p *udpPendingRequest) {
+	c.lock.Lock()
+	if c.pending[id] != p {
+		c.lock.Unlock()
+		return
+	}
+	if p.retransmits >= c.opts.MaxRetransmits {
+		glog.Errorf("%s: no response to request %d after %d retransmissions", c, id, p.retransmits)
+		delete(c.pending, id)
+		c.lock.Unlock()
+		// Make the call fail rather than wait for a response forever.
+		rf := frame.NewResponseFrame(p.dst, p.src, "", &frame.Response{
+			ID:        id,
+			Status:    udpNoResponseStatus,
+			StatusMsg: fmt.Sprintf("no response after %d retransmissions", p.retransmits),
+		})
+		select {
+		case c.failed <- rf:
+		case <-c.closeNotifier:
+		}
+		return
+	}
+	p.retransmits++
+	p.timer.Reset(c.opts.RetransmitInterval)
+	data, n := p.data, p.retransmits
+	c.lock.Unlock()
+	glog.V(1).Infof("%s: retransmitting request %d (%d)", c, id, n)
+	for _, b := range data {
+		if err := c.write(b); err != nil {
+			glog.V(1).Infof("%s: failed to retransmit request %d: %s", c, id, err)
+			return
+		}
+	}
+}
+
+func (c *udpCodec) Close() {
+	c.closeOnce.Do(func() {
+		close(c.closeNotifier)
+		c.lock.Lock()
+		for id, p := range c.pending {
+			p.timer.Stop()
+			delete(c.pending, id)
+		}
+		c.lock.Unlock()
+		if c.idleTimer != nil {
+			c.idleTimer.Stop()
+		}
+		if c.onClose != nil {
+			c.onClose()
+		}
+	})
+}
+
+func (c *udpCodec) CloseNotify() <-chan struct{} {
+	return c.closeNotifier
+}
+
+func (c *udpCodec) MaxNumFrames() int {
+	return -1
+}
+
+func (c *udpCodec) Info() ConnectionInfo {
+	return ConnectionInfo{RemoteAddr: c.remoteAddr}
+}
+
+// UDPListener receives datagrams on a socket and sorts them into connections
+// by the address of the sender.
+type UDPListener struct {
+	conn net.PacketConn
+	opts UDPOptions
+
+	lock  sync.Mutex
+	peers map[string]*udpCodec
+
+	accept    chan Codec
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// ListenUDP starts receiving datagrams on conn. Connections from new peers
+// are returned by Accept.
+func ListenUDP(conn net.PacketConn, opts UDPOptions) *UDPListener {
+	opts.setDefaults()
+	l := &UDPListener{
+		conn:   conn,
+		opts:   opts,
+		peers:  make(map[string]*udpCodec),
+		accept: make(chan Codec),
+		closed: make(chan struct{}),
+	}
+	go l.readLoop()
+	return l
+}
+
+func (l *UDPListener) readLoop() {
+	buf := make([]byte, maxUDPDatagramSize)
+	for {
+		n, addr, err := l.conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-l.closed:
+				return
+			default:
+			}
+			glog.V(1).Infof("UDP listener %s: read error: %s", l.Addr(), err)
+			continue
+		}
+		b := append([]byte(nil), buf[:n]...)
+		key := addr.String()
+		l.lock.Lock()
+		c := l.peers[key]
+		isNew := c == nil
+		if isNew {
+			c = l.newPeer(addr)
+			l.peers[key] = c
+		}
+		l.lock.Unlock()
+		if isNew {
+			select {
+			case l.accept <- c:
+			case <-l.closed:
+				return
+			}
+		}
+		c.deliver(b)
+	}
+}
+
+func (l *UDPListener) newPeer(addr net.Addr) *udpCodec {
+	key := addr.String()
+	c := newUDPCodec(key, func(b []byte) error {
+		_, err := l.conn.WriteTo(b, addr)
+		return errors.Trace(err)
+	}, l.opts)
+	c.onClose = func() {
+		l.lock.Lock()
+		defer l.lock.Unlock()
+		if l.peers[key] == c {
+			delete(l.peers, key)
+		}
+	}
+	c.idleTimer = time.AfterFunc(l.opts.IdleTimeout, func() {
+		glog.V(1).Infof("%s: idle for %s, closing", c, l.opts.IdleTimeout)
+		c.Close()
+	})
+	return c
+}
+
+// Accept waits for a datagram from a new peer and returns the connection to
+// that peer.
+func (l *UDPListener) Accept(ctx context.Context) (Codec, error) {
+	select {
+	case c := <-l.accept:
+		return c, nil
+	case <-l.closed:
+		return nil, errors.Trace(io.EOF)
+	case <-ctx.Done():
+		return nil, errors.Trace(ctx.Err())
+	}
+}
+
+// Addr returns the address the listener receives datagrams on.
+func (l *UDPListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+// Close stops receiving datagrams and closes all the connections.
+func (l *UDPListener) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		err = l.conn.Close()
+		l.lock.Lock()
+		peers := l.peers
+		l.peers = make(map[string]*udpCodec)
+		l.lock.Unlock()
+		for _, c := range peers {
+			c.Close()
+		}
+	})
+	return errors.Trace(err)
+}
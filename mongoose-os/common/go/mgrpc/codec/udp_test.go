@@ -0,0 +1,165 @@
+package codec
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"cesanta.com/common/go/mgrpc/frame"
+	"cesanta.com/common/go/ourjson"
+)
+
+// rawUDPPeer returns a UDP socket and a codec connected to it.
+func rawUDPPeer(t *testing.T, opts UDPOptions) (net.PacketConn, Codec) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.DialUDP("udp", nil, pc.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pc, UDP(conn, opts)
+}
+
+func readFrame(t *testing.T, pc net.PacketConn) (*frame.Frame, net.Addr) {
+	buf := make([]byte, maxUDPDatagramSize)
+	pc.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, addr, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &frame.Frame{}
+	if err := json.Unmarshal(buf[:n], f); err != nil {
+		t.Fatal(err)
+	}
+	return f, addr
+}
+
+func TestUDPRetransmitAndDedup(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	pc, c := rawUDPPeer(t, UDPOptions{RetransmitInterval: 20 * time.Millisecond})
+	defer pc.Close()
+	defer c.Close()
+
+	if err := c.Send(ctx, &frame.Frame{ID: 42, Method: "Sys.GetInfo"}); err != nil {
+		t.Fatal(err)
+	}
+	// The first copy is "lost", the request must be sent again.
+	readFrame(t, pc)
+	f, addr := readFrame(t, pc)
+	if f.ID != 42 || f.Method != "Sys.GetInfo" {
+		t.Fatalf("got %+v, want a retransmitted request 42", f)
+	}
+	resp, _ := json.Marshal(&frame.Frame{ID: 42, Result: ourjson.RawJSON([]byte(`true`))})
+	for i := 0; i < 2; i++ {
+		if _, err := pc.WriteTo(resp, addr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rf, err := c.Recv(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rf.ID != 42 || rf.IsRequest() {
+		t.Fatalf("got %+v, want response 42", rf)
+	}
+	sctx, scancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer scancel()
+	if rf, err := c.Recv(sctx); err == nil {
+		t.Errorf("duplicate response has been received: %+v", rf)
+	}
+}
+
+func TestUDPNoResponse(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	pc, c := rawUDPPeer(t, UDPOptions{RetransmitInterval: 10 * time.Millisecond, MaxRetransmits: 2})
+	defer pc.Close()
+	defer c.Close()
+
+	// The peer never responds, and the request fails once retransmissions
+	// are exhausted.
+	if err := c.Send(ctx, &frame.Frame{Src: "host", Dst: "dev", ID: 5, Method: "Test"}); err != nil {
+		t.Fatal(err)
+	}
+	f, err := c.Recv(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.ID != 5 || f.Src != "dev" || f.Dst != "host" || f.Error == nil || f.Error.Code != udpNoResponseStatus {
+		t.Errorf("got %s, want an error response to request 5", f)
+	}
+	for i := 0; i < 3; i++ {
+		if f, _ := readFrame(t, pc); f.ID != 5 {
+			t.Errorf("got %s, want request 5", f)
+		}
+	}
+}
+
+func TestUDPFrameTooBig(t *testing.T) {
+	ctx := context.Background()
+	pc, c := rawUDPPeer(t, UDPOptions{MaxDatagramSize: 100})
+	defer pc.Close()
+	defer c.Close()
+	args := ourjson.RawJSON([]byte(`"` + strings.Repeat("x", 100) + `"`))
+	err := c.Send(ctx, &frame.Frame{ID: 1, Method: "FS.Put", Args: args})
+	if err == nil || !strings.Contains(err.Error(), "too big") {
+		t.Errorf("got %v, want a frame too big error", err)
+	}
+}
+
+func TestUDPListener(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := ListenUDP(conn, UDPOptions{})
+	defer l.Close()
+
+	client, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	req, _ := json.Marshal(&frame.Frame{ID: 7, Method: "Echo"})
+	if _, err := client.WriteTo(req, l.Addr()); err != nil {
+		t.Fatal(err)
+	}
+	sc, err := l.Accept(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := sc.Info().RemoteAddr, client.LocalAddr().String(); got != want {
+		t.Errorf("got remote address %q, want %q", got, want)
+	}
+	f, err := sc.Recv(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sc.Send(ctx, &frame.Frame{ID: f.ID, Result: ourjson.RawJSON([]byte(`1`))}); err != nil {
+		t.Fatal(err)
+	}
+	if rf, _ := readFrame(t, client); rf.ID != 7 {
+		t.Fatalf("got %+v, want response 7", rf)
+	}
+	// The response got lost and the request is retransmitted: the server
+	// answers it again without passing it on.
+	if _, err := client.WriteTo(req, l.Addr()); err != nil {
+		t.Fatal(err)
+	}
+	sctx, scancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer scancel()
+	if f, err := sc.Recv(sctx); err == nil {
+		t.Errorf("duplicate request has been received: %+v", f)
+	}
+	if rf, _ := readFrame(t, client); rf.ID != 7 {
+		t.Fatalf("got %+v, want response 7 again", rf)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"strings"
 	"sync"
+	"time"
 
 	"cesanta.com/common/go/mgrpc/frame"
 	"github.com/cesanta/errors"
@@ -46,8 +47,9 @@ func (e WSEncoding) String() string {
 
 func ParseEncodingExtension(s string) (WSEncoding, error) {
 	knownEnc := map[string]bool{
-		"json":   true,
-		"ubjson": true,
+		"json":    true,
+		"ubjson":  true,
+		"jsonrpc": true,
 	}
 	parts := strings.Split(s, ";")
 	if strings.TrimSpace(parts[0]) != WSEncodingExtension {
@@ -153,7 +155,22 @@ func combinedUnmarshal(data []byte, payloadType byte, v interface{}) error {
 	}
 }
 
-func WebSocket(conn *websocket.Conn) Codec {
+// WSKeepAliveOptions configure WebSocket pings.
+type WSKeepAliveOptions struct {
+	// Pings are sent at this interval. Zero disables keepalive.
+	PingInterval time.Duration
+	// If nothing, not even a pong, is received within this time after a ping,
+	// the peer is considered dead and the codec is closed. Defaults to
+	// PingInterval.
+	PongTimeout time.Duration
+	// LastRead returns the time data has last been received on the underlying
+	// connection, see ActivityConn. Pongs can't be noticed without it, so only
+	// pings are sent and dead peers are not detected.
+	LastRead func() time.Time
+}
+
+// WebSocket creates a codec on top of the WebSocket connection.
+func WebSocket(conn *websocket.Conn, keepAlive WSKeepAliveOptions) Codec {
 	r := &wsCodec{
 		closeNotify: make(chan struct{}),
 		conn:        conn,
@@ -182,24 +199,83 @@ func WebSocket(conn *websocket.Conn) Codec {
 			// server, which means that we need to reverse directions.
 			in, out = out, in
 		}
-		if in == "ubjson" {
+		switch in {
+		case "ubjson":
 			r.codec.Unmarshal = ubjsonUnmarshal
+		case "jsonrpc":
+			r.jsonRPCIn = true
 		}
-		if out == "ubjson" {
+		switch out {
+		case "ubjson":
 			r.codec.Marshal = ubjsonMarshal
+		case "jsonrpc":
+			r.jsonRPCOut = true
 		}
 	}
 	if *ubjsonInput {
 		r.codec.Unmarshal = combinedUnmarshal
 	}
+	if keepAlive.PingInterval > 0 {
+		if keepAlive.PongTimeout <= 0 {
+			keepAlive.PongTimeout = keepAlive.PingInterval
+		}
+		go r.keepAlive(keepAlive)
+	}
 	return r
 }
 
+var wsPingCodec = websocket.Codec{
+	Marshal: func(v interface{}) ([]byte, byte, error) {
+		return nil, websocket.PingFrame, nil
+	},
+}
+
+// keepAlive pings the peer until the codec is closed, and closes it if the
+// peer stops responding.
+func (c *wsCodec) keepAlive(opts WSKeepAliveOptions) {
+	next := time.Now().Add(opts.PingInterval)
+	for {
+		select {
+		case <-time.After(next.Sub(time.Now())):
+		case <-c.closeNotify:
+			return
+		}
+		sentAt := time.Now()
+		next = sentAt.Add(opts.PingInterval)
+		if err := wsPingCodec.Send(c.conn, nil); err != nil {
+			glog.Errorf("%s: failed to send ping: %s", c, err)
+			c.Close()
+			return
+		}
+		if opts.LastRead == nil {
+			continue
+		}
+		select {
+		case <-time.After(opts.PongTimeout):
+		case <-c.closeNotify:
+			return
+		}
+		if opts.LastRead().Before(sentAt) {
+			glog.Errorf("%s: no response to ping in %s, closing", c, opts.PongTimeout)
+			c.Close()
+			return
+		}
+	}
+}
+
 type wsCodec struct {
 	closeNotify chan struct{}
 	conn        *websocket.Conn
 	closeOnce   sync.Once
 	codec       websocket.Codec
+
+	// Set if JSON-RPC 2.0 encoding is used in either direction.
+	jsonRPCIn  bool
+	jsonRPCOut bool
+	jsonRPC    jsonRPCSession
+	// Frames received in a batch but not returned yet, and its lock.
+	rxQueue []*frame.Frame
+	rxLock  sync.Mutex
 }
 
 func (c *wsCodec) String() string {
@@ -211,6 +287,9 @@ func (c *wsCodec) String() string {
 }
 
 func (c *wsCodec) Recv(ctx context.Context) (*frame.Frame, error) {
+	if c.jsonRPCIn {
+		return c.recvJSONRPC()
+	}
 	var f12 frame.Frame
 	if err := c.codec.Receive(c.conn, &f12); err != nil {
 		glog.V(2).Infof("%s Recv(): %s", c, err)
@@ -220,7 +299,55 @@ func (c *wsCodec) Recv(ctx context.Context) (*frame.Frame, error) {
 	return &f12, nil
 }
 
+// recvJSONRPC receives a JSON-RPC message, or a batch of them.
+func (c *wsCodec) recvJSONRPC() (*frame.Frame, error) {
+	c.rxLock.Lock()
+	defer c.rxLock.Unlock()
+	for len(c.rxQueue) == 0 {
+		var data []byte
+		if err := websocket.Message.Receive(c.conn, &data); err != nil {
+			glog.V(2).Infof("%s Recv(): %s", c, err)
+			c.Close()
+			return nil, errors.Trace(err)
+		}
+		var fs []*frame.Frame
+		var err error
+		if c.jsonRPCOut {
+			var resp []byte
+			fs, resp, err = c.jsonRPC.unmarshal(data)
+			if resp != nil {
+				if err := websocket.Message.Send(c.conn, string(resp)); err != nil {
+					glog.Errorf("%s: failed to respond to an invalid message: %s", c, err)
+				}
+			}
+		} else {
+			// Responses are not JSON-RPC, so they can't be batched and must have
+			// integer IDs.
+			fs, _, _, err = frame.UnmarshalJSONRPC(data, nil)
+		}
+		if err != nil {
+			glog.Errorf("%s: invalid JSON-RPC message: %s", c, err)
+			continue
+		}
+		c.rxQueue = fs
+	}
+	f := c.rxQueue[0]
+	c.rxQueue = c.rxQueue[1:]
+	return f, nil
+}
+
 func (c *wsCodec) Send(ctx context.Context, f12 *frame.Frame) error {
+	if c.jsonRPCOut {
+		b, err := c.jsonRPC.marshal(f12)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if b == nil {
+			glog.V(2).Infof("%s: not sending response %d now", c, f12.ID)
+			return nil
+		}
+		return errors.Trace(websocket.Message.Send(c.conn, string(b)))
+	}
 	return errors.Trace(c.codec.Send(c.conn, f12))
 }
 
@@ -244,6 +371,7 @@ func (c *wsCodec) Info() ConnectionInfo {
 	r := ConnectionInfo{
 		TLS:        c.conn.Request().TLS != nil,
 		RemoteAddr: c.conn.Request().RemoteAddr,
+		Ordered:    true,
 	}
 	if r.TLS {
 		r.PeerCertificates = c.conn.Request().TLS.PeerCertificates
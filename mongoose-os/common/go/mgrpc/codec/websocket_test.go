@@ -0,0 +1,75 @@
+package codec
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// dialWS connects to the server and creates a codec with keepalive. The codec
+// is read from, as pongs are only noticed while reading.
+func dialWS(t *testing.T, s *httptest.Server, interval, timeout time.Duration) Codec {
+	config, err := websocket.NewConfig(strings.Replace(s.URL, "http://", "ws://", 1), "http://localhost/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nc, err := net.Dial("tcp", s.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ac := NewActivityConn(nc)
+	conn, err := websocket.NewClient(config, ac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := WebSocket(conn, WSKeepAliveOptions{
+		PingInterval: interval,
+		PongTimeout:  timeout,
+		LastRead:     ac.LastRead,
+	})
+	go func() {
+		for {
+			if _, err := c.Recv(context.Background()); err != nil {
+				return
+			}
+		}
+	}()
+	return c
+}
+
+func TestWebSocketKeepAlive(t *testing.T) {
+	// Reading makes x/net/websocket answer pings.
+	responsive := httptest.NewServer(websocket.Handler(func(conn *websocket.Conn) {
+		io.Copy(ioutil.Discard, conn)
+	}))
+	defer responsive.Close()
+	unblock := make(chan struct{})
+	defer close(unblock)
+	silent := httptest.NewServer(websocket.Handler(func(conn *websocket.Conn) {
+		<-unblock
+	}))
+	defer silent.Close()
+
+	c := dialWS(t, responsive, 20*time.Millisecond, 50*time.Millisecond)
+	defer c.Close()
+	select {
+	case <-c.CloseNotify():
+		t.Errorf("connection to a responsive peer has been closed")
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	c = dialWS(t, silent, 20*time.Millisecond, 50*time.Millisecond)
+	defer c.Close()
+	select {
+	case <-c.CloseNotify():
+	case <-time.After(2 * time.Second):
+		t.Errorf("connection to a silent peer has not been closed")
+	}
+}
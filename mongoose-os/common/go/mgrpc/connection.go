@@ -4,9 +4,14 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
+	"cesanta.com/common/go/mgrpc/codec"
 	"github.com/cesanta/errors"
 )
 
@@ -22,9 +27,39 @@ type connectOptions struct {
 	tlsConfig       *tls.Config
 	psk             string
 	enableUBJSON    bool
+	checksums       bool
+	jsonRPC         bool
 	enableTracing   bool
 	enableReconnect bool
+	reconnectOpts   codec.ReconnectOptions
 	junkHandler     func(junk []byte)
+	udpOpts         codec.UDPOptions
+	mqttOpts        codec.MQTTOptions
+	wsKeepAlive     codec.WSKeepAliveOptions
+	httpREST        bool
+	serialOpts      codec.SerialOptions
+
+	propagateDeadline bool
+	sessionRecorder   io.Writer
+	matchResponseSrc  bool
+	helloOnConnect    bool
+	helloDst          string
+	mtu               int
+	// Zero means the default of the transport, negative means no limit.
+	maxInFlight int
+}
+
+func newConnectOptions() *connectOptions {
+	return &connectOptions{
+		enableUBJSON:      true,
+		propagateDeadline: true,
+		mqttOpts:          codec.DefaultMQTTOptions(),
+		serialOpts:        codec.DefaultSerialOptions(),
+		wsKeepAlive: codec.WSKeepAliveOptions{
+			PingInterval: defaultWSPingInterval,
+			PongTimeout:  defaultWSPongTimeout,
+		},
+	}
 }
 
 // ConnectOption is an optional argument to Instance.Connect which affects the
@@ -54,6 +89,17 @@ func UseHTTPPost() ConnectOption {
 	}
 }
 
+// UseHTTPREST instructs RPC to send commands over HTTP in the REST form:
+// POST /Method?id=... with args as the body. Commands can only be sent to the
+// node at the URL, and it can't send commands back.
+func UseHTTPREST() ConnectOption {
+	return func(c *connectOptions) error {
+		c.proto = tHTTP_POST
+		c.httpREST = true
+		return nil
+	}
+}
+
 // LocalID specifies mgrpc id of the local node
 func LocalID(localID string) ConnectOption {
 	return func(c *connectOptions) error {
@@ -69,13 +115,27 @@ func LocalID(localID string) ConnectOption {
 // This function is unexported, because mgrpc.New() takes connectAddr as a
 // separate argument.
 func connectTo(connectURL string) ConnectOption {
+	// Command line is not a valid URL, so it's handled separately.
+	if strings.HasPrefix(connectURL, "exec://") {
+		cmdLine := strings.TrimPrefix(connectURL, "exec://")
+		if len(strings.Fields(cmdLine)) == 0 {
+			return badConnectOption(errors.Errorf("no command specified in %q", connectURL))
+		}
+		return func(c *connectOptions) error {
+			c.proto = tExec
+			c.connectAddress = cmdLine
+			return nil
+		}
+	}
 	url, err := url.Parse(connectURL)
 	if err != nil {
 		return badConnectOption(errors.Errorf("invalid ConnectTo format: %s", err))
 	}
 	var t transport
 	var a string
-	var tls bool
+	var tls, multiDevice bool
+	// Parameters of the serial port.
+	var serialQuery map[string][]string
 	switch {
 	case url.Scheme == "http" || url.Scheme == "https":
 		url.RawQuery = ""
@@ -83,21 +143,30 @@ func connectTo(connectURL string) ConnectOption {
 		t, a = tHTTP_POST, url.String()
 		tls = url.Scheme == "https"
 	case url.Scheme == "mqtt" || url.Scheme == "mqtts":
-		url.RawQuery = ""
+		// Query carries MQTT options, see codec.MQTTOptions.
 		url.Fragment = ""
 		t, a = tMQTT, url.String()
 		tls = url.Scheme == "mqtts"
+		// Without a device ID in the URL, the broker connection is shared by
+		// calls to different devices.
+		multiDevice = strings.Trim(url.Path, "/") == ""
 	case url.Scheme == "ws" || url.Scheme == "wss":
 		url.RawQuery = ""
 		url.Fragment = ""
 		t, a = tWebSocket, url.String()
 		tls = url.Scheme == "wss"
-	case url.Scheme == "tcp":
+	case url.Scheme == "tcp" || url.Scheme == "tcps":
 		t, a = tPlainTCP, url.Host
+		tls = url.Scheme == "tcps"
 	case url.Scheme == "serial":
 		// it might look like "serial:///dev/ttyUSB0" or "serial://COM7", so the
 		// actual payload will be either in url.Host or url.Path.
 		t, a = tSerial, url.Host+url.Path
+		serialQuery = url.Query()
+	case url.Scheme == "unix":
+		t, a = tUnix, url.Host+url.Path
+	case url.Scheme == "udp":
+		t, a = tUDP, url.Host
 	default:
 		return badConnectOption(errors.Errorf("invalid ConnectTo protocol %q", url.Scheme))
 	}
@@ -105,10 +174,54 @@ func connectTo(connectURL string) ConnectOption {
 		c.proto = t
 		c.connectAddress = a
 		c.useTLS = tls
+		if multiDevice {
+			c.matchResponseSrc = true
+		}
+		if serialQuery != nil {
+			return errors.Trace(setSerialOptionsFromQuery(&c.serialOpts, serialQuery))
+		}
 		return nil
 	}
 }
 
+// setSerialOptionsFromQuery overrides serial options with the query
+// parameters of a serial:// URL, e.g. serial:///dev/ttyUSB0?baud=921600&fc=rtscts.
+func setSerialOptionsFromQuery(o *codec.SerialOptions, q url.Values) error {
+	for k, vs := range q {
+		v := vs[len(vs)-1]
+		var err error
+		switch k {
+		case "baud":
+			var baud uint64
+			baud, err = strconv.ParseUint(v, 10, 32)
+			o.BaudRate = uint(baud)
+		case "fc":
+			switch v {
+			case "rtscts":
+				o.HardwareFlowControl = true
+			case "none":
+				o.HardwareFlowControl = false
+			default:
+				err = errors.Errorf("must be rtscts or none")
+			}
+		case "chunk_size":
+			o.ChunkSize, err = strconv.Atoi(v)
+		case "chunk_delay":
+			o.ChunkDelay, err = time.ParseDuration(v)
+		case "handshake_interval":
+			o.HandshakeInterval, err = time.ParseDuration(v)
+		case "handshake_timeout":
+			o.HandshakeTimeout, err = time.ParseDuration(v)
+		default:
+			return errors.Errorf("unknown serial option %q", k)
+		}
+		if err != nil {
+			return errors.Annotatef(err, "invalid %s value %q", k, v)
+		}
+	}
+	return nil
+}
+
 // ClientCert specifies the client certificate chain to supply to the server
 // and enables TLS.
 func ClientCert(cert *tls.Certificate) ConnectOption {
@@ -119,6 +232,25 @@ func ClientCert(cert *tls.Certificate) ConnectOption {
 	}
 }
 
+// clientTLSConfig returns TLS configuration for connecting to the given
+// host: either the one provided with TlsConfig, or the one built from
+// ClientCert and VerifyServerWith options.
+func (c *connectOptions) clientTLSConfig(host string) *tls.Config {
+	var r *tls.Config
+	if c.tlsConfig != nil {
+		r = c.tlsConfig.Clone()
+	} else {
+		r = &tls.Config{RootCAs: c.caPool}
+		if c.cert != nil {
+			r.Certificates = []tls.Certificate{*c.cert}
+		}
+	}
+	if r.ServerName == "" {
+		r.ServerName = host
+	}
+	return r
+}
+
 func maybeLoadCertAndKey(certFile, keyFile string) (*tls.Certificate, error) {
 	if certFile == "" && keyFile == "" {
 		return nil, nil
@@ -175,7 +307,8 @@ func SendPSK(psk string) ConnectOption {
 	}
 }
 
-// UBJSON enables the binary UBJSON protocol.
+// UBJSON enables the binary UBJSON protocol on WebSocket, TCP and serial
+// connections, if the peer supports it.
 func UBJSON(enable bool) ConnectOption {
 	return func(c *connectOptions) error {
 		c.enableUBJSON = enable
@@ -183,6 +316,27 @@ func UBJSON(enable bool) ConnectOption {
 	}
 }
 
+// StreamChecksums makes TCP, Unix, serial and exec connections offer frames with
+// length and CRC32 to the peer, so that frames corrupted on the way are
+// dropped instead of breaking the stream. The peer has to agree, otherwise
+// plain frames are used.
+func StreamChecksums(enable bool) ConnectOption {
+	return func(c *connectOptions) error {
+		c.checksums = enable
+		return nil
+	}
+}
+
+// JSONRPC makes the connection use JSON-RPC 2.0 messages instead of frames.
+// Supported by HTTP POST, WebSocket (if the server agrees), TCP, Unix, serial
+// and exec connections. JSON-RPC has no notion of source and destination.
+func JSONRPC(enable bool) ConnectOption {
+	return func(c *connectOptions) error {
+		c.jsonRPC = enable
+		return nil
+	}
+}
+
 // Tracing enables the RPC tracing functionality.
 func Tracing(enable bool) ConnectOption {
 	return func(c *connectOptions) error {
@@ -191,6 +345,25 @@ func Tracing(enable bool) ConnectOption {
 	}
 }
 
+// PropagateDeadline makes calls carry the deadline of their context, so that
+// the peer can stop working on requests the caller no longer waits for.
+// Enabled by default.
+func PropagateDeadline(enable bool) ConnectOption {
+	return func(c *connectOptions) error {
+		c.propagateDeadline = enable
+		return nil
+	}
+}
+
+// RecordSession makes the connection write all the frames sent and received
+// to w, see codec.RecordSession.
+func RecordSession(w io.Writer) ConnectOption {
+	return func(c *connectOptions) error {
+		c.sessionRecorder = w
+		return nil
+	}
+}
+
 func JunkHandler(junkHandler func(junk []byte)) ConnectOption {
 	return func(c *connectOptions) error {
 		c.junkHandler = junkHandler
@@ -198,6 +371,171 @@ func JunkHandler(junkHandler func(junk []byte)) ConnectOption {
 	}
 }
 
+// UDPRetransmit sets how often and how many times requests sent over UDP are
+// retransmitted if there is no response.
+func UDPRetransmit(interval time.Duration, maxRetransmits int) ConnectOption {
+	return func(c *connectOptions) error {
+		c.udpOpts.RetransmitInterval = interval
+		c.udpOpts.MaxRetransmits = maxRetransmits
+		return nil
+	}
+}
+
+// UDPMaxDatagramSize limits the size of the frames sent over UDP, e.g. to
+// avoid IP fragmentation. Sending a bigger frame fails.
+func UDPMaxDatagramSize(size int) ConnectOption {
+	return func(c *connectOptions) error {
+		c.udpOpts.MaxDatagramSize = size
+		return nil
+	}
+}
+
+// MQTTCredentials sets the user name and password to connect to the MQTT
+// broker with.
+func MQTTCredentials(user, password string) ConnectOption {
+	return func(c *connectOptions) error {
+		c.mqttOpts.User = user
+		c.mqttOpts.Password = password
+		return nil
+	}
+}
+
+// MQTTClientID sets the MQTT client ID, which is also used as the source of
+// the outgoing frames.
+func MQTTClientID(clientID string) ConnectOption {
+	return func(c *connectOptions) error {
+		c.mqttOpts.ClientID = clientID
+		return nil
+	}
+}
+
+// MQTTTopics sets the topic layout: frames to a node with ID x are published
+// to prefix + x + suffix. The default is "" and "/rpc", respectively.
+func MQTTTopics(prefix, suffix string) ConnectOption {
+	return func(c *connectOptions) error {
+		c.mqttOpts.TopicPrefix = prefix
+		c.mqttOpts.TopicSuffix = suffix
+		return nil
+	}
+}
+
+// MQTTQoS sets the QoS of the MQTT subscription and messages, 1 by default.
+func MQTTQoS(qos byte) ConnectOption {
+	return func(c *connectOptions) error {
+		if qos > 2 {
+			return errors.Errorf("invalid MQTT QoS %d", qos)
+		}
+		c.mqttOpts.QoS = qos
+		return nil
+	}
+}
+
+// MQTTCleanSession sets the clean session flag of the MQTT connection, true
+// by default.
+func MQTTCleanSession(clean bool) ConnectOption {
+	return func(c *connectOptions) error {
+		c.mqttOpts.CleanSession = clean
+		return nil
+	}
+}
+
+// MatchResponseSrc makes Call accept only responses that come from the
+// destination of the request, which is useful when a connection carries calls
+// to many nodes, e.g. via an MQTT broker. Enabled automatically for MQTT URLs
+// without a device ID.
+func MatchResponseSrc(enable bool) ConnectOption {
+	return func(c *connectOptions) error {
+		c.matchResponseSrc = enable
+		return nil
+	}
+}
+
+// HelloOnConnect makes New send hello to dst once connected, so that
+// PeerInfo is available right away. Failed hello does not fail New.
+func HelloOnConnect(dst string) ConnectOption {
+	return func(c *connectOptions) error {
+		c.helloOnConnect = true
+		c.helloDst = dst
+		return nil
+	}
+}
+
+// MaxInFlight limits the number of requests that wait for a response at the
+// same time, further calls wait for earlier ones to complete. Negative n
+// removes the limit. By default, the limit depends on the transport; there is
+// none for NewWithCodec.
+func MaxInFlight(n int) ConnectOption {
+	return func(c *connectOptions) error {
+		if n == 0 {
+			return errors.Errorf("invalid number of requests in flight %d", n)
+		}
+		c.maxInFlight = n
+		return nil
+	}
+}
+
+// MTU limits the size of frames sent to the peer: frames which are bigger
+// when encoded as JSON are sent in fragments. By default, the maximum frame
+// size the peer reports in response to hello is used, if any.
+func MTU(mtu int) ConnectOption {
+	return func(c *connectOptions) error {
+		if mtu < 0 {
+			return errors.Errorf("invalid MTU %d", mtu)
+		}
+		c.mtu = mtu
+		return nil
+	}
+}
+
+// WebSocketKeepAlive sets how often WebSocket connections are pinged, and for
+// how long to wait for a response before considering the connection dead and
+// closing it (and reconnecting, if enabled). Zero pingInterval disables pings.
+// The default is 30 seconds and 10 seconds, respectively.
+func WebSocketKeepAlive(pingInterval, pongTimeout time.Duration) ConnectOption {
+	return func(c *connectOptions) error {
+		c.wsKeepAlive.PingInterval = pingInterval
+		c.wsKeepAlive.PongTimeout = pongTimeout
+		return nil
+	}
+}
+
+// SerialBaudRate sets the baud rate of the serial port, 115200 by default.
+func SerialBaudRate(baudRate uint) ConnectOption {
+	return func(c *connectOptions) error {
+		c.serialOpts.BaudRate = baudRate
+		return nil
+	}
+}
+
+// SerialHardwareFlowControl enables RTS/CTS flow control on the serial port.
+func SerialHardwareFlowControl(enable bool) ConnectOption {
+	return func(c *connectOptions) error {
+		c.serialOpts.HardwareFlowControl = enable
+		return nil
+	}
+}
+
+// SerialChunking makes data be written to the serial port in chunks of size
+// bytes, with delay after each chunk. Zero size disables chunking, which is
+// usually fine with flow control. The default is 16 bytes and 5 ms.
+func SerialChunking(size int, delay time.Duration) ConnectOption {
+	return func(c *connectOptions) error {
+		c.serialOpts.ChunkSize = size
+		c.serialOpts.ChunkDelay = delay
+		return nil
+	}
+}
+
+// SerialHandshake sets how often the handshake is attempted when talking to
+// a device over the serial port, and for how long.
+func SerialHandshake(interval, timeout time.Duration) ConnectOption {
+	return func(c *connectOptions) error {
+		c.serialOpts.HandshakeInterval = interval
+		c.serialOpts.HandshakeTimeout = timeout
+		return nil
+	}
+}
+
 func Reconnect(enable bool) ConnectOption {
 	return func(c *connectOptions) error {
 		c.enableReconnect = enable
@@ -205,6 +543,34 @@ func Reconnect(enable bool) ConnectOption {
 	}
 }
 
+// ReconnectBackoff sets the delay between reconnection attempts. The delay
+// starts at initial and doubles after each failed attempt, up to max.
+func ReconnectBackoff(initial, max time.Duration) ConnectOption {
+	return func(c *connectOptions) error {
+		c.reconnectOpts.InitialBackoff = initial
+		c.reconnectOpts.MaxBackoff = max
+		return nil
+	}
+}
+
+// ReconnectJitter sets the fraction by which reconnection delays are randomly
+// adjusted.
+func ReconnectJitter(jitter float64) ConnectOption {
+	return func(c *connectOptions) error {
+		c.reconnectOpts.Jitter = jitter
+		return nil
+	}
+}
+
+// ConnectionStateHandler sets the function which is invoked whenever
+// a reconnecting connection gets established or lost.
+func ConnectionStateHandler(handler func(codec.ConnStateEvent)) ConnectOption {
+	return func(c *connectOptions) error {
+		c.reconnectOpts.OnStateChange = handler
+		return nil
+	}
+}
+
 func badConnectOption(err error) ConnectOption {
 	return func(_ *connectOptions) error {
 		return err
@@ -213,7 +579,7 @@ func badConnectOption(err error) ConnectOption {
 
 // ListenerConfig specifies a listener that receives RPC connections.
 type ListenerConfig struct {
-	// Address suitable for net.Listener (currently only TCP).
+	// Address suitable for net.Listen or, for UDP listeners, net.ListenPacket.
 	Addr string `yaml:"addr"`
 	// If present, connections will be wrapped in a TLS wrapper and this field
 	// specifies the configuration.
@@ -227,6 +593,12 @@ type ListenerConfig struct {
 	// HTTP listener uses HTTP POST requests to send RPC frames.
 	// HTTP listener also supports WebSocket connections.
 	HTTP *HTTPListenerConfig `yaml:"http,omitempty"`
+	// UDP listener receives RPC frames in UDP datagrams, one frame per datagram.
+	// TLS is not supported.
+	UDP *UDPListenerConfig `yaml:"udp,omitempty"`
+
+	// If set, incoming requests must carry this pre-shared key.
+	PSK string `yaml:"psk,omitempty"`
 
 	EnableTracing bool `yaml:"enable_tracing"`
 }
@@ -250,15 +622,46 @@ type HTTPListenerConfig struct {
 	// Accept RPC frames in POST requests.
 	EnablePOST bool `yaml:"enable_post,omitempty"`
 	// Allow upgrading to a WebSocket connection.
-	// Note: Currently both POST and WebSocket cannot be used on the same listener.
 	EnableWebSocket bool `yaml:"enable_websocket,omitempty"`
 	// Cloud host base. If set, then for REST-like requests destination can be
 	// specified in the Host header, and will be derived by stripping this suffix.
 	CloudHost string `yaml:"cloud_host,omitempty"`
+	// If set, WebSocket connections are pinged at this interval and closed
+	// if the peer doesn't respond within WSPongTimeout (defaults to the
+	// interval).
+	WSPingInterval time.Duration `yaml:"ws_ping_interval,omitempty"`
+	WSPongTimeout  time.Duration `yaml:"ws_pong_timeout,omitempty"`
+	// POST requests carry JSON-RPC 2.0 requests or batches of them instead of
+	// frames.
+	JSONRPC bool `yaml:"jsonrpc,omitempty"`
 }
 
-// TCPListenerConfig is a TCP listener configuration.
+// TCPListenerConfig is a TCP listener configuration. Zero values mean
+// defaults.
 type TCPListenerConfig struct {
+	// By default, clients that offer UBJSON frames or frames with checksums
+	// get them. These turn the offers down, and plain JSON is used.
+	DisableUBJSON    bool `yaml:"disable_ubjson,omitempty"`
+	DisableChecksums bool `yaml:"disable_checksums,omitempty"`
+}
+
+// streamOptions returns options for the codecs of accepted connections.
+func (tc *TCPListenerConfig) streamOptions() codec.StreamOptions {
+	return codec.StreamOptions{
+		UBJSON:    !tc.DisableUBJSON,
+		Checksums: !tc.DisableChecksums,
+	}
+}
+
+// UDPListenerConfig is a UDP listener configuration. Zero values mean
+// defaults.
+type UDPListenerConfig struct {
+	// How often and how many times requests to peers are retransmitted if
+	// there is no response.
+	RetransmitInterval time.Duration `yaml:"retransmit_interval,omitempty"`
+	MaxRetransmits     int           `yaml:"max_retransmits,omitempty"`
+	// Peers that haven't sent anything for this long are forgotten.
+	IdleTimeout time.Duration `yaml:"idle_timeout,omitempty"`
 }
 
 // ListenerConfigFromURL offers a quick way to create ListenerConfig from URL, e.g. http://:8081.
@@ -285,6 +688,8 @@ func ListenerConfigFromURL(urlStr string) (ListenerConfig, error) {
 		fallthrough
 	case "tcp":
 		lc.TCP = &TCPListenerConfig{}
+	case "udp":
+		lc.UDP = &UDPListenerConfig{}
 	default:
 		err = errors.Errorf("unknown listen protocol %q", url.Scheme)
 	}
@@ -340,6 +745,14 @@ func VerifyClientsWithCAsFromFile(file string) ListenOption {
 	}
 }
 
+// ExpectPSK makes the listener reject requests that don't carry the given
+// pre-shared key.
+func ExpectPSK(psk string) ListenOption {
+	return func(c *ListenerConfig) {
+		c.PSK = psk
+	}
+}
+
 // ListenerTracing enables the RPC tracing functionality.
 func ListenerTracing(enable bool) ListenOption {
 	return func(c *ListenerConfig) {
@@ -0,0 +1,52 @@
+package mgrpc
+
+import (
+	"testing"
+	"time"
+
+	"cesanta.com/common/go/mgrpc/codec"
+)
+
+func TestConnectToSerial(t *testing.T) {
+	defaults := codec.DefaultSerialOptions()
+	fast := defaults
+	fast.BaudRate = 921600
+	fast.HardwareFlowControl = true
+	fast.ChunkSize = 0
+	slow := defaults
+	slow.ChunkDelay = 10 * time.Millisecond
+	slow.HandshakeTimeout = 20 * time.Second
+	cases := []struct {
+		url      string
+		wantAddr string
+		want     codec.SerialOptions
+		wantErr  bool
+	}{
+		{"serial:///dev/ttyUSB0", "/dev/ttyUSB0", defaults, false},
+		{"serial:///dev/ttyUSB0?baud=921600&fc=rtscts&chunk_size=0", "/dev/ttyUSB0", fast, false},
+		{"serial://COM7?chunk_delay=10ms&handshake_timeout=20s", "COM7", slow, false},
+		{"serial:///dev/ttyUSB0?baud=fast", "", defaults, true},
+		{"serial:///dev/ttyUSB0?fc=xonxoff", "", defaults, true},
+		{"serial:///dev/ttyUSB0?parity=even", "", defaults, true},
+	}
+	for _, tc := range cases {
+		opts := newConnectOptions()
+		err := connectTo(tc.url)(opts)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("%s: expected an error", tc.url)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", tc.url, err)
+			continue
+		}
+		if opts.proto != tSerial || opts.connectAddress != tc.wantAddr {
+			t.Errorf("%s: got %s %q, want %q", tc.url, opts.proto, opts.connectAddress, tc.wantAddr)
+		}
+		if opts.serialOpts != tc.want {
+			t.Errorf("%s: got %+v, want %+v", tc.url, opts.serialOpts, tc.want)
+		}
+	}
+}
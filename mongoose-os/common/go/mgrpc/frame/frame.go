@@ -33,17 +33,40 @@ type Frame struct {
 	Deadline int64 `json:"deadline,omitempty"`
 	// Number of seconds after reception of the command after when the command result is no longer relevant.
 	Timeout int64 `json:"timeout,omitempty"`
+	// If set, the peer may send progress frames before the response.
+	WantProgress bool `json:"want_progress,omitempty"`
 
 	// Response
 	Result ourjson.RawMessage `json:"result,omitempty"`
 	Error  *Error             `json:"error,omitempty"`
+	// Progress makes the frame an interim one, which reports the progress of
+	// a request that is still being served. The response with the same ID
+	// follows.
+	Progress ourjson.RawMessage `json:"progress,omitempty"`
 
 	Trace *Trace `json:"trace,omitempty"`
 
+	// Set if the frame is a piece of a bigger frame, see codec.Fragmenting.
+	Frag *Fragment `json:"frag,omitempty"`
+
 	// Size hint, if present, gives approximate size of the frame in memory.
 	SizeHint int `json:"-"`
 }
 
+// Fragment is a piece of a frame that is too big to be sent at once.
+// Fragments of a frame have the same Src, Dst, Key and ID as the frame itself,
+// but no Method, so that they are not mistaken for requests.
+type Fragment struct {
+	// Index of the fragment, starting from 0.
+	Index int `json:"i"`
+	// Count is the total number of fragments.
+	Count int `json:"n"`
+	// Request is set if the fragmented frame is a request.
+	Request bool `json:"r,omitempty"`
+	// Piece of the JSON-encoded frame.
+	Data []byte `json:"d"`
+}
+
 type Error struct {
 	Code    int    `json:"code"`
 	Message string `json:"message,omitempty"`
@@ -96,6 +119,12 @@ func (f *Frame) IsRequest() bool {
 	return f.Method != ""
 }
 
+// IsProgress returns true if the frame reports progress of a request rather
+// than responds to it.
+func (f *Frame) IsProgress() bool {
+	return !f.IsRequest() && f.Progress.IsInitialized()
+}
+
 const frameSizeStringifyLimit = 2048
 
 func (f *Frame) String() string {
@@ -105,6 +134,8 @@ func (f *Frame) String() string {
 	if f.SizeHint < frameSizeStringifyLimit {
 		if f.IsRequest() {
 			fmt.Fprintf(lim, "%s args=%v %d", f.Method, f.Args, f.SizeHint)
+		} else if f.IsProgress() {
+			fmt.Fprintf(lim, "progress=%v %d", f.Progress, f.SizeHint)
 		} else {
 			fmt.Fprintf(lim, "result=%v error=%v %d", f.Result, f.Error, f.SizeHint)
 		}
@@ -175,6 +206,19 @@ func NewResponseFrame(src string, dst string, key string, resp *Response) *Frame
 	return f
 }
 
+// NewProgressFrame creates a frame that reports progress of the request with
+// the given ID.
+func NewProgressFrame(src string, dst string, key string, id int64, progress ourjson.RawMessage) *Frame {
+	return &Frame{
+		Version:  2,
+		Src:      src,
+		Dst:      dst,
+		Key:      key,
+		ID:       id,
+		Progress: progress,
+	}
+}
+
 func NewCommandFromFrame(f *Frame) *Command {
 	return &Command{
 		Cmd:      f.Method,
@@ -0,0 +1,224 @@
+package frame
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sync"
+
+	"cesanta.com/common/go/ourjson"
+	"github.com/cesanta/errors"
+)
+
+// JSON-RPC 2.0 representation of frames, see
+// https://www.jsonrpc.org/specification. Only the members defined by the
+// specification are encoded, so source, destination, key, deadlines and trace
+// of the frame are not. Requests with ID 0 are notifications. Statuses of
+// the frames that have standard JSON-RPC counterparts are mapped to them.
+
+const jsonRPCVersion = "2.0"
+
+// Error codes defined by the specification.
+const (
+	JSONRPCParseError     = -32700
+	JSONRPCInvalidRequest = -32600
+	JSONRPCMethodNotFound = -32601
+	JSONRPCInvalidParams  = -32602
+	JSONRPCInternalError  = -32603
+)
+
+// jsonRPCCodes maps statuses to JSON-RPC error codes.
+var jsonRPCCodes = map[int]int{
+	404: JSONRPCMethodNotFound,
+	400: JSONRPCInvalidParams,
+	500: JSONRPCInternalError,
+}
+
+// JSONRPCIDs maps the JSON-RPC ids of requests that are not integers, such as
+// strings, to unique frame IDs, and maps them back when the responses are
+// marshaled. The zero value is ready to use. Integer ids are used as they are.
+type JSONRPCIDs struct {
+	lock sync.Mutex
+	next int64
+	ids  map[int64]json.RawMessage
+}
+
+// add returns the frame ID for the id. IDs are allocated from the bottom of
+// the range, where IDs chosen by peers are unlikely to be.
+func (m *JSONRPCIDs) add(id json.RawMessage) int64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.ids == nil {
+		m.ids = make(map[int64]json.RawMessage)
+	}
+	m.next++
+	fid := math.MinInt64 + m.next
+	m.ids[fid] = id
+	return fid
+}
+
+// take returns the original id the frame ID was mapped from, if any, and
+// forgets it.
+func (m *JSONRPCIDs) take(fid int64) (json.RawMessage, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	id, ok := m.ids[fid]
+	delete(m.ids, fid)
+	return id, ok
+}
+
+type jsonRPCMessage struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+
+	// Request
+	Method string             `json:"method,omitempty"`
+	Params ourjson.RawMessage `json:"params,omitempty"`
+
+	// Response
+	Result ourjson.RawMessage `json:"result,omitempty"`
+	Error  *jsonRPCError      `json:"error,omitempty"`
+}
+
+type jsonRPCError struct {
+	Code    int                `json:"code"`
+	Message string             `json:"message"`
+	Data    ourjson.RawMessage `json:"data,omitempty"`
+}
+
+func newJSONRPCMessage(f *Frame, ids *JSONRPCIDs) *jsonRPCMessage {
+	m := &jsonRPCMessage{JSONRPC: jsonRPCVersion}
+	if f.ID != 0 {
+		m.ID = json.RawMessage(fmt.Sprintf("%d", f.ID))
+	}
+	if f.IsRequest() {
+		m.Method = f.Method
+		m.Params = f.Args
+		return m
+	}
+	if f.ID == 0 {
+		// The ID of the request is unknown.
+		m.ID = json.RawMessage("null")
+	} else if ids != nil {
+		if id, ok := ids.take(f.ID); ok {
+			m.ID = id
+		}
+	}
+	if f.Error != nil {
+		code := f.Error.Code
+		if c, ok := jsonRPCCodes[code]; ok {
+			code = c
+		}
+		m.Error = &jsonRPCError{Code: code, Message: f.Error.Message}
+	} else {
+		m.Result = f.Result
+		if !m.Result.IsInitialized() {
+			// Result is required in a successful response.
+			m.Result = ourjson.RawJSON([]byte("null"))
+		}
+	}
+	return m
+}
+
+// marshalJSONRPC encodes v without the trailing newline.
+func marshalJSONRPC(v interface{}) ([]byte, error) {
+	b, err := ourjson.MarshalJSONNoHTMLEscape(v)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return bytes.TrimRight(b, "\n"), nil
+}
+
+// MarshalJSONRPC encodes the frame as a JSON-RPC 2.0 request or response. If
+// ids is not nil, the ID of a response is mapped back to the id of the request.
+func MarshalJSONRPC(f *Frame, ids *JSONRPCIDs) ([]byte, error) {
+	return marshalJSONRPC(newJSONRPCMessage(f, ids))
+}
+
+// MarshalJSONRPCBatch encodes the frames as a JSON-RPC 2.0 batch.
+func MarshalJSONRPCBatch(fs []*Frame, ids *JSONRPCIDs) ([]byte, error) {
+	ms := make([]*jsonRPCMessage, len(fs))
+	for i, f := range fs {
+		ms[i] = newJSONRPCMessage(f, ids)
+	}
+	return marshalJSONRPC(ms)
+}
+
+// UnmarshalJSONRPC decodes a JSON-RPC 2.0 request or response, or a batch of
+// them, in which case batch is true. Messages that are not valid JSON-RPC are
+// not returned in fs, there is an Invalid Request error response for each of
+// them in invalid instead. An error is only returned if data is not JSON at
+// all. If ids is not nil, requests may have ids that are not integers, they
+// are mapped to frame IDs; otherwise such requests are invalid.
+func UnmarshalJSONRPC(data []byte, ids *JSONRPCIDs) (fs, invalid []*Frame, batch bool, err error) {
+	data = bytes.TrimSpace(data)
+	if !json.Valid(data) {
+		return nil, nil, false, errors.Errorf("invalid JSON")
+	}
+	var ms []json.RawMessage
+	if data[0] != '[' {
+		ms = append(ms, data)
+	} else if err := json.Unmarshal(data, &ms); err != nil {
+		return nil, nil, false, errors.Trace(err)
+	} else if len(ms) == 0 {
+		// An empty batch is answered with a single response.
+		return nil, []*Frame{newInvalidRequest(errors.Errorf("empty batch"))}, false, nil
+	} else {
+		batch = true
+	}
+	for _, md := range ms {
+		f, err := unmarshalJSONRPCMessage(md, ids)
+		if err != nil {
+			invalid = append(invalid, newInvalidRequest(err))
+			continue
+		}
+		fs = append(fs, f)
+	}
+	return fs, invalid, batch, nil
+}
+
+// newInvalidRequest returns the response to a message that is not valid. The
+// id of an invalid message is not known, so it's null.
+func newInvalidRequest(err error) *Frame {
+	return &Frame{Version: 2, Error: &Error{Code: JSONRPCInvalidRequest, Message: err.Error()}}
+}
+
+func unmarshalJSONRPCMessage(data []byte, ids *JSONRPCIDs) (*Frame, error) {
+	var m jsonRPCMessage
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if m.JSONRPC != jsonRPCVersion {
+		return nil, errors.Errorf("unsupported JSON-RPC version %q", m.JSONRPC)
+	}
+	f := &Frame{Version: 2, SizeHint: len(data)}
+	if len(m.ID) > 0 && string(m.ID) != "null" {
+		if err := json.Unmarshal(m.ID, &f.ID); err != nil {
+			if ids == nil || m.Method == "" {
+				return nil, errors.Errorf("unsupported id %s, only integers are supported", m.ID)
+			}
+			f.ID = ids.add(m.ID)
+		}
+	}
+	switch {
+	case m.Method != "":
+		if m.Result.IsInitialized() || m.Error != nil {
+			return nil, errors.Errorf("request must not have result or error")
+		}
+		f.Method = m.Method
+		f.Args = m.Params
+	case m.Error != nil:
+		f.Error = &Error{Code: m.Error.Code, Message: m.Error.Message}
+		for status, code := range jsonRPCCodes {
+			if code == m.Error.Code {
+				f.Error.Code = status
+			}
+		}
+	case m.Result.IsInitialized():
+		f.Result = m.Result
+	default:
+		return nil, errors.Errorf("neither a request nor a response")
+	}
+	return f, nil
+}
@@ -0,0 +1,119 @@
+package frame
+
+import (
+	"testing"
+
+	"cesanta.com/common/go/ourjson"
+)
+
+func TestMarshalJSONRPC(t *testing.T) {
+	cases := []struct {
+		f    *Frame
+		want string
+	}{
+		{
+			&Frame{Src: "mos", ID: 1, Method: "Sys.GetInfo", Args: ourjson.RawJSON([]byte(`{"a":1}`))},
+			`{"jsonrpc":"2.0","id":1,"method":"Sys.GetInfo","params":{"a":1}}`,
+		},
+		{&Frame{Method: "Log"}, `{"jsonrpc":"2.0","method":"Log"}`},
+		{&Frame{ID: 2, Result: ourjson.RawJSON([]byte(`true`))}, `{"jsonrpc":"2.0","id":2,"result":true}`},
+		{&Frame{ID: 3}, `{"jsonrpc":"2.0","id":3,"result":null}`},
+		{
+			&Frame{ID: 4, Error: &Error{Code: 404, Message: "no such method"}},
+			`{"jsonrpc":"2.0","id":4,"error":{"code":-32601,"message":"no such method"}}`,
+		},
+		{
+			&Frame{ID: 5, Error: &Error{Code: 403, Message: "denied"}},
+			`{"jsonrpc":"2.0","id":5,"error":{"code":403,"message":"denied"}}`,
+		},
+	}
+	for _, tc := range cases {
+		b, err := MarshalJSONRPC(tc.f, nil)
+		if err != nil {
+			t.Errorf("%s: %s", tc.f, err)
+			continue
+		}
+		if string(b) != tc.want {
+			t.Errorf("got %s, want %s", b, tc.want)
+		}
+		fs, invalid, batch, err := UnmarshalJSONRPC(b, nil)
+		if err != nil || batch || len(fs) != 1 || len(invalid) != 0 {
+			t.Errorf("%s: got %v %v %t %v", b, fs, invalid, batch, err)
+			continue
+		}
+		if f := fs[0]; f.ID != tc.f.ID || f.Method != tc.f.Method || (f.Error == nil) != (tc.f.Error == nil) {
+			t.Errorf("%s: got %s", b, f)
+		}
+		if f := fs[0]; f.Error != nil && f.Error.Code != tc.f.Error.Code {
+			t.Errorf("%s: got code %d, want %d", b, f.Error.Code, tc.f.Error.Code)
+		}
+	}
+}
+
+func TestUnmarshalJSONRPC(t *testing.T) {
+	fs, invalid, batch, err := UnmarshalJSONRPC([]byte(` [{"jsonrpc":"2.0","id":1,"method":"A"}, {"jsonrpc":"2.0","id":null,"error":{"code":-32600,"message":"bad"}}]`), nil)
+	if err != nil || !batch || len(fs) != 2 || len(invalid) != 0 {
+		t.Fatalf("got %v %v %t %v", fs, invalid, batch, err)
+	}
+	if fs[0].ID != 1 || fs[0].Method != "A" || fs[1].ID != 0 || fs[1].Error.Code != -32600 {
+		t.Errorf("got %s, %s", fs[0], fs[1])
+	}
+	for _, bad := range []string{
+		``,
+		`{"jsonrpc":"2.0","id":1,"method":"A"`,
+		`[{"jsonrpc":"2.0","id":1,"method":"A"},`,
+	} {
+		if _, _, _, err := UnmarshalJSONRPC([]byte(bad), nil); err == nil {
+			t.Errorf("%s: expected an error", bad)
+		}
+	}
+	// Messages that are JSON, but not JSON-RPC, get an error response each.
+	for _, bad := range []string{
+		`[]`,
+		`1`,
+		`{"id":1,"method":"A"}`,
+		`{"jsonrpc":"2.0","id":"abc","method":"A"}`,
+		`{"jsonrpc":"2.0","id":1}`,
+		`{"jsonrpc":"2.0","id":1,"method":"A","result":1}`,
+	} {
+		fs, invalid, batch, err := UnmarshalJSONRPC([]byte(bad), nil)
+		if err != nil || batch || len(fs) != 0 || len(invalid) != 1 {
+			t.Errorf("%s: got %v %v %t %v", bad, fs, invalid, batch, err)
+			continue
+		}
+		if f := invalid[0]; f.ID != 0 || f.Error.Code != JSONRPCInvalidRequest {
+			t.Errorf("%s: got %s", bad, f)
+		}
+	}
+	fs, invalid, batch, err = UnmarshalJSONRPC([]byte(`[{"jsonrpc":"2.0","id":1,"method":"A"},1,{"jsonrpc":"1.0","id":2,"method":"B"}]`), nil)
+	if err != nil || !batch || len(fs) != 1 || len(invalid) != 2 {
+		t.Errorf("got %v %v %t %v", fs, invalid, batch, err)
+	}
+}
+
+func TestJSONRPCIDs(t *testing.T) {
+	var ids JSONRPCIDs
+	fs, invalid, _, err := UnmarshalJSONRPC([]byte(`[
+		{"jsonrpc":"2.0","id":"abc","method":"A"},
+		{"jsonrpc":"2.0","id":1.5,"method":"B"},
+		{"jsonrpc":"2.0","id":3,"method":"C"}
+	]`), &ids)
+	if err != nil || len(fs) != 3 || len(invalid) != 0 {
+		t.Fatalf("got %v %v %v", fs, invalid, err)
+	}
+	if fs[0].ID == 0 || fs[0].ID == fs[1].ID || fs[2].ID != 3 {
+		t.Errorf("got IDs %d, %d, %d", fs[0].ID, fs[1].ID, fs[2].ID)
+	}
+	b, err := MarshalJSONRPCBatch([]*Frame{{ID: fs[1].ID}, {ID: fs[0].ID}, {ID: 3}}, &ids)
+	if want := `[{"jsonrpc":"2.0","id":1.5,"result":null},{"jsonrpc":"2.0","id":"abc","result":null},{"jsonrpc":"2.0","id":3,"result":null}]`; err != nil || string(b) != want {
+		t.Errorf("got %s %v, want %s", b, err, want)
+	}
+	if len(ids.ids) != 0 {
+		t.Errorf("ids have not been forgotten: %v", ids.ids)
+	}
+	// Responses must have the IDs of our requests.
+	_, invalid, _, _ = UnmarshalJSONRPC([]byte(`{"jsonrpc":"2.0","id":"abc","result":1}`), &ids)
+	if len(invalid) != 1 {
+		t.Errorf("response with a string id has been accepted")
+	}
+}
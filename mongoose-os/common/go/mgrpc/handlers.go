@@ -0,0 +1,58 @@
+package mgrpc
+
+import (
+	"sort"
+	"sync"
+)
+
+// handlerSet is a registry of handlers for incoming requests, shared between
+// a client connection or all the connections accepted by a Server.
+type handlerSet struct {
+	lock           sync.Mutex
+	handlers       map[string]Handler
+	defaultHandler Handler
+}
+
+func newHandlerSet() *handlerSet {
+	return &handlerSet{handlers: make(map[string]Handler)}
+}
+
+func (hs *handlerSet) add(method string, handler Handler) {
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	hs.handlers[method] = handler
+}
+
+func (hs *handlerSet) setDefault(handler Handler) {
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	hs.defaultHandler = handler
+}
+
+// get returns the handler for the given method, falling back to the default
+// handler. Returns nil if there is neither. Hello never goes to the default
+// handler: unless there is a handler for it, it's answered by the RPC
+// instance itself.
+func (hs *handlerSet) get(method string) Handler {
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	if h, ok := hs.handlers[method]; ok {
+		return h
+	}
+	if method == helloMethod {
+		return nil
+	}
+	return hs.defaultHandler
+}
+
+// methods returns the sorted list of methods that have handlers.
+func (hs *handlerSet) methods() []string {
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	var r []string
+	for m := range hs.handlers {
+		r = append(r, m)
+	}
+	sort.Strings(r)
+	return r
+}
@@ -0,0 +1,140 @@
+package mgrpc
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"cesanta.com/common/go/mgrpc/frame"
+	"cesanta.com/common/go/ourjson"
+	"github.com/cesanta/errors"
+	"github.com/golang/glog"
+)
+
+const (
+	helloMethod = "/v1/Hello"
+	// Used to get the method list from peers that don't know about hello.
+	listMethod = "RPC.List"
+
+	// Version of the protocol reported to the peers that send hello.
+	protocolVersion = 2
+
+	// How long the handshake done on connect may take.
+	helloTimeout = 5 * time.Second
+)
+
+// PeerInfo describes what the peer supports, as reported in response to the
+// hello request.
+type PeerInfo struct {
+	// ProtocolVersion is 0 if the peer does not support hello.
+	ProtocolVersion int `json:"protocol_version"`
+	// Encodings the peer can receive, most preferred first.
+	Encodings []string `json:"encodings,omitempty"`
+	// MaxFrameSize is the largest frame the peer can receive, 0 if unknown.
+	MaxFrameSize int `json:"max_frame_size,omitempty"`
+	// Methods the peer serves.
+	Methods []string `json:"methods,omitempty"`
+}
+
+// SupportsEncoding returns true if the peer can receive frames in the given
+// encoding.
+func (pi *PeerInfo) SupportsEncoding(enc string) bool {
+	for _, e := range pi.Encodings {
+		if e == enc {
+			return true
+		}
+	}
+	return false
+}
+
+// HasMethod returns true if the peer serves the given method.
+func (pi *PeerInfo) HasMethod(method string) bool {
+	for _, m := range pi.Methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// SendHello asks the peer about its capabilities. The result is also kept
+// and returned by PeerInfo, and the maximum frame size reported by the peer
+// becomes the MTU, unless it has been set explicitly. For peers that don't
+// support hello, only the method list is filled in, if the peer can provide
+// it.
+func (r *mgRPCImpl) SendHello(ctx context.Context, dst string) (*PeerInfo, error) {
+	glog.V(2).Infof("Sending hello to %q", dst)
+	resp, err := r.Call(ctx, dst, &frame.Command{Cmd: helloMethod})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	glog.V(2).Infof("Hello response: %+v", resp)
+	info := &PeerInfo{}
+	switch {
+	case resp.Status == 0:
+		if resp.Response.IsInitialized() {
+			if err := resp.Response.UnmarshalInto(info); err != nil {
+				return nil, errors.Annotatef(err, "invalid hello response")
+			}
+		}
+	case resp.Status == 404:
+		// Older firmware: all we can learn is the method list.
+		resp, err = r.Call(ctx, dst, &frame.Command{Cmd: listMethod})
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if resp.Status == 0 && resp.Response.IsInitialized() {
+			if err := resp.Response.UnmarshalInto(&info.Methods); err != nil {
+				return nil, errors.Annotatef(err, "invalid %s response", listMethod)
+			}
+		}
+	default:
+		return nil, errors.Trace(&ErrorResponse{Status: resp.Status, Msg: resp.StatusMsg})
+	}
+	r.peerInfoLock.Lock()
+	r.peerInfo = info
+	r.peerInfoLock.Unlock()
+	if r.frag != nil && r.opts.mtu == 0 && info.MaxFrameSize > 0 {
+		glog.V(1).Infof("%q accepts frames up to %d bytes", dst, info.MaxFrameSize)
+		r.frag.SetMTU(info.MaxFrameSize)
+	}
+	return info, nil
+}
+
+// PeerInfo returns the result of the last successful SendHello, or nil if
+// there was none.
+func (r *mgRPCImpl) PeerInfo() *PeerInfo {
+	r.peerInfoLock.Lock()
+	defer r.peerInfoLock.Unlock()
+	return r.peerInfo
+}
+
+// helloOnConnect does the handshake requested with HelloOnConnect. Failure
+// is not fatal: the connection is usable, only the peer info is missing.
+func (r *mgRPCImpl) helloOnConnect(ctx context.Context) {
+	if !r.opts.helloOnConnect {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, helloTimeout)
+	defer cancel()
+	if _, err := r.SendHello(ctx, r.opts.helloDst); err != nil {
+		glog.Infof("hello to %q failed: %s", r.opts.helloDst, err)
+	}
+}
+
+// helloResponse describes this side to the peer that sent hello.
+func (r *mgRPCImpl) helloResponse() *frame.Response {
+	info := &PeerInfo{
+		ProtocolVersion: protocolVersion,
+		Encodings:       []string{"json"},
+		Methods:         r.handlers.methods(),
+	}
+	if r.opts.enableUBJSON {
+		info.Encodings = []string{"ubjson", "json"}
+	}
+	b, err := json.Marshal(info)
+	if err != nil {
+		return &frame.Response{Status: 500, StatusMsg: err.Error()}
+	}
+	return &frame.Response{Response: ourjson.RawJSON(b)}
+}
@@ -0,0 +1,102 @@
+package mgrpc
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"cesanta.com/common/go/mgrpc/codec"
+	"cesanta.com/common/go/mgrpc/frame"
+	"cesanta.com/common/go/ourjson"
+)
+
+func TestHello(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ok := func(ctx context.Context, rpc MgRPC, src string, cmd *frame.Command) *frame.Response {
+		return nil
+	}
+	hc, dc := codec.Pipe()
+	dev, err := NewWithCodec(ctx, dc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dev.Disconnect(ctx)
+	dev.AddHandler("Sys.Reboot", ok)
+	dev.AddHandler("FS.Put", ok)
+	host, err := NewWithCodec(ctx, hc, HelloOnConnect(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer host.Disconnect(ctx)
+	want := &PeerInfo{
+		ProtocolVersion: protocolVersion,
+		Encodings:       []string{"ubjson", "json"},
+		Methods:         []string{"FS.Put", "Sys.Reboot"},
+	}
+	if got := host.PeerInfo(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	// Hello is answered even if there is a default handler.
+	listOnly := func(ctx context.Context, rpc MgRPC, src string, cmd *frame.Command) *frame.Response {
+		if cmd.Cmd == listMethod {
+			return &frame.Response{Response: ourjson.RawJSON([]byte(`["Sys.Reboot"]`))}
+		}
+		return &frame.Response{Status: 404, StatusMsg: "No handler"}
+	}
+	hc, dc = codec.Pipe()
+	old, err := NewWithCodec(ctx, dc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer old.Disconnect(ctx)
+	old.SetDefaultHandler(listOnly)
+	host, err = NewWithCodec(ctx, hc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer host.Disconnect(ctx)
+	info, err := host.SendHello(ctx, "")
+	if err != nil || info.ProtocolVersion != protocolVersion {
+		t.Fatalf("got %+v, %v", info, err)
+	}
+
+	// A peer that does not know about hello, but can list its methods.
+	hc, dc = codec.Pipe()
+	old, err = NewWithCodec(ctx, dc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer old.Disconnect(ctx)
+	old.SetDefaultHandler(listOnly)
+	old.AddHandler(helloMethod, listOnly)
+	host, err = NewWithCodec(ctx, hc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer host.Disconnect(ctx)
+	if host.PeerInfo() != nil {
+		t.Errorf("peer info is available before hello")
+	}
+	info, err = host.SendHello(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = &PeerInfo{Methods: []string{"Sys.Reboot"}}
+	if !reflect.DeepEqual(info, want) || !info.HasMethod("Sys.Reboot") || info.SupportsEncoding("ubjson") {
+		t.Errorf("got %+v, want %+v", info, want)
+	}
+
+	// MTU is taken from the handshake.
+	old.AddHandler(helloMethod, func(ctx context.Context, rpc MgRPC, src string, cmd *frame.Command) *frame.Response {
+		return &frame.Response{Response: ourjson.RawJSON([]byte(`{"protocol_version":2,"max_frame_size":512}`))}
+	})
+	if _, err := host.SendHello(ctx, ""); err != nil {
+		t.Fatal(err)
+	}
+	if mtu := host.(*mgRPCImpl).frag.MTU(); mtu != 512 {
+		t.Errorf("got MTU %d, want 512", mtu)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"crypto/tls"
 	"fmt"
+	"io"
 	"net"
 	"strings"
 	"sync"
@@ -21,28 +22,78 @@ type MgRPC interface {
 	Call(
 		ctx context.Context, dst string, cmd *frame.Command,
 	) (*frame.Response, error)
+	// CallBatch sends the commands to dst and collects all the responses, see
+	// BatchResult.
+	CallBatch(
+		ctx context.Context, dst string, cmds []*frame.Command,
+	) ([]BatchResult, error)
+	// AddHandler registers a handler for incoming requests to the given method.
+	AddHandler(method string, handler Handler)
+	// SetDefaultHandler sets the handler for incoming requests to methods that
+	// have no handler registered.
+	SetDefaultHandler(handler Handler)
+	// SendHello asks the peer about its capabilities, see PeerInfo.
+	SendHello(ctx context.Context, dst string) (*PeerInfo, error)
+	// PeerInfo returns what the peer has reported in response to the last
+	// successful SendHello, or nil.
+	PeerInfo() *PeerInfo
+	// ConnectionInfo describes the connection to the peer.
+	ConnectionInfo() codec.ConnectionInfo
+	// MaxInFlight returns how many requests are sent before the peer has
+	// responded to the earlier ones, zero if there is no limit.
+	MaxInFlight() int
 	Disconnect(ctx context.Context) error
 }
 
+// Handler serves a request initiated by the remote peer. rpc is the
+// connection the request has arrived on, src is the ID of the caller.
+// Returned response is sent back to the caller; its ID is filled in
+// automatically.
+type Handler func(
+	ctx context.Context, rpc MgRPC, src string, cmd *frame.Command,
+) *frame.Response
+
 type mgRPCImpl struct {
 	codec codec.Codec
+	// Fragments outgoing frames, MTU is updated by SendHello.
+	frag *codec.FragmentingCodec
 
 	// Map of outgoing requests, and its lock
 	reqs     map[int64]req
 	reqsLock sync.Mutex
 
+	// Handlers for incoming requests
+	handlers *handlerSet
+
+	// Limits the number of requests in flight
+	sendQueue sendQueue
+
 	opts *connectOptions
 
+	// Set by Disconnect, protected by reqsLock
 	closing bool
+
+	// Set by SendHello, and its lock
+	peerInfo     *PeerInfo
+	peerInfoLock sync.Mutex
 }
 
 type req struct {
-	respChan chan *frame.Response
+	// Destination the request has been sent to.
+	dst      string
+	respChan chan *frame.Frame
 	errChan  chan error
+	// Set if the caller has asked for progress.
+	progressChan chan *frame.Frame
 }
 
 const tcpKeepAliveInterval = 3 * time.Minute
 
+const (
+	defaultWSPingInterval = 30 * time.Second
+	defaultWSPongTimeout  = 10 * time.Second
+)
+
 // ErrorResponse is an error type for failed commands. Intended for use by
 // wrappers around Call() method, like ones generated by clubbygen.
 type ErrorResponse struct {
@@ -56,25 +107,65 @@ func (e ErrorResponse) Error() string {
 	return fmt.Sprintf("(%d) %s", e.Status, e.Msg)
 }
 
+// BatchResult is the outcome of one of the commands sent with CallBatch.
+type BatchResult struct {
+	// Response is nil if no response has been received.
+	Response *frame.Response
+	// Err is set if the call has failed, including ErrorResponse if the
+	// response has non-zero status.
+	Err error
+}
+
 func New(ctx context.Context, connectAddr string, opts ...ConnectOption) (MgRPC, error) {
 
 	opts = append(opts, connectTo(connectAddr))
 
 	rpc := mgRPCImpl{
-		reqs: make(map[int64]req),
+		reqs:     make(map[int64]req),
+		handlers: newHandlerSet(),
 	}
 	if err := rpc.connect(ctx, opts...); err != nil {
 		return nil, errors.Trace(err)
 	}
 
 	go rpc.recvLoop(ctx, rpc.codec)
+	rpc.helloOnConnect(ctx)
 
 	return &rpc, nil
 }
 
+// NewWithCodec creates an RPC instance on top of an already established
+// connection, e.g. one end of codec.Pipe. Options that specify how to connect
+// have no effect.
+func NewWithCodec(ctx context.Context, c codec.Codec, opts ...ConnectOption) (MgRPC, error) {
+	rpc := &mgRPCImpl{
+		codec:    c,
+		reqs:     make(map[int64]req),
+		handlers: newHandlerSet(),
+		opts:     newConnectOptions(),
+	}
+	for _, opt := range opts {
+		if err := opt(rpc.opts); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	rpc.sendQueue.limit = rpc.opts.maxInFlight
+	rpc.frag = codec.Fragmenting(c, rpc.opts.mtu)
+	rpc.codec = rpc.frag
+	if rpc.opts.sessionRecorder != nil {
+		rpc.codec = codec.RecordSession(rpc.codec, rpc.opts.sessionRecorder)
+	}
+
+	go rpc.recvLoop(ctx, rpc.codec)
+	rpc.helloOnConnect(ctx)
+
+	return rpc, nil
+}
+
 // wsDialConfig does the same thing as websocket.DialConfig, but also enables
-// TCP keep-alive.
-func wsDialConfig(config *websocket.Config) (*websocket.Conn, error) {
+// TCP keep-alive. The returned ActivityConn tracks data received on the
+// connection.
+func wsDialConfig(config *websocket.Config) (*websocket.Conn, *codec.ActivityConn, error) {
 	host, port, err := net.SplitHostPort(config.Location.Host)
 	if err != nil {
 		// Assuming that no port specified.
@@ -92,30 +183,34 @@ func wsDialConfig(config *websocket.Config) (*websocket.Conn, error) {
 			port = "443"
 		}
 	default:
-		return nil, errors.Trace(websocket.ErrBadScheme)
+		return nil, nil, errors.Trace(websocket.ErrBadScheme)
 	}
 	addr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(host, port))
 	if err != nil {
-		return nil, errors.Annotate(err, "net.ResolveTCPAddr")
+		return nil, nil, errors.Annotate(err, "net.ResolveTCPAddr")
 	}
 	tc, err := net.DialTCP("tcp", nil, addr)
 	if err != nil {
-		return nil, errors.Annotate(err, "net.DialTCP")
+		return nil, nil, errors.Annotate(err, "net.DialTCP")
 	}
 	tc.SetKeepAlive(true)
 	tc.SetKeepAlivePeriod(tcpKeepAliveInterval)
-	var nc net.Conn = tc
+	ac := codec.NewActivityConn(tc)
+	var nc net.Conn = ac
 
 	if config.Location.Scheme == "wss" {
 		nc = tls.Client(nc, config.TlsConfig)
 	}
 
 	conn, err := websocket.NewClient(config, nc)
-	return conn, errors.Trace(err)
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	return conn, ac, nil
 }
 
 func (r *mgRPCImpl) mqttConnect(dst string, opts *connectOptions) (codec.Codec, error) {
-	return codec.MQTT(dst, opts.tlsConfig)
+	return codec.MQTT(dst, opts.tlsConfig, opts.mqttOpts)
 }
 
 func (r *mgRPCImpl) wsConnect(url string, opts *connectOptions) (codec.Codec, error) {
@@ -126,34 +221,88 @@ func (r *mgRPCImpl) wsConnect(url string, opts *connectOptions) (codec.Codec, er
 		return nil, errors.Trace(err)
 	}
 	encodings := []string{"json"}
-	if opts.enableUBJSON {
+	switch {
+	case opts.jsonRPC:
+		encodings = []string{"jsonrpc"}
+	case opts.enableUBJSON:
 		encodings = append([]string{"ubjson"}, encodings...)
 	}
 	s := strings.Join(encodings, "|")
 	config.Protocol = []string{codec.WSProtocol}
 	config.OutboundExtensions = []string{fmt.Sprintf("%s; in=%s; out=%s", codec.WSEncodingExtension, s, s)}
 	config.TlsConfig = opts.tlsConfig
-	conn, err := wsDialConfig(config)
+	conn, ac, err := wsDialConfig(config)
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
-	return codec.WebSocket(conn), nil
+	ka := opts.wsKeepAlive
+	ka.LastRead = ac.LastRead
+	return codec.WebSocket(conn, ka), nil
 }
 
 func (r *mgRPCImpl) tcpConnect(tcpAddress string, opts *connectOptions) (codec.Codec, error) {
-	// TODO(imax): add TLS support.
 	conn, err := net.Dial("tcp", tcpAddress)
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
 	conn.(*net.TCPConn).SetKeepAlive(true)
 	conn.(*net.TCPConn).SetKeepAlivePeriod(tcpKeepAliveInterval)
-	return codec.TCP(conn), nil
+	if opts.useTLS {
+		host, _, err := net.SplitHostPort(tcpAddress)
+		if err != nil {
+			host = tcpAddress
+		}
+		tlsConn := tls.Client(conn, opts.clientTLSConfig(host))
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, errors.Annotatef(err, "TLS handshake with %s", tcpAddress)
+		}
+		conn = tlsConn
+	}
+	return codec.TCP(conn, codec.StreamOptions{UBJSON: opts.enableUBJSON, Checksums: opts.checksums, JSONRPC: opts.jsonRPC, Client: true}), nil
+}
+
+func (r *mgRPCImpl) unixConnect(path string, opts *connectOptions) (codec.Codec, error) {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return codec.Unix(conn, codec.StreamOptions{UBJSON: opts.enableUBJSON, Checksums: opts.checksums, JSONRPC: opts.jsonRPC, Client: true}), nil
+}
+
+func (r *mgRPCImpl) udpConnect(address string, opts *connectOptions) (codec.Codec, error) {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return codec.UDP(conn, opts.udpOpts), nil
+}
+
+func (r *mgRPCImpl) execConnect(cmdLine string, opts *connectOptions) (codec.Codec, error) {
+	c, err := codec.Exec(strings.Fields(cmdLine), codec.StreamOptions{
+		JunkHandler: opts.junkHandler,
+		UBJSON:      opts.enableUBJSON,
+		Checksums:   opts.checksums,
+		JSONRPC:     opts.jsonRPC,
+		Client:      true,
+	})
+	return c, errors.Trace(err)
 }
+
 func (r *mgRPCImpl) serialConnect(
 	ctx context.Context, portName string, opts *connectOptions,
 ) (codec.Codec, error) {
-	sc, err := codec.Serial(ctx, portName, opts.junkHandler)
+	sc, err := codec.Serial(ctx, portName, codec.StreamOptions{
+		JunkHandler: opts.junkHandler,
+		UBJSON:      opts.enableUBJSON,
+		Checksums:   opts.checksums,
+		JSONRPC:     opts.jsonRPC,
+		Client:      true,
+	}, opts.serialOpts)
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
@@ -161,7 +310,7 @@ func (r *mgRPCImpl) serialConnect(
 }
 
 func (r *mgRPCImpl) connect(ctx context.Context, opts ...ConnectOption) error {
-	r.opts = &connectOptions{enableUBJSON: true}
+	r.opts = newConnectOptions()
 
 	for _, opt := range opts {
 		if err := opt(r.opts); err != nil {
@@ -174,28 +323,34 @@ func (r *mgRPCImpl) connect(ctx context.Context, opts ...ConnectOption) error {
 	switch r.opts.proto {
 
 	case tHTTP_POST:
-		r.codec = codec.OutboundHTTP(r.opts.connectAddress, r.opts.tlsConfig)
+		if r.opts.httpREST {
+			r.codec = codec.OutboundRESTHTTP(r.opts.connectAddress, r.opts.tlsConfig)
+		} else if r.opts.jsonRPC {
+			r.codec = codec.OutboundJSONRPCHTTP(r.opts.connectAddress, r.opts.tlsConfig)
+		} else {
+			r.codec = codec.OutboundHTTP(r.opts.connectAddress, r.opts.tlsConfig)
+		}
 	case tWebSocket:
 		r.codec = codec.NewReconnectWrapperCodec(
 			r.opts.connectAddress,
 			func(wsURL string) (codec.Codec, error) {
 				c, err := r.wsConnect(wsURL, r.opts)
 				return c, errors.Trace(err)
-			})
+			}, r.opts.reconnectOpts)
 	case tMQTT:
 		r.codec = codec.NewReconnectWrapperCodec(
 			r.opts.connectAddress,
 			func(mqttURL string) (codec.Codec, error) {
 				c, err := r.mqttConnect(mqttURL, r.opts)
 				return c, errors.Trace(err)
-			})
+			}, r.opts.reconnectOpts)
 	case tPlainTCP:
 		r.codec = codec.NewReconnectWrapperCodec(
 			r.opts.connectAddress,
 			func(tcpAddress string) (codec.Codec, error) {
 				c, err := r.tcpConnect(tcpAddress, r.opts)
 				return c, errors.Trace(err)
-			})
+			}, r.opts.reconnectOpts)
 	case tSerial:
 		if r.opts.enableReconnect {
 			r.codec = codec.NewReconnectWrapperCodec(
@@ -203,7 +358,7 @@ func (r *mgRPCImpl) connect(ctx context.Context, opts ...ConnectOption) error {
 				func(serialAddress string) (codec.Codec, error) {
 					c, err := r.serialConnect(ctx, serialAddress, r.opts)
 					return c, errors.Trace(err)
-				})
+				}, r.opts.reconnectOpts)
 		} else {
 			serialCodec, err := r.serialConnect(ctx, r.opts.connectAddress, r.opts)
 			if err != nil {
@@ -212,15 +367,57 @@ func (r *mgRPCImpl) connect(ctx context.Context, opts ...ConnectOption) error {
 			r.codec = serialCodec
 		}
 
+	case tUnix:
+		r.codec = codec.NewReconnectWrapperCodec(
+			r.opts.connectAddress,
+			func(path string) (codec.Codec, error) {
+				c, err := r.unixConnect(path, r.opts)
+				return c, errors.Trace(err)
+			}, r.opts.reconnectOpts)
+	case tExec:
+		if r.opts.enableReconnect {
+			// The command is restarted if it exits.
+			r.codec = codec.NewReconnectWrapperCodec(
+				r.opts.connectAddress,
+				func(cmdLine string) (codec.Codec, error) {
+					c, err := r.execConnect(cmdLine, r.opts)
+					return c, errors.Trace(err)
+				}, r.opts.reconnectOpts)
+		} else {
+			c, err := r.execConnect(r.opts.connectAddress, r.opts)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			r.codec = c
+		}
+	case tUDP:
+		// There is no connection to lose, lost datagrams are retransmitted.
+		c, err := r.udpConnect(r.opts.connectAddress, r.opts)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		r.codec = c
 	default:
 		return fmt.Errorf("unknown transport %q", r.opts.proto)
 	}
 
+	r.sendQueue.limit = r.opts.maxInFlight
+	if r.sendQueue.limit == 0 {
+		r.sendQueue.limit = r.opts.proto.defaultMaxInFlight()
+	}
+	r.frag = codec.Fragmenting(r.codec, r.opts.mtu)
+	r.codec = r.frag
+	if r.opts.sessionRecorder != nil {
+		r.codec = codec.RecordSession(r.codec, r.opts.sessionRecorder)
+	}
+
 	return nil
 }
 
 func (r *mgRPCImpl) Disconnect(ctx context.Context) error {
+	r.reqsLock.Lock()
 	r.closing = true
+	r.reqsLock.Unlock()
 	r.codec.Close()
 	return nil
 }
@@ -229,17 +426,22 @@ func (r *mgRPCImpl) recvLoop(ctx context.Context, c codec.Codec) {
 	glog.V(2).Infof("Started recv loop, codec: %v", c)
 	for {
 		f, err := c.Recv(ctx)
-		if r.closing {
-			glog.Infof("devConn is disconnected, breaking out of the recvLoop", err)
-			r.reqsLock.Lock()
-			for k, v := range r.reqs {
-				v.errChan <- err
-				delete(r.reqs, k)
-			}
-			r.reqsLock.Unlock()
+		r.reqsLock.Lock()
+		closing := r.closing
+		r.reqsLock.Unlock()
+		if closing {
+			glog.Infof("devConn is disconnected, breaking out of the recvLoop: %v", err)
+			r.failPendingRequests(err)
 			return
 		}
 		if err != nil {
+			select {
+			case <-c.CloseNotify():
+				glog.V(1).Infof("%v is closed, breaking out of the recvLoop: %v", c, err)
+				r.failPendingRequests(err)
+				return
+			default:
+			}
 			glog.Infof("error returned from codec Recv: %s, keep trying", err)
 			continue
 		}
@@ -252,18 +454,151 @@ func (r *mgRPCImpl) recvLoop(ctx context.Context, c codec.Codec) {
 			glog.V(2).Infof("Rec'd %s", s)
 		}
 
-		resp := frame.NewResponseFromFrame(f)
+		if f.IsRequest() {
+			go r.handleRequest(ctx, f)
+			continue
+		}
+
 		r.reqsLock.Lock()
-		if req, ok := r.reqs[resp.ID]; ok {
-			req.respChan <- resp
-			delete(r.reqs, resp.ID)
-		} else {
-			glog.Infof("ignoring unsolicited response: %v", resp)
+		req, ok := r.reqs[f.ID]
+		switch {
+		case !ok:
+			glog.Infof("ignoring unsolicited response: %v", frame.NewResponseFromFrame(f))
+		case r.opts.matchResponseSrc && f.Src != req.dst:
+			glog.Infof("ignoring response %d from %q, the request was sent to %q", f.ID, f.Src, req.dst)
+		case f.IsProgress():
+			select {
+			case req.progressChan <- f:
+			default:
+				glog.V(1).Infof("dropping progress of request %d", f.ID)
+			}
+		default:
+			req.respChan <- f
+			delete(r.reqs, f.ID)
 		}
 		r.reqsLock.Unlock()
 	}
 }
 
+// failPendingRequests completes all outstanding calls with the given error.
+func (r *mgRPCImpl) failPendingRequests(err error) {
+	if err == nil {
+		err = errors.Trace(io.EOF)
+	}
+	r.reqsLock.Lock()
+	defer r.reqsLock.Unlock()
+	for k, v := range r.reqs {
+		v.errChan <- err
+		delete(r.reqs, k)
+	}
+}
+
+func (r *mgRPCImpl) AddHandler(method string, handler Handler) {
+	r.handlers.add(method, handler)
+}
+
+func (r *mgRPCImpl) SetDefaultHandler(handler Handler) {
+	r.handlers.setDefault(handler)
+}
+
+func (r *mgRPCImpl) ConnectionInfo() codec.ConnectionInfo {
+	return r.codec.Info()
+}
+
+func (r *mgRPCImpl) MaxInFlight() int {
+	if r.sendQueue.limit < 0 {
+		return 0
+	}
+	return r.sendQueue.limit
+}
+
+// setFrameDeadline fills in the request's deadline and timeout from the
+// context, unless the command specifies them explicitly. Both are rounded up
+// to whole seconds.
+func setFrameDeadline(ctx context.Context, f *frame.Frame) {
+	deadline, ok := ctx.Deadline()
+	if !ok || f.Deadline != 0 || f.Timeout != 0 {
+		return
+	}
+	f.Deadline = deadline.Unix()
+	if deadline.Nanosecond() > 0 {
+		f.Deadline++
+	}
+	f.Timeout = int64((deadline.Sub(time.Now()) + time.Second - 1) / time.Second)
+	if f.Timeout < 1 {
+		f.Timeout = 1
+	}
+}
+
+// frameDeadline returns the time after which the result of the request
+// received at the given time is no longer relevant.
+func frameDeadline(f *frame.Frame, received time.Time) (time.Time, bool) {
+	var deadline time.Time
+	if f.Deadline != 0 {
+		deadline = time.Unix(f.Deadline, 0)
+	}
+	if f.Timeout != 0 {
+		d := received.Add(time.Duration(f.Timeout) * time.Second)
+		if deadline.IsZero() || d.Before(deadline) {
+			deadline = d
+		}
+	}
+	return deadline, !deadline.IsZero()
+}
+
+// handleRequest dispatches a request frame received from the peer to the
+// registered handler and sends the response back.
+func (r *mgRPCImpl) handleRequest(ctx context.Context, f *frame.Frame) {
+	if deadline, ok := frameDeadline(f, time.Now()); ok {
+		if !time.Now().Before(deadline) {
+			glog.Infof("dropping expired %s request %d from %q", f.Method, f.ID, f.Src)
+			return
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+	var t *rpcTrace
+	if r.opts.enableTracing {
+		t, ctx = newServeTrace(ctx, f)
+		defer t.finish()
+	}
+	cmd := frame.NewCommandFromFrame(f)
+	var resp *frame.Response
+	if h := r.handlers.get(f.Method); h != nil {
+		ctx = context.WithValue(ctx, servedRequestKey{}, &servedRequest{rpc: r, f: f})
+		resp = h(ctx, r, f.Src, cmd)
+		if resp == nil {
+			resp = &frame.Response{}
+		}
+	} else if f.Method == helloMethod {
+		resp = r.helloResponse()
+	} else {
+		resp = &frame.Response{
+			Status:    404,
+			StatusMsg: fmt.Sprintf("No handler for %s", f.Method),
+		}
+	}
+	resp.ID = f.ID
+	rf := frame.NewResponseFrame(r.responseSrc(f), f.Src, "", resp)
+	glog.V(2).Infof("responding to %s request %d: [%v]", f.Method, f.ID, resp)
+	if err := r.codec.Send(ctx, rf); err != nil {
+		glog.Errorf("failed to send response to %s request %d: %s", f.Method, f.ID, err)
+		t.error(err)
+		return
+	}
+	t.frameSent(rf)
+	t.response(resp)
+}
+
+// responseSrc returns the source of the frames sent in response to f.
+func (r *mgRPCImpl) responseSrc(f *frame.Frame) string {
+	if r.opts.localID != "" {
+		return r.opts.localID
+	}
+	return f.Dst
+}
+
 func (r *mgRPCImpl) Call(
 	ctx context.Context, dst string, cmd *frame.Command,
 ) (*frame.Response, error) {
@@ -271,43 +606,194 @@ func (r *mgRPCImpl) Call(
 		cmd.ID = frame.CreateCommandUID()
 	}
 
-	respChan := make(chan *frame.Response)
-	errChan := make(chan error)
+	var t *rpcTrace
+	if r.opts.enableTracing {
+		t = newCallTrace(ctx, dst, cmd)
+		defer t.finish()
+	}
 
-	r.reqsLock.Lock()
-	r.reqs[cmd.ID] = req{
-		respChan: respChan,
-		errChan:  errChan,
+	rq, err := r.sendRequest(ctx, dst, cmd, t, nil)
+	if err != nil {
+		t.error(err)
+		return nil, errors.Trace(err)
 	}
+	return r.waitResponse(ctx, cmd.ID, rq, t)
+}
+
+// CallBatch sends the commands in order, keeping as many of them in flight as
+// the connection allows (see MaxInFlight). Devices serve requests of a
+// connection in the order they arrive, but commands that depend on the
+// outcome of the previous ones should not be batched. Over HTTP, each command
+// is sent in a separate request, all at once, so the order is not guaranteed.
+// The results are in the order of commands; the returned error is set if any
+// of the commands has failed.
+func (r *mgRPCImpl) CallBatch(
+	ctx context.Context, dst string, cmds []*frame.Command,
+) ([]BatchResult, error) {
+	results := make([]BatchResult, len(cmds))
+	var wg sync.WaitGroup
+	// Each command is sent once the previous one has been.
+	prevSent := make(chan struct{})
+	close(prevSent)
+	for i, cmd := range cmds {
+		if cmd.ID == 0 {
+			cmd.ID = frame.CreateCommandUID()
+		}
+		sent := make(chan struct{})
+		wg.Add(1)
+		go func(res *BatchResult, cmd *frame.Command, prevSent <-chan struct{}, sent chan struct{}) {
+			defer wg.Done()
+			var t *rpcTrace
+			if r.opts.enableTracing {
+				t = newCallTrace(ctx, dst, cmd)
+				defer t.finish()
+			}
+			<-prevSent
+			rq, err := r.sendRequest(ctx, dst, cmd, t, func() { close(sent) })
+			if err != nil {
+				t.error(err)
+				res.Err = errors.Trace(err)
+				return
+			}
+			res.Response, res.Err = r.waitResponse(ctx, cmd.ID, rq, t)
+		}(&results[i], cmd, prevSent, sent)
+		prevSent = sent
+	}
+	wg.Wait()
+	return results, batchError(cmds, results)
+}
+
+// batchError fills in errors for the responses with non-zero status and
+// returns an error if any of the commands has failed.
+func batchError(cmds []*frame.Command, results []BatchResult) error {
+	var first error
+	numFailed := 0
+	for i := range results {
+		res := &results[i]
+		if res.Err == nil && res.Response.Status != 0 {
+			res.Err = errors.Trace(&ErrorResponse{Status: res.Response.Status, Msg: res.Response.StatusMsg})
+		}
+		if res.Err != nil {
+			if first == nil {
+				first = errors.Annotatef(res.Err, "%s", cmds[i].Cmd)
+			}
+			numFailed++
+		}
+	}
+	if numFailed == 0 {
+		return nil
+	}
+	return errors.Annotatef(first, "%d of %d commands failed", numFailed, len(cmds))
+}
+
+// CommandRecorder collects the commands made by generated service clients
+// instead of sending them, so that they can be sent with CallBatch. The
+// clients get empty responses, so only the commands which return no result
+// can be recorded this way.
+type CommandRecorder struct {
+	Commands []*frame.Command
+}
+
+// Call records the command. dst is ignored, it's given to CallBatch.
+func (cr *CommandRecorder) Call(
+	ctx context.Context, dst string, cmd *frame.Command,
+) (*frame.Response, error) {
+	cr.Commands = append(cr.Commands, cmd)
+	return &frame.Response{}, nil
+}
+
+// sendRequest waits for the codec to be able to take one more request and
+// sends it. Requests are sent in the order sendRequest is called. If sent is
+// not nil, it's called once the next request can be sent: when this one has
+// been, or has failed. Codecs that wait for the response in Send, like HTTP,
+// take requests independently, and sent is called before sending then.
+func (r *mgRPCImpl) sendRequest(
+	ctx context.Context, dst string, cmd *frame.Command, t *rpcTrace, sent func(),
+) (req, error) {
+	if sent == nil {
+		sent = func() {}
+	}
+	if err := r.sendQueue.acquire(ctx); err != nil {
+		sent()
+		return req{}, errors.Trace(err)
+	}
+	if r.codec.MaxNumFrames() >= 0 {
+		sent()
+		sent = func() {}
+	}
+
+	// Channels are buffered, so that recvLoop never blocks on a caller that
+	// has given up waiting.
+	rq := req{
+		dst:      dst,
+		respChan: make(chan *frame.Frame, 1),
+		errChan:  make(chan error, 1),
+	}
+	// HTTP can carry only one frame in response.
+	wantProgress := progressFromContext(ctx) != nil && r.codec.MaxNumFrames() < 0
+	if wantProgress {
+		rq.progressChan = make(chan *frame.Frame, progressQueueLen)
+	}
+	r.reqsLock.Lock()
+	r.reqs[cmd.ID] = rq
 	r.reqsLock.Unlock()
 	glog.V(2).Infof("created a request with id %d", cmd.ID)
 
-	f := frame.NewRequestFrame(r.opts.localID, dst, "", cmd)
-	if err := r.codec.Send(ctx, f); err != nil {
-		return nil, errors.Trace(err)
+	f := frame.NewRequestFrame(r.opts.localID, dst, r.opts.psk, cmd)
+	if r.opts.propagateDeadline {
+		setFrameDeadline(ctx, f)
 	}
-
-	select {
-	case resp := <-respChan:
-		glog.V(2).Infof("got response on request %d: [%v]", cmd.ID, resp)
-		return resp, nil
-	case err := <-errChan:
-		glog.V(2).Infof("got err on request %d: [%v]", cmd.ID, err)
-		return nil, errors.Trace(err)
-	case <-ctx.Done():
-		glog.V(2).Infof("context for the request %d is done: %v", cmd.ID, ctx.Err())
-		r.reqsLock.Lock()
-		delete(r.reqs, cmd.ID)
-		r.reqsLock.Unlock()
-		return nil, errors.Trace(ctx.Err())
+	f.WantProgress = wantProgress
+	err := r.codec.Send(ctx, f)
+	sent()
+	if err != nil {
+		r.completeRequest(cmd.ID)
+		return req{}, errors.Trace(err)
 	}
+	t.frameSent(f)
+	return rq, nil
 }
 
-func (r *mgRPCImpl) SendHello(dst string) {
-	hello := &frame.Command{
-		Cmd: "/v1/Hello",
+// waitResponse waits for the response to the request sent by sendRequest,
+// passing progress to the callback from the context in the meantime.
+func (r *mgRPCImpl) waitResponse(
+	ctx context.Context, id int64, rq req, t *rpcTrace,
+) (*frame.Response, error) {
+	progress := progressFromContext(ctx)
+	for {
+		select {
+		case pf := <-rq.progressChan:
+			glog.V(2).Infof("got progress on request %d: %s", id, pf.Progress)
+			progress(id, pf.Progress)
+		case rf := <-rq.respChan:
+			// Progress received before the response is delivered first.
+			for len(rq.progressChan) > 0 {
+				progress(id, (<-rq.progressChan).Progress)
+			}
+			r.completeRequest(id)
+			resp := frame.NewResponseFromFrame(rf)
+			glog.V(2).Infof("got response on request %d: [%v]", id, resp)
+			t.frameReceived(rf)
+			t.response(resp)
+			return resp, nil
+		case err := <-rq.errChan:
+			r.completeRequest(id)
+			glog.V(2).Infof("got err on request %d: [%v]", id, err)
+			t.error(err)
+			return nil, errors.Trace(err)
+		case <-ctx.Done():
+			r.completeRequest(id)
+			glog.V(2).Infof("context for the request %d is done: %v", id, ctx.Err())
+			t.error(ctx.Err())
+			return nil, errors.Trace(ctx.Err())
+		}
 	}
-	glog.V(2).Infof("Sending hello to %q", dst)
-	resp, err := r.Call(context.Background(), dst, hello)
-	glog.V(2).Infof("Hello response: %+v, %s", resp, err)
+}
+
+// completeRequest forgets the request and frees its slot in the send queue.
+func (r *mgRPCImpl) completeRequest(id int64) {
+	r.reqsLock.Lock()
+	delete(r.reqs, id)
+	r.reqsLock.Unlock()
+	r.sendQueue.release()
 }
@@ -0,0 +1,315 @@
+package mgrpc
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"cesanta.com/common/go/mgrpc/codec"
+	"cesanta.com/common/go/mgrpc/frame"
+	"cesanta.com/common/go/ourjson"
+	"cesanta.com/common/go/ourtrace"
+	"github.com/cesanta/errors"
+	"golang.org/x/net/trace"
+)
+
+func TestCallBatch(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, pipelined := range []bool{true, false} {
+		hc, dc := codec.Pipe()
+		dev, err := NewWithCodec(ctx, dc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer dev.Disconnect(ctx)
+		// Pipelined requests are all received before any of them is answered.
+		var arrived sync.WaitGroup
+		arrived.Add(3)
+		var lock sync.Mutex
+		var order []int64
+		dev.AddHandler("Put", func(ctx context.Context, rpc MgRPC, src string, cmd *frame.Command) *frame.Response {
+			lock.Lock()
+			order = append(order, cmd.ID)
+			lock.Unlock()
+			if pipelined {
+				arrived.Done()
+				arrived.Wait()
+			}
+			return nil
+		})
+		opts := []ConnectOption{MaxInFlight(1)}
+		if pipelined {
+			opts = nil
+		}
+		host, err := NewWithCodec(ctx, hc, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer host.Disconnect(ctx)
+
+		cmds := []*frame.Command{
+			{ID: 1, Cmd: "Put"},
+			{ID: 2, Cmd: "Nope"},
+			{ID: 3, Cmd: "Put"},
+			{ID: 4, Cmd: "Put"},
+		}
+		results, err := host.CallBatch(ctx, "", cmds)
+		if len(results) != len(cmds) {
+			t.Fatalf("pipelined %t: got %d results, want %d", pipelined, len(results), len(cmds))
+		}
+		for i, res := range results {
+			failed := cmds[i].Cmd == "Nope"
+			if (res.Err != nil) != failed || res.Response == nil || res.Response.ID != cmds[i].ID {
+				t.Errorf("pipelined %t: %s: got %+v", pipelined, cmds[i].Cmd, res)
+			}
+		}
+		if er, ok := errors.Cause(results[1].Err).(*ErrorResponse); err == nil || !ok || er.Status != 404 {
+			t.Errorf("pipelined %t: got %v, %v", pipelined, err, results[1].Err)
+		}
+		// One request at a time is served in order.
+		if !pipelined && !reflect.DeepEqual(order, []int64{1, 3, 4}) {
+			t.Errorf("got order %v", order)
+		}
+	}
+}
+
+func TestCommandRecorder(t *testing.T) {
+	ctx := context.Background()
+	var rec CommandRecorder
+	for _, method := range []string{"A", "B"} {
+		resp, err := rec.Call(ctx, "dev", &frame.Command{Cmd: method})
+		if err != nil || resp.Status != 0 {
+			t.Errorf("got %v, %v", resp, err)
+		}
+	}
+	if len(rec.Commands) != 2 || rec.Commands[0].Cmd != "A" || rec.Commands[1].Cmd != "B" {
+		t.Errorf("got %v", rec.Commands)
+	}
+}
+
+func TestCallProgress(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	hc, dc := codec.Pipe()
+	dev, err := NewWithCodec(ctx, dc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dev.Disconnect(ctx)
+	dev.AddHandler("Update", func(ctx context.Context, rpc MgRPC, src string, cmd *frame.Command) *frame.Response {
+		for i := 1; i <= 3; i++ {
+			if err := SendProgress(ctx, map[string]int{"done": i, "total": 3}); err != nil {
+				return &frame.Response{Status: 500, StatusMsg: err.Error()}
+			}
+		}
+		return nil
+	})
+	host, err := NewWithCodec(ctx, hc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer host.Disconnect(ctx)
+
+	// Without a callback, progress is not sent at all.
+	resp, err := host.Call(ctx, "", &frame.Command{Cmd: "Update"})
+	if err != nil || resp.Status != 0 {
+		t.Fatalf("got %v %v", resp, err)
+	}
+
+	var got []string
+	pctx := WithProgress(ctx, func(id int64, progress ourjson.RawMessage) {
+		if id != 123 {
+			t.Errorf("got progress of request %d", id)
+		}
+		b, _ := progress.MarshalJSON()
+		got = append(got, string(b))
+	})
+	resp, err = host.Call(pctx, "", &frame.Command{ID: 123, Cmd: "Update"})
+	if err != nil || resp.Status != 0 {
+		t.Fatalf("got %v %v", resp, err)
+	}
+	want := []string{`{"done":1,"total":3}`, `{"done":2,"total":3}`, `{"done":3,"total":3}`}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	if err := SendProgress(ctx, 1); err == nil {
+		t.Errorf("progress sent outside of a handler")
+	}
+}
+
+func TestMaxInFlight(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	hc, dc := codec.Pipe()
+	dev, err := NewWithCodec(ctx, dc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dev.Disconnect(ctx)
+	arrived := make(chan int64, 10)
+	proceed := make(chan struct{})
+	dev.AddHandler("Wait", func(ctx context.Context, rpc MgRPC, src string, cmd *frame.Command) *frame.Response {
+		arrived <- cmd.ID
+		<-proceed
+		return nil
+	})
+	host, err := NewWithCodec(ctx, hc, MaxInFlight(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer host.Disconnect(ctx)
+
+	errs := make(chan error, 3)
+	for id := int64(1); id <= 3; id++ {
+		go func(id int64) {
+			_, err := host.Call(ctx, "", &frame.Command{ID: id, Cmd: "Wait"})
+			errs <- err
+		}(id)
+		// Let the calls be queued in order.
+		time.Sleep(10 * time.Millisecond)
+	}
+	for i := 0; i < 2; i++ {
+		<-arrived
+	}
+	select {
+	case id := <-arrived:
+		t.Fatalf("request %d has been sent over the limit", id)
+	case <-time.After(50 * time.Millisecond):
+	}
+	proceed <- struct{}{}
+	if id := <-arrived; id != 3 {
+		t.Errorf("got request %d, want 3", id)
+	}
+	close(proceed)
+	for i := 0; i < 3; i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+
+	if _, err := NewWithCodec(ctx, hc, MaxInFlight(0)); err == nil {
+		t.Errorf("zero requests in flight are allowed")
+	}
+}
+
+func TestDeadlinePropagation(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, propagate := range []bool{true, false} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		host, err := New(ctx, "tcp://"+l.Addr().String(), PropagateDeadline(propagate))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer host.Disconnect(ctx)
+		conn, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		dc := codec.TCP(conn, codec.StreamOptions{UBJSON: true})
+		defer dc.Close()
+		go host.Call(ctx, "", &frame.Command{Cmd: "Test"})
+		f, err := dc.Recv(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		deadline, _ := ctx.Deadline()
+		if !propagate {
+			if f.Deadline != 0 || f.Timeout != 0 {
+				t.Errorf("got deadline %d, timeout %d", f.Deadline, f.Timeout)
+			}
+			continue
+		}
+		// Both are rounded up to whole seconds.
+		if f.Deadline < deadline.Unix() || f.Deadline > deadline.Unix()+1 || f.Timeout < 1 || f.Timeout > 5 {
+			t.Errorf("got deadline %d, timeout %d, want %d, 5", f.Deadline, f.Timeout, deadline.Unix())
+		}
+	}
+
+	// The handler gets the deadline from the frame, expired requests are not
+	// served.
+	// Handlers' contexts are derived from this one, it must not have a deadline.
+	s, _ := listenEcho(context.Background(), t, "tcp://127.0.0.1:0")
+	defer s.Close()
+	deadlines := make(chan time.Time, 2)
+	s.AddHandler("Test", func(ctx context.Context, rpc MgRPC, src string, cmd *frame.Command) *frame.Response {
+		d, _ := ctx.Deadline()
+		deadlines <- d
+		return nil
+	})
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	hc := codec.TCP(conn, codec.StreamOptions{Client: true, UBJSON: true})
+	defer hc.Close()
+	now := time.Now()
+	for _, f := range []*frame.Frame{
+		{ID: 1, Method: "Test", Deadline: now.Unix() - 10},
+		{ID: 2, Method: "Test", Timeout: 30},
+	} {
+		if err := hc.Send(ctx, f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f, err := hc.Recv(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.ID != 2 {
+		t.Errorf("got response %s, want 2", f)
+	}
+	if d := <-deadlines; d.Before(now.Add(29*time.Second)) || d.After(now.Add(31*time.Second)) {
+		t.Errorf("got deadline %s, want 30s from %s", d, now)
+	}
+	if len(deadlines) != 0 {
+		t.Errorf("expired request has been served")
+	}
+}
+
+func TestTracing(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	s, addr := listenEcho(ctx, t, "tcp://127.0.0.1:0", ListenerTracing(true))
+	defer s.Close()
+	var sent *frame.Trace
+	var served *ourtrace.Trace
+	s.AddHandler("Test", func(ctx context.Context, rpc MgRPC, src string, cmd *frame.Command) *frame.Response {
+		sent = cmd.Trace
+		served = nil
+		if tr, ok := trace.FromContext(ctx); ok {
+			served, _ = tr.(*ourtrace.Trace)
+		}
+		return nil
+	})
+	for _, enable := range []bool{true, false} {
+		host, err := New(ctx, addr, Tracing(enable))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer host.Disconnect(ctx)
+		if _, err := host.Call(ctx, "", &frame.Command{Cmd: "Test"}); err != nil {
+			t.Fatal(err)
+		}
+		if !enable {
+			if sent != nil {
+				t.Errorf("got trace %+v with tracing disabled", sent)
+			}
+			continue
+		}
+		// The request is served in a child span of the call.
+		if sent == nil || sent.TraceID == 0 || served == nil ||
+			served.TraceID != uint64(sent.TraceID) || served.ParentSpanID != uint64(sent.SpanID) {
+			t.Errorf("got trace %+v, served in %+v", sent, served)
+		}
+	}
+}
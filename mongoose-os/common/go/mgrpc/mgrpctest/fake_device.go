@@ -0,0 +1,206 @@
+// Package mgrpctest provides utilities for testing code that talks to devices
+// over mgrpc, without real hardware.
+package mgrpctest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"cesanta.com/common/go/mgrpc"
+	"cesanta.com/common/go/mgrpc/codec"
+	"cesanta.com/common/go/mgrpc/frame"
+	"cesanta.com/common/go/ourjson"
+	"github.com/cesanta/errors"
+)
+
+// Reply is a canned response of a FakeDevice.
+type Reply struct {
+	// Result is marshaled to JSON and sent as the response payload, unless
+	// it's nil.
+	Result interface{}
+	// Non-zero Status makes the reply an error.
+	Status    int
+	StatusMsg string
+	// Delay postpones the reply, but not past the deadline of the request.
+	Delay time.Duration
+	// Progress is reported before the reply, if the caller has asked for it.
+	Progress []interface{}
+}
+
+// FakeDevice serves RPC requests the way a device would. Requests are served
+// with canned replies set up with Script, or with handlers added with Handle.
+// Requests to other methods fail with 404, like they do on a device.
+// Requests that arrive over one connection are served one at a time, in order,
+// also like on a device. Hosts talk to the device over in-memory pipes, see
+// Dial.
+type FakeDevice struct {
+	ID string
+
+	lock     sync.Mutex
+	handlers map[string]mgrpc.Handler
+	scripts  map[string][]Reply
+	calls    []*frame.Command
+	conns    []codec.Codec
+}
+
+// NewFakeDevice creates a device with the given ID and no handlers.
+func NewFakeDevice(id string) *FakeDevice {
+	return &FakeDevice{
+		ID:       id,
+		handlers: make(map[string]mgrpc.Handler),
+		scripts:  make(map[string][]Reply),
+	}
+}
+
+// Handle makes the device serve requests to the method with h.
+func (d *FakeDevice) Handle(method string, h mgrpc.Handler) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.handlers[method] = h
+}
+
+// Script makes the device answer requests to the method with the given
+// replies, one per request, in order. The last reply is repeated once the
+// others are used up.
+func (d *FakeDevice) Script(method string, replies ...Reply) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.scripts[method] = replies
+}
+
+// Calls returns the requests received by the device so far, in the order they
+// have arrived.
+func (d *FakeDevice) Calls() []*frame.Command {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return append([]*frame.Command(nil), d.calls...)
+}
+
+// Dial creates a new connection to the device and returns the host's end of
+// it. Together with DropConnections, it allows testing reconnects with
+// codec.NewReconnectWrapperCodec.
+func (d *FakeDevice) Dial(ctx context.Context) (codec.Codec, error) {
+	hc, dc := codec.Pipe()
+	rpc, err := mgrpc.NewWithCodec(ctx, &inOrderCodec{Codec: dc, serving: make(chan struct{}, 1)}, mgrpc.LocalID(d.ID))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	rpc.SetDefaultHandler(d.serve)
+	// Hello goes to the default handler only if there is no handler for it,
+	// and it has to be scripted like the other methods.
+	rpc.AddHandler("/v1/Hello", d.serve)
+	d.lock.Lock()
+	d.conns = append(d.conns, dc)
+	d.lock.Unlock()
+	return hc, nil
+}
+
+// Connect creates a new connection to the device and returns an RPC instance
+// on the host's end of it.
+func (d *FakeDevice) Connect(ctx context.Context, opts ...mgrpc.ConnectOption) (mgrpc.MgRPC, error) {
+	c, err := d.Dial(ctx)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	rpc, err := mgrpc.NewWithCodec(ctx, c, opts...)
+	return rpc, errors.Trace(err)
+}
+
+// DropConnections closes all the connections to the device, as if it was
+// rebooted or unplugged.
+func (d *FakeDevice) DropConnections() {
+	d.lock.Lock()
+	conns := d.conns
+	d.conns = nil
+	d.lock.Unlock()
+	for _, c := range conns {
+		c.Close()
+	}
+}
+
+func (d *FakeDevice) serve(
+	ctx context.Context, rpc mgrpc.MgRPC, src string, cmd *frame.Command,
+) *frame.Response {
+	d.lock.Lock()
+	d.calls = append(d.calls, cmd)
+	h := d.handlers[cmd.Cmd]
+	var reply *Reply
+	if replies := d.scripts[cmd.Cmd]; len(replies) > 0 {
+		reply = &replies[0]
+		if len(replies) > 1 {
+			d.scripts[cmd.Cmd] = replies[1:]
+		}
+	}
+	d.lock.Unlock()
+
+	switch {
+	case reply != nil:
+		return d.reply(ctx, reply)
+	case h != nil:
+		return h(ctx, rpc, src, cmd)
+	default:
+		return &frame.Response{Status: 404, StatusMsg: fmt.Sprintf("No handler for %s", cmd.Cmd)}
+	}
+}
+
+func (d *FakeDevice) reply(ctx context.Context, reply *Reply) *frame.Response {
+	for _, p := range reply.Progress {
+		if err := mgrpc.SendProgress(ctx, p); err != nil {
+			return &frame.Response{Status: 500, StatusMsg: err.Error()}
+		}
+	}
+	if reply.Delay > 0 {
+		select {
+		case <-time.After(reply.Delay):
+		case <-ctx.Done():
+		}
+	}
+	resp := &frame.Response{Status: reply.Status, StatusMsg: reply.StatusMsg}
+	if reply.Result != nil {
+		b, err := json.Marshal(reply.Result)
+		if err != nil {
+			return &frame.Response{Status: 500, StatusMsg: err.Error()}
+		}
+		resp.Response = ourjson.RawJSON(b)
+	}
+	return resp
+}
+
+// inOrderCodec makes the requests served one at a time: the next request is
+// not received until the response to the previous one has been sent.
+type inOrderCodec struct {
+	codec.Codec
+	serving chan struct{}
+}
+
+func (c *inOrderCodec) Recv(ctx context.Context) (*frame.Frame, error) {
+	f, err := c.Codec.Recv(ctx)
+	if err != nil || !f.IsRequest() {
+		return f, err
+	}
+	select {
+	case c.serving <- struct{}{}:
+		return f, nil
+	case <-c.CloseNotify():
+		return nil, errors.Trace(io.EOF)
+	case <-ctx.Done():
+		return nil, errors.Trace(ctx.Err())
+	}
+}
+
+func (c *inOrderCodec) Send(ctx context.Context, f *frame.Frame) error {
+	if err := c.Codec.Send(ctx, f); err != nil {
+		return errors.Trace(err)
+	}
+	if !f.IsRequest() && !f.IsProgress() {
+		select {
+		case <-c.serving:
+		default:
+		}
+	}
+	return nil
+}
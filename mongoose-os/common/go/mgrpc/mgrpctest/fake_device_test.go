@@ -0,0 +1,112 @@
+package mgrpctest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"cesanta.com/common/go/mgrpc"
+	"cesanta.com/common/go/mgrpc/codec"
+	"cesanta.com/common/go/mgrpc/frame"
+	"cesanta.com/common/go/ourjson"
+)
+
+func TestFakeDevice(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	d := NewFakeDevice("dev1")
+	d.Script("Sys.GetInfo",
+		Reply{Result: map[string]string{"fw_version": "1.0"}},
+		Reply{Status: 500, StatusMsg: "busy"},
+	)
+	d.Handle("Echo", func(ctx context.Context, rpc mgrpc.MgRPC, src string, cmd *frame.Command) *frame.Response {
+		return &frame.Response{Response: cmd.Args}
+	})
+	rpc, err := d.Connect(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rpc.Disconnect(ctx)
+
+	cases := []struct {
+		cmd        string
+		args       string
+		wantStatus int
+		wantResp   string
+	}{
+		{"Sys.GetInfo", "", 0, `{"fw_version":"1.0"}`},
+		{"Sys.GetInfo", "", 500, ""},
+		{"Sys.GetInfo", "", 500, ""},
+		{"Echo", `{"a":1}`, 0, `{"a":1}`},
+		{"Nope", "", 404, ""},
+	}
+	for i, c := range cases {
+		cmd := &frame.Command{Cmd: c.cmd}
+		if c.args != "" {
+			cmd.Args = ourjson.RawJSON([]byte(c.args))
+		}
+		resp, err := rpc.Call(ctx, "", cmd)
+		if err != nil {
+			t.Fatalf("%d: %s: %s", i, c.cmd, err)
+		}
+		if resp.Status != c.wantStatus {
+			t.Errorf("%d: %s: status %d, want %d", i, c.cmd, resp.Status, c.wantStatus)
+		}
+		if c.wantResp != "" {
+			got, err := resp.Response.MarshalJSON()
+			if err != nil || string(got) != c.wantResp {
+				t.Errorf("%d: %s: response %s %v, want %s", i, c.cmd, got, err, c.wantResp)
+			}
+		}
+	}
+	if got := len(d.Calls()); got != len(cases) {
+		t.Errorf("device got %d calls, want %d", got, len(cases))
+	}
+}
+
+func TestFakeDeviceReconnect(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	d := NewFakeDevice("dev1")
+	d.Script("Sys.Reboot", Reply{})
+	c := codec.NewReconnectWrapperCodec("dev1", func(addr string) (codec.Codec, error) {
+		return d.Dial(ctx)
+	}, codec.ReconnectOptions{InitialBackoff: time.Millisecond})
+	rpc, err := mgrpc.NewWithCodec(ctx, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rpc.Disconnect(ctx)
+	for i := 0; i < 3; i++ {
+		resp, err := rpc.Call(ctx, "", &frame.Command{Cmd: "Sys.Reboot"})
+		if err != nil || resp.Status != 0 {
+			t.Fatalf("%d: got %v %v", i, resp, err)
+		}
+		d.DropConnections()
+	}
+}
+
+func TestMatchResponseSrc(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	d := NewFakeDevice("dev1")
+	d.Script("Sys.GetInfo", Reply{Result: true})
+	rpc, err := d.Connect(ctx, mgrpc.MatchResponseSrc(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rpc.Disconnect(ctx)
+
+	if _, err := rpc.Call(ctx, "dev1", &frame.Command{Cmd: "Sys.GetInfo"}); err != nil {
+		t.Fatal(err)
+	}
+	// The device answers anyway, but the response comes from the wrong node.
+	cctx, ccancel := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer ccancel()
+	if resp, err := rpc.Call(cctx, "dev2", &frame.Command{Cmd: "Sys.GetInfo"}); err == nil {
+		t.Errorf("got response %v from %s, want none", resp, d.ID)
+	}
+	if n := len(d.Calls()); n != 2 {
+		t.Errorf("device got %d calls, want 2", n)
+	}
+}
@@ -0,0 +1,66 @@
+package mgrpc
+
+import (
+	"context"
+	"encoding/json"
+
+	"cesanta.com/common/go/mgrpc/frame"
+	"cesanta.com/common/go/ourjson"
+	"github.com/cesanta/errors"
+	"github.com/golang/glog"
+)
+
+// Long-running requests can report their progress before responding. The
+// caller asks for it with WithProgress, which marks the requests made with the
+// context, and the handler reports it with SendProgress. Peers that haven't
+// asked for progress never get it, so they are not confused by more than one
+// frame with the same ID.
+
+// How many progress frames of a request may be waiting for the caller, newer
+// ones are dropped.
+const progressQueueLen = 16
+
+// ProgressFunc receives the progress of the request with the given ID, as sent
+// by the peer. It's called from the goroutine that has made the call.
+type ProgressFunc func(id int64, progress ourjson.RawMessage)
+
+type progressKey struct{}
+
+// WithProgress returns a context that makes the calls with it ask the peer for
+// progress and pass it to f. Progress is not available over HTTP.
+func WithProgress(ctx context.Context, f ProgressFunc) context.Context {
+	return context.WithValue(ctx, progressKey{}, f)
+}
+
+func progressFromContext(ctx context.Context) ProgressFunc {
+	f, _ := ctx.Value(progressKey{}).(ProgressFunc)
+	return f
+}
+
+// servedRequest is the request a handler has been called for.
+type servedRequest struct {
+	rpc *mgRPCImpl
+	f   *frame.Frame
+}
+
+type servedRequestKey struct{}
+
+// SendProgress reports progress of the request that is being served. ctx must
+// be the one passed to the handler. progress is marshaled to JSON; it's
+// dropped if the caller hasn't asked for progress.
+func SendProgress(ctx context.Context, progress interface{}) error {
+	sr, ok := ctx.Value(servedRequestKey{}).(*servedRequest)
+	if !ok {
+		return errors.Errorf("no request is being served")
+	}
+	if !sr.f.WantProgress || sr.f.ID == 0 {
+		return nil
+	}
+	b, err := json.Marshal(progress)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	pf := frame.NewProgressFrame(sr.rpc.responseSrc(sr.f), sr.f.Src, "", sr.f.ID, ourjson.RawJSON(b))
+	glog.V(2).Infof("reporting progress of %s request %d: %s", sr.f.Method, sr.f.ID, b)
+	return errors.Trace(sr.rpc.codec.Send(ctx, pf))
+}
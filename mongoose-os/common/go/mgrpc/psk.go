@@ -0,0 +1,53 @@
+package mgrpc
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+
+	"cesanta.com/common/go/mgrpc/codec"
+	"cesanta.com/common/go/mgrpc/frame"
+	"github.com/cesanta/errors"
+	"github.com/golang/glog"
+)
+
+// pskCodec wraps a connection accepted by a Server and rejects incoming
+// requests, and fragments of requests, which don't carry the expected
+// pre-shared key. Responses are passed through, they can only complete calls
+// made by this side.
+type pskCodec struct {
+	codec.Codec
+	psk string
+}
+
+func newPSKCodec(c codec.Codec, psk string) codec.Codec {
+	return &pskCodec{Codec: c, psk: psk}
+}
+
+func (c *pskCodec) String() string {
+	return fmt.Sprintf("%v", c.Codec)
+}
+
+func (c *pskCodec) Recv(ctx context.Context) (*frame.Frame, error) {
+	for {
+		f, err := c.Codec.Recv(ctx)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		isRequest := f.IsRequest() || (f.Frag != nil && f.Frag.Request)
+		if !isRequest || subtle.ConstantTimeCompare([]byte(f.Key), []byte(c.psk)) == 1 {
+			return f, nil
+		}
+		if f.Frag != nil && f.Frag.Index != 0 {
+			// Fragmented requests are answered once.
+			continue
+		}
+		glog.Infof("%v: rejecting %s request %d from %q: invalid key", c.Codec, f.Method, f.ID, f.Src)
+		rf := frame.NewResponseFrame(f.Dst, f.Src, "", &frame.Response{
+			ID: f.ID, Status: 403, StatusMsg: "unauthorized",
+		})
+		if err := c.Codec.Send(ctx, rf); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package mgrpc
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"cesanta.com/common/go/mgrpc/codec"
+	"cesanta.com/common/go/mgrpc/frame"
+	"github.com/golang/glog"
+)
+
+// Router relays frames between connected peers by destination ID.
+// Routes are learned from the source ID of frames received from peers, and
+// can also be added explicitly. Frames for unknown destinations are sent over
+// the default route, if there is one.
+//
+// Peers are expected to use distinct IDs.
+//
+// Router.AddPeer can be used as a Server's CodecHandler, so that accepted
+// connections are relayed as well.
+type Router struct {
+	lock         sync.Mutex
+	peers        map[codec.Codec]*routerPeer
+	routes       map[string]*routerPeer
+	defaultRoute *routerPeer
+}
+
+type routerPeer struct {
+	c codec.Codec
+	// IDs of requests received from this peer which haven't been responded to.
+	pending map[int64]bool
+	// Set once the peer won't send any more frames.
+	recvDone bool
+}
+
+func (p *routerPeer) String() string {
+	return fmt.Sprintf("%v", p.c)
+}
+
+// NewRouter creates a router with no peers.
+func NewRouter() *Router {
+	return &Router{
+		peers:  make(map[codec.Codec]*routerPeer),
+		routes: make(map[string]*routerPeer),
+	}
+}
+
+// AddPeer starts relaying frames received from c, and makes c available as a
+// route. Routes to c are removed once c is closed.
+func (r *Router) AddPeer(ctx context.Context, c codec.Codec) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.addPeerLocked(ctx, c)
+}
+
+func (r *Router) addPeerLocked(ctx context.Context, c codec.Codec) *routerPeer {
+	p := r.peers[c]
+	if p == nil {
+		p = &routerPeer{c: c, pending: make(map[int64]bool)}
+		r.peers[c] = p
+		go r.relay(ctx, c)
+	}
+	return p
+}
+
+// AddRoute makes frames destined to id go to c. c is added as a peer if
+// it hasn't been yet.
+func (r *Router) AddRoute(ctx context.Context, id string, c codec.Codec) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.routes[id] = r.addPeerLocked(ctx, c)
+}
+
+// SetDefaultRoute makes frames with no known route go to c. c is added as
+// a peer if it hasn't been yet. Passing nil removes the default route.
+func (r *Router) SetDefaultRoute(ctx context.Context, c codec.Codec) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if c == nil {
+		r.defaultRoute = nil
+		return
+	}
+	r.defaultRoute = r.addPeerLocked(ctx, c)
+}
+
+// Routes returns the current routing table as a map from ID to peer address.
+func (r *Router) Routes() map[string]string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	res := make(map[string]string)
+	for id, p := range r.routes {
+		res[id] = p.c.Info().RemoteAddr
+	}
+	return res
+}
+
+func (r *Router) relay(ctx context.Context, c codec.Codec) {
+	glog.V(1).Infof("Router: relaying frames from %v", c)
+	defer r.removePeer(c)
+	for {
+		f, err := c.Recv(ctx)
+		if err != nil {
+			select {
+			case <-c.CloseNotify():
+				glog.V(1).Infof("Router: %v is closed: %v", c, err)
+				return
+			default:
+			}
+			if codec.IsEOF(err) {
+				// Some codecs, like inbound HTTP, only deliver a single frame, but
+				// must be kept until the response is sent.
+				r.lock.Lock()
+				p := r.peers[c]
+				p.recvDone = true
+				if len(p.pending) == 0 {
+					c.Close()
+				}
+				r.lock.Unlock()
+				<-c.CloseNotify()
+				return
+			}
+			glog.Infof("Router: error returned from %v Recv: %s, keep trying", c, err)
+			continue
+		}
+		glog.V(2).Infof("Router: rec'd from %v: %s", c, f)
+		r.route(ctx, c, f)
+	}
+}
+
+// route sends the frame received from the peer src to its destination.
+func (r *Router) route(ctx context.Context, src codec.Codec, f *frame.Frame) {
+	r.lock.Lock()
+	sp := r.peers[src]
+	if f.Src != "" && r.routes[f.Src] != sp {
+		glog.V(1).Infof("Router: %q is at %v", f.Src, src)
+		r.routes[f.Src] = sp
+	}
+	// Progress is followed by the response, which is what the peer waits for.
+	isRequest, isResponse := f.IsRequest(), !f.IsRequest() && !f.IsProgress()
+	if f.Frag != nil {
+		// Fragments are relayed as they are, a fragmented response has been
+		// sent once its last fragment has.
+		isRequest = f.Frag.Request
+		isResponse = !f.Frag.Request && f.Frag.Index == f.Frag.Count-1
+	}
+	if isRequest {
+		sp.pending[f.ID] = true
+	}
+	dp := r.routes[f.Dst]
+	if dp == nil {
+		dp = r.defaultRoute
+	}
+	r.lock.Unlock()
+
+	if dp == nil || dp == sp {
+		glog.Infof("Router: no route to %q for %s", f.Dst, f)
+		if isRequest {
+			r.reply(ctx, sp, f, 404, fmt.Sprintf("no route to %q", f.Dst))
+		}
+		return
+	}
+	if err := dp.c.Send(ctx, f); err != nil {
+		glog.Errorf("Router: failed to send to %v: %s", dp, err)
+		if isRequest {
+			r.reply(ctx, sp, f, 503, fmt.Sprintf("failed to send to %q: %s", f.Dst, err))
+		}
+		return
+	}
+	if isResponse {
+		r.responseSent(dp, f.ID)
+	}
+}
+
+// reply sends an error response to the request f back to the peer it came
+// from.
+func (r *Router) reply(ctx context.Context, p *routerPeer, f *frame.Frame, status int, msg string) {
+	rf := frame.NewResponseFrame(f.Dst, f.Src, "", &frame.Response{
+		ID: f.ID, Status: status, StatusMsg: msg,
+	})
+	if err := p.c.Send(ctx, rf); err != nil {
+		glog.Errorf("Router: failed to send to %v: %s", p, err)
+	}
+	r.responseSent(p, f.ID)
+}
+
+// responseSent marks the request from the peer as responded to, and closes
+// the peer if it has nothing more to send or receive.
+func (r *Router) responseSent(p *routerPeer, id int64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(p.pending, id)
+	if p.recvDone && len(p.pending) == 0 {
+		p.c.Close()
+	}
+}
+
+func (r *Router) removePeer(c codec.Codec) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	p := r.peers[c]
+	for id, rp := range r.routes {
+		if rp == p {
+			delete(r.routes, id)
+		}
+	}
+	if r.defaultRoute == p {
+		r.defaultRoute = nil
+	}
+	delete(r.peers, c)
+	glog.V(1).Infof("Router: removed %v", c)
+}
@@ -0,0 +1,210 @@
+package mgrpc
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"cesanta.com/common/go/mgrpc/codec"
+	"cesanta.com/common/go/mgrpc/frame"
+	"cesanta.com/common/go/ourjson"
+)
+
+// newRouterPeer connects a new MgRPC instance to the router over TCP and
+// returns it along with the router's end of the connection.
+func newRouterPeer(ctx context.Context, t *testing.T, r *Router, id string) (MgRPC, codec.Codec) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	rpc, err := New(ctx, "tcp://"+l.Addr().String(), LocalID(id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc := codec.TCP(conn, codec.StreamOptions{UBJSON: true})
+	r.AddPeer(ctx, rc)
+	return rpc, rc
+}
+
+// addRouterDevice connects a device that responds to Whoami with its ID.
+func addRouterDevice(ctx context.Context, t *testing.T, r *Router, id string) (MgRPC, codec.Codec) {
+	dev, rc := newRouterPeer(ctx, t, r, id)
+	dev.AddHandler("Whoami", func(ctx context.Context, rpc MgRPC, src string, cmd *frame.Command) *frame.Response {
+		return &frame.Response{Response: ourjson.DelayMarshaling(map[string]string{"id": id, "src": src})}
+	})
+	r.AddRoute(ctx, id, rc)
+	return dev, rc
+}
+
+func whoami(ctx context.Context, rpc MgRPC, dst string) (string, error) {
+	resp, err := rpc.Call(ctx, dst, &frame.Command{Cmd: "Whoami"})
+	if err != nil {
+		return "", err
+	}
+	if resp.Status != 0 {
+		return "", fmt.Errorf("%d %s", resp.Status, resp.StatusMsg)
+	}
+	var res map[string]string
+	if err := resp.Response.UnmarshalInto(&res); err != nil {
+		return "", err
+	}
+	return res["id"] + " for " + res["src"], nil
+}
+
+func TestRouterForwarding(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	r := NewRouter()
+	dev1, _ := addRouterDevice(ctx, t, r, "dev1")
+	defer dev1.Disconnect(ctx)
+	dev2, _ := addRouterDevice(ctx, t, r, "dev2")
+	defer dev2.Disconnect(ctx)
+
+	// Responses go back to the peer the request came from, even when requests
+	// from different peers are in flight at the same time.
+	var wg sync.WaitGroup
+	for _, host := range []string{"host1", "host2"} {
+		rpc, _ := newRouterPeer(ctx, t, r, host)
+		defer rpc.Disconnect(ctx)
+		for _, dst := range []string{"dev1", "dev2"} {
+			wg.Add(1)
+			go func(host, dst string) {
+				defer wg.Done()
+				for i := 0; i < 5; i++ {
+					got, err := whoami(ctx, rpc, dst)
+					if want := dst + " for " + host; err != nil || got != want {
+						t.Errorf("%s -> %s: got %q, %v, want %q", host, dst, got, err, want)
+						return
+					}
+				}
+			}(host, dst)
+		}
+	}
+	wg.Wait()
+
+	routes := r.Routes()
+	for _, id := range []string{"dev1", "dev2", "host1", "host2"} {
+		if _, ok := routes[id]; !ok {
+			t.Errorf("no route to %q in %v", id, routes)
+		}
+	}
+
+	host, _ := newRouterPeer(ctx, t, r, "host3")
+	defer host.Disconnect(ctx)
+	if got, err := whoami(ctx, host, "dev3"); err == nil {
+		t.Errorf("request to an unknown peer got %q", got)
+	}
+	// Unknown destinations go over the default route.
+	dev3, dc := newRouterPeer(ctx, t, r, "dev3")
+	defer dev3.Disconnect(ctx)
+	dev3.AddHandler("Whoami", func(ctx context.Context, rpc MgRPC, src string, cmd *frame.Command) *frame.Response {
+		return &frame.Response{Response: ourjson.DelayMarshaling(map[string]string{"id": "default", "src": src})}
+	})
+	r.SetDefaultRoute(ctx, dc)
+	if got, err := whoami(ctx, host, "dev4"); err != nil || got != "default for host3" {
+		t.Errorf("got %q, %v", got, err)
+	}
+}
+
+func TestRouterPeerDisconnect(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	r := NewRouter()
+	dev, dc := addRouterDevice(ctx, t, r, "dev")
+	r.SetDefaultRoute(ctx, dc)
+	host, _ := newRouterPeer(ctx, t, r, "host")
+	defer host.Disconnect(ctx)
+	if _, err := whoami(ctx, host, "dev"); err != nil {
+		t.Fatal(err)
+	}
+
+	dev.Disconnect(ctx)
+	for {
+		if _, ok := r.Routes()["dev"]; !ok {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatalf("route to the disconnected peer is still there: %v", r.Routes())
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	// Neither the route nor the default route are there anymore.
+	if got, err := whoami(ctx, host, "dev"); err == nil {
+		t.Errorf("request to a disconnected peer got %q", got)
+	}
+	r.lock.Lock()
+	if len(r.peers) != 1 || r.defaultRoute != nil {
+		t.Errorf("got peers %v, default route %v", r.peers, r.defaultRoute)
+	}
+	r.lock.Unlock()
+}
+
+// singleShotCodec delivers one frame and then reports EOF while staying open,
+// like inbound HTTP.
+type singleShotCodec struct {
+	codec.Codec
+	lock sync.Mutex
+	done bool
+}
+
+func (c *singleShotCodec) Recv(ctx context.Context) (*frame.Frame, error) {
+	c.lock.Lock()
+	done := c.done
+	c.done = true
+	c.lock.Unlock()
+	if done {
+		return nil, io.EOF
+	}
+	return c.Codec.Recv(ctx)
+}
+
+func TestRouterProgress(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	r := NewRouter()
+	dev, _ := addRouterDevice(ctx, t, r, "dev")
+	defer dev.Disconnect(ctx)
+	dev.AddHandler("Update", func(ctx context.Context, rpc MgRPC, src string, cmd *frame.Command) *frame.Response {
+		for i := 1; i <= 2; i++ {
+			if err := SendProgress(ctx, i); err != nil {
+				return &frame.Response{Status: 500, StatusMsg: err.Error()}
+			}
+		}
+		return nil
+	})
+
+	// The peer is closed once it has its response, but not after progress.
+	hc, rc := codec.Pipe()
+	host, err := NewWithCodec(ctx, hc, LocalID("host"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer host.Disconnect(ctx)
+	r.AddPeer(ctx, &singleShotCodec{Codec: rc})
+	numProgress := 0
+	pctx := WithProgress(ctx, func(id int64, progress ourjson.RawMessage) {
+		numProgress++
+	})
+	resp, err := host.Call(pctx, "dev", &frame.Command{Cmd: "Update"})
+	if err != nil || resp.Status != 0 {
+		t.Fatalf("got %v, %v", resp, err)
+	}
+	if numProgress != 2 {
+		t.Errorf("got %d progress frames, want 2", numProgress)
+	}
+	select {
+	case <-hc.CloseNotify():
+	case <-ctx.Done():
+		t.Errorf("peer has not been closed after the response")
+	}
+}
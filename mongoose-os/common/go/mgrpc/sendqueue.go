@@ -0,0 +1,80 @@
+package mgrpc
+
+import (
+	"context"
+	"sync"
+
+	"github.com/cesanta/errors"
+)
+
+// sendQueue keeps the number of requests waiting for a response within the
+// limit, which is how many requests the peer can take before it has responded
+// to the earlier ones. Callers that have to wait are let through in the order
+// they arrived. The zero value is an empty queue with no limit.
+type sendQueue struct {
+	// Zero or negative means no limit.
+	limit int
+
+	lock     sync.Mutex
+	inFlight int
+	// Callers waiting for a slot, oldest first. The channel is closed when
+	// the slot is handed over.
+	waiters []chan struct{}
+}
+
+func (q *sendQueue) hasRoomLocked() bool {
+	return q.limit <= 0 || q.inFlight < q.limit
+}
+
+// acquire waits until a request can be sent, or until ctx is done. Successful
+// acquire must be followed by release once the request is completed.
+func (q *sendQueue) acquire(ctx context.Context) error {
+	q.lock.Lock()
+	if len(q.waiters) == 0 && q.hasRoomLocked() {
+		q.inFlight++
+		q.lock.Unlock()
+		return nil
+	}
+	ch := make(chan struct{})
+	q.waiters = append(q.waiters, ch)
+	q.lock.Unlock()
+
+	select {
+	case <-ch:
+		return nil
+	case <-ctx.Done():
+		q.lock.Lock()
+		defer q.lock.Unlock()
+		select {
+		case <-ch:
+			// The slot was handed over to us just now, pass it on.
+			q.inFlight--
+			q.wakeLocked()
+		default:
+			for i, w := range q.waiters {
+				if w == ch {
+					q.waiters = append(q.waiters[:i], q.waiters[i+1:]...)
+					break
+				}
+			}
+		}
+		return errors.Trace(ctx.Err())
+	}
+}
+
+// release frees the slot taken by acquire and lets the next waiting caller
+// through.
+func (q *sendQueue) release() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.inFlight--
+	q.wakeLocked()
+}
+
+func (q *sendQueue) wakeLocked() {
+	for len(q.waiters) > 0 && q.hasRoomLocked() {
+		close(q.waiters[0])
+		q.waiters = q.waiters[1:]
+		q.inFlight++
+	}
+}
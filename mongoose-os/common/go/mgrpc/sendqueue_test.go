@@ -0,0 +1,76 @@
+package mgrpc
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// acquired calls acquire in the background and returns a channel that gets
+// its result.
+func acquired(ctx context.Context, q *sendQueue) <-chan error {
+	ch := make(chan error, 1)
+	go func() { ch <- q.acquire(ctx) }()
+	return ch
+}
+
+func waitAcquired(t *testing.T, ch <-chan error, want bool) {
+	select {
+	case err := <-ch:
+		if !want {
+			t.Fatalf("acquired a slot over the limit (%v)", err)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(50 * time.Millisecond):
+		if want {
+			t.Fatalf("no slot has been acquired")
+		}
+	}
+}
+
+func TestSendQueue(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	q := &sendQueue{limit: 2}
+	waitAcquired(t, acquired(ctx, q), true)
+	waitAcquired(t, acquired(ctx, q), true)
+
+	// Over the limit, callers wait and are let through in order.
+	first := acquired(ctx, q)
+	waitAcquired(t, first, false)
+	second := acquired(ctx, q)
+	waitAcquired(t, second, false)
+	q.release()
+	waitAcquired(t, first, true)
+	waitAcquired(t, second, false)
+
+	// A caller that gives up leaves the queue.
+	cctx, ccancel := context.WithCancel(ctx)
+	third := acquired(cctx, q)
+	ccancel()
+	select {
+	case err := <-third:
+		if err == nil {
+			t.Fatalf("acquired a slot with a cancelled context")
+		}
+	case <-ctx.Done():
+		t.Fatalf("acquire has not returned")
+	}
+	q.release()
+	waitAcquired(t, second, true)
+	q.release()
+	q.release()
+	q.lock.Lock()
+	if q.inFlight != 0 || len(q.waiters) != 0 {
+		t.Errorf("%d in flight, %d waiting", q.inFlight, len(q.waiters))
+	}
+	q.lock.Unlock()
+
+	// The zero value has no limit.
+	var uq sendQueue
+	for i := 0; i < 100; i++ {
+		waitAcquired(t, acquired(ctx, &uq), true)
+	}
+}
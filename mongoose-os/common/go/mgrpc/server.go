@@ -0,0 +1,427 @@
+package mgrpc
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/websocket"
+
+	"cesanta.com/common/go/mgrpc/codec"
+	"github.com/cesanta/errors"
+	"github.com/golang/glog"
+)
+
+// CodecHandler takes over a connection accepted by a Server.
+type CodecHandler func(ctx context.Context, c codec.Codec)
+
+// Server accepts RPC connections from remote peers and serves incoming
+// requests with the registered handlers.
+type Server struct {
+	lc       ListenerConfig
+	listener net.Listener
+	// Instead of listener, for UDP.
+	udpListener *codec.UDPListener
+	handlers    *handlerSet
+
+	codecHandler     CodecHandler
+	codecHandlerLock sync.Mutex
+
+	closeOnce sync.Once
+}
+
+// Listen creates a listener as specified by lc and opts. Connections are not
+// accepted until Serve is called.
+func Listen(ctx context.Context, lc ListenerConfig, opts ...ListenOption) (*Server, error) {
+	for _, opt := range opts {
+		opt(&lc)
+	}
+	numProtos := 0
+	for _, configured := range []bool{lc.TCP != nil, lc.HTTP != nil, lc.UDP != nil} {
+		if configured {
+			numProtos++
+		}
+	}
+	if numProtos != 1 {
+		return nil, errors.Errorf("exactly one of TCP, HTTP or UDP listener must be configured")
+	}
+	if lc.HTTP != nil && !lc.HTTP.EnablePOST && !lc.HTTP.EnableWebSocket {
+		return nil, errors.Errorf("HTTP listener must have POST or WebSocket enabled")
+	}
+	if lc.UDP != nil {
+		return listenUDP(lc)
+	}
+	l, err := net.Listen("tcp", lc.Addr)
+	if err != nil {
+		return nil, errors.Annotatef(err, "failed to listen on %s", lc.Addr)
+	}
+	if lc.TLS != nil {
+		tlsConfig, err := lc.TLS.serverTLSConfig()
+		if err != nil {
+			l.Close()
+			return nil, errors.Trace(err)
+		}
+		l = tls.NewListener(l, tlsConfig)
+	}
+	s := &Server{
+		lc:       lc,
+		listener: l,
+		handlers: newHandlerSet(),
+	}
+	glog.Infof("Listening on %s", s)
+	return s, nil
+}
+
+// listenUDP creates a server which receives frames in UDP datagrams.
+func listenUDP(lc ListenerConfig) (*Server, error) {
+	if lc.TLS != nil {
+		return nil, errors.Errorf("TLS is not supported by UDP listener")
+	}
+	conn, err := net.ListenPacket("udp", lc.Addr)
+	if err != nil {
+		return nil, errors.Annotatef(err, "failed to listen on %s", lc.Addr)
+	}
+	s := &Server{
+		lc: lc,
+		udpListener: codec.ListenUDP(conn, codec.UDPOptions{
+			RetransmitInterval: lc.UDP.RetransmitInterval,
+			MaxRetransmits:     lc.UDP.MaxRetransmits,
+			IdleTimeout:        lc.UDP.IdleTimeout,
+		}),
+		handlers: newHandlerSet(),
+	}
+	glog.Infof("Listening on %s", s)
+	return s, nil
+}
+
+func (s *Server) String() string {
+	var proto string
+	switch {
+	case s.lc.TCP != nil:
+		proto = "tcp"
+	case s.lc.UDP != nil:
+		proto = "udp"
+	case s.lc.HTTP.EnableWebSocket && s.lc.HTTP.EnablePOST:
+		proto = "http+ws"
+	case s.lc.HTTP.EnableWebSocket:
+		proto = "ws"
+	default:
+		proto = "http"
+	}
+	if s.lc.TLS != nil {
+		proto += "+tls"
+	}
+	return fmt.Sprintf("[mgrpc.Server %s %s]", proto, s.Addr())
+}
+
+// Addr returns the address the server is listening on.
+func (s *Server) Addr() net.Addr {
+	if s.udpListener != nil {
+		return s.udpListener.Addr()
+	}
+	return s.listener.Addr()
+}
+
+// AddHandler registers a handler for incoming requests to the given method,
+// on all the connections accepted by this server.
+func (s *Server) AddHandler(method string, handler Handler) {
+	s.handlers.add(method, handler)
+}
+
+// SetDefaultHandler sets the handler for incoming requests to methods that
+// have no handler registered.
+func (s *Server) SetDefaultHandler(handler Handler) {
+	s.handlers.setDefault(handler)
+}
+
+// SetCodecHandler makes the server pass accepted connections to h instead of
+// serving them with the registered handlers. h may return before it is done
+// with the codec; the underlying connection is kept until the codec is
+// closed.
+func (s *Server) SetCodecHandler(h CodecHandler) {
+	s.codecHandlerLock.Lock()
+	defer s.codecHandlerLock.Unlock()
+	s.codecHandler = h
+}
+
+// Serve accepts connections until the server is closed. It always returns
+// a non-nil error.
+func (s *Server) Serve(ctx context.Context) error {
+	if s.lc.HTTP != nil {
+		hs := &http.Server{
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				s.serveHTTP(ctx, w, req)
+			}),
+		}
+		return errors.Trace(hs.Serve(s.listener))
+	}
+	if s.udpListener != nil {
+		for {
+			c, err := s.udpListener.Accept(ctx)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			glog.V(1).Infof("%s: accepted a connection from %s", s, c.Info().RemoteAddr)
+			go s.serveCodec(ctx, c)
+		}
+	}
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if tc, ok := conn.(*net.TCPConn); ok {
+			tc.SetKeepAlive(true)
+			tc.SetKeepAlivePeriod(tcpKeepAliveInterval)
+		}
+		glog.V(1).Infof("%s: accepted a connection from %s", s, conn.RemoteAddr())
+		go s.serveCodec(ctx, codec.TCP(conn, s.lc.TCP.streamOptions()))
+	}
+}
+
+// Close stops accepting new connections. Connections that have already been
+// accepted are not affected, except for UDP, where they share the socket with
+// the listener and are closed too.
+func (s *Server) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		if s.udpListener != nil {
+			err = s.udpListener.Close()
+		} else {
+			err = s.listener.Close()
+		}
+	})
+	return errors.Trace(err)
+}
+
+// wrapCodec applies the checks configured for the listener to an accepted
+// connection. Fragments are checked before they are reassembled, so that
+// peers without the key can't make us buffer anything.
+func (s *Server) wrapCodec(c codec.Codec) codec.Codec {
+	if s.lc.PSK != "" {
+		c = newPSKCodec(c, s.lc.PSK)
+	}
+	return codec.Fragmenting(c, 0)
+}
+
+// serveCodec handles a newly accepted connection.
+func (s *Server) serveCodec(ctx context.Context, c codec.Codec) {
+	c = s.wrapCodec(c)
+	s.codecHandlerLock.Lock()
+	h := s.codecHandler
+	s.codecHandlerLock.Unlock()
+	if h != nil {
+		h(ctx, c)
+		return
+	}
+	rpc := s.newConn(c)
+	rpc.recvLoop(ctx, c)
+}
+
+// newConn wraps an accepted connection into an MgRPC instance that serves
+// incoming requests with the server's handlers.
+func (s *Server) newConn(c codec.Codec) *mgRPCImpl {
+	return &mgRPCImpl{
+		codec:    c,
+		reqs:     make(map[int64]req),
+		handlers: s.handlers,
+		opts:     &connectOptions{enableTracing: s.lc.EnableTracing},
+	}
+}
+
+func (s *Server) serveHTTP(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	isUpgrade := strings.ToLower(req.Header.Get("Upgrade")) == "websocket"
+	switch {
+	case isUpgrade && s.lc.HTTP.EnableWebSocket:
+		hw := &activityHijacker{ResponseWriter: w}
+		ws := websocket.Server{
+			Handshake: s.wsHandshake,
+			Handler: func(conn *websocket.Conn) {
+				c := codec.WebSocket(conn, codec.WSKeepAliveOptions{
+					PingInterval: s.lc.HTTP.WSPingInterval,
+					PongTimeout:  s.lc.HTTP.WSPongTimeout,
+					LastRead:     hw.conn.LastRead,
+				})
+				glog.V(1).Infof("%s: accepted a connection from %s", s, c.Info().RemoteAddr)
+				s.serveCodec(ctx, c)
+				// Returning from the handler closes the connection.
+				<-c.CloseNotify()
+			},
+		}
+		ws.ServeHTTP(hw, req)
+	case !isUpgrade && s.lc.HTTP.EnablePOST && req.Method == http.MethodPost:
+		s.serveHTTPPost(ctx, w, req)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// activityHijacker wraps the connection hijacked by the WebSocket server into
+// an ActivityConn, so that keepalive can tell when the client responds.
+type activityHijacker struct {
+	http.ResponseWriter
+	conn *codec.ActivityConn
+}
+
+func (w *activityHijacker) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.Errorf("connection can't be hijacked")
+	}
+	nc, brw, err := h.Hijack()
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	w.conn = codec.NewActivityConn(nc)
+	// Data the HTTP server has already read ahead is read first.
+	buffered, err := brw.Reader.Peek(brw.Reader.Buffered())
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	r := io.MultiReader(bytes.NewReader(append([]byte(nil), buffered...)), w.conn)
+	return w.conn, bufio.NewReadWriter(bufio.NewReader(r), brw.Writer), nil
+}
+
+// serveHTTPPost handles a single request delivered in an HTTP POST request.
+// Unlike the stream-based connections, the response has to be sent before
+// returning from the HTTP handler.
+func (s *Server) serveHTTPPost(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	var hc codec.Codec
+	if s.lc.HTTP.JSONRPC {
+		hc = codec.InboundJSONRPCHTTP(w, req)
+	} else {
+		hc = codec.InboundHTTP(w, req, s.lc.HTTP.CloudHost)
+	}
+	if hc == nil {
+		// The error has already been reported to the client.
+		return
+	}
+	c := s.wrapCodec(hc)
+	s.codecHandlerLock.Lock()
+	h := s.codecHandler
+	s.codecHandlerLock.Unlock()
+	if h != nil {
+		h(ctx, c)
+		<-c.CloseNotify()
+		return
+	}
+	defer c.Close()
+	rpc := s.newConn(c)
+	// There may be a batch of JSON-RPC requests, served concurrently.
+	var wg sync.WaitGroup
+	for {
+		f, err := c.Recv(ctx)
+		if err != nil {
+			// EOF means all the requests have been received, or the request has
+			// been rejected and responded to already.
+			if !codec.IsEOF(err) {
+				glog.Errorf("%s: failed to receive a frame: %s", s, err)
+			}
+			break
+		}
+		if !f.IsRequest() {
+			glog.Infof("%s: ignoring unsolicited response: %v", s, f)
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rpc.handleRequest(ctx, f)
+		}()
+	}
+	wg.Wait()
+}
+
+// wsHandshake checks the subprotocol and picks frame encodings out of those
+// offered by the client.
+func (s *Server) wsHandshake(config *websocket.Config, req *http.Request) error {
+	found := false
+	for _, p := range config.Protocol {
+		if p == codec.WSProtocol {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return errors.Errorf("unsupported protocol %q, want %q", config.Protocol, codec.WSProtocol)
+	}
+	config.Protocol = []string{codec.WSProtocol}
+	config.OutboundExtensions = nil
+	for _, ext := range config.InboundExtensions {
+		if !strings.HasPrefix(ext, codec.WSEncodingExtension+";") {
+			continue
+		}
+		offered, err := codec.ParseEncodingExtension(ext)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		// Client's "out" is what we receive, and vice versa.
+		enc := codec.WSEncoding{
+			In:  []string{pickEncoding(offered.Out)},
+			Out: []string{pickEncoding(offered.In)},
+		}
+		config.OutboundExtensions = []string{enc.String()}
+		break
+	}
+	return nil
+}
+
+// pickEncoding returns the first encoding from the list, which is the most
+// preferred one. JSON is assumed if the list is empty.
+func pickEncoding(encs []string) string {
+	if len(encs) == 0 {
+		return "json"
+	}
+	return encs[0]
+}
+
+// serverTLSConfig creates TLS configuration for the listener.
+func (tc *TLSConfig) serverTLSConfig() (*tls.Config, error) {
+	cert := tc.Cert
+	if cert == nil {
+		if tc.CertFile == "" {
+			return nil, errors.Errorf("TLS listener requires a certificate")
+		}
+		keyFile := tc.KeyFile
+		if keyFile == "" {
+			// Certificate and key may be in the same file.
+			keyFile = tc.CertFile
+		}
+		var err error
+		cert, err = maybeLoadCertAndKey(tc.CertFile, keyFile)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	r := &tls.Config{
+		Certificates: []tls.Certificate{*cert},
+	}
+	pool := tc.ClientCAPool
+	if tc.ClientCAPoolFile != "" {
+		if pool != nil {
+			return nil, errors.Errorf("both ClientCAPool and ClientCAPoolFile are specified")
+		}
+		pem, err := ioutil.ReadFile(tc.ClientCAPoolFile)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("no certificates found in %s", tc.ClientCAPoolFile)
+		}
+	}
+	if pool != nil {
+		r.ClientCAs = pool
+		r.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return r, nil
+}
@@ -0,0 +1,361 @@
+package mgrpc
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"cesanta.com/common/go/mgrpc/frame"
+	"cesanta.com/common/go/ourjson"
+)
+
+func TestJSONRPCOverHTTP(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	s, err := Listen(ctx, ListenerConfig{
+		Addr: "127.0.0.1:0",
+		HTTP: &HTTPListenerConfig{EnablePOST: true, JSONRPC: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.AddHandler("Echo", func(ctx context.Context, rpc MgRPC, src string, cmd *frame.Command) *frame.Response {
+		return &frame.Response{Response: cmd.Args}
+	})
+	go s.Serve(ctx)
+	url := "http://" + s.Addr().String() + "/"
+
+	rpc, err := New(ctx, url, JSONRPC(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rpc.Disconnect(ctx)
+	resp, err := rpc.Call(ctx, "", &frame.Command{Cmd: "Echo", Args: ourjson.RawJSON([]byte(`{"a":1}`))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := resp.Response.MarshalJSON(); resp.Status != 0 || string(b) != `{"a":1}` {
+		t.Errorf("got %v", resp)
+	}
+
+	// A batch with a notification, which is not responded to, and an invalid
+	// request, which is.
+	batch := `[
+		{"jsonrpc": "2.0", "id": 1, "method": "Echo", "params": [1]},
+		{"jsonrpc": "2.0", "method": "Echo"},
+		{"jsonrpc": "2.0", "id": 2, "method": "Nope"},
+		{"jsonrpc": "2.0", "id": "three", "method": "Echo", "params": 3},
+		{"id": 4, "method": "Echo"}
+	]`
+	hr, err := http.Post(url, "application/json", strings.NewReader(batch))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hr.Body.Close()
+	body, _ := ioutil.ReadAll(hr.Body)
+	var got []struct {
+		JSONRPC string          `json:"jsonrpc"`
+		ID      json.RawMessage `json:"id"`
+		Result  json.RawMessage `json:"result"`
+		Error   *frame.Error    `json:"error"`
+	}
+	if err := json.Unmarshal(body, &got); err != nil {
+		t.Fatalf("%s: %s", body, err)
+	}
+	if len(got) != 4 {
+		t.Fatalf("got %s, want 4 responses", body)
+	}
+	for _, r := range got {
+		switch id := string(r.ID); {
+		case r.JSONRPC != "2.0":
+			t.Errorf("got version %q", r.JSONRPC)
+		case id == "1" && string(r.Result) != "[1]":
+			t.Errorf("got result %s", r.Result)
+		case id == "2" && (r.Error == nil || r.Error.Code != -32601):
+			t.Errorf("got error %+v", r.Error)
+		case id == `"three"` && string(r.Result) != "3":
+			t.Errorf("got result %s", r.Result)
+		case id == "null" && (r.Error == nil || r.Error.Code != -32600):
+			t.Errorf("got error %+v", r.Error)
+		case id != "1" && id != "2" && id != `"three"` && id != "null":
+			t.Errorf("got response to %s", id)
+		}
+	}
+}
+
+func TestRESTOverHTTP(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	s, err := Listen(ctx, ListenerConfig{
+		Addr: "127.0.0.1:0",
+		HTTP: &HTTPListenerConfig{EnablePOST: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.AddHandler("Echo", func(ctx context.Context, rpc MgRPC, src string, cmd *frame.Command) *frame.Response {
+		return &frame.Response{Response: cmd.Args}
+	})
+	go s.Serve(ctx)
+
+	rpc, err := New(ctx, "http://"+s.Addr().String()+"/", UseHTTPREST())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rpc.Disconnect(ctx)
+	resp, err := rpc.Call(ctx, "", &frame.Command{ID: 7, Cmd: "Echo", Args: ourjson.RawJSON([]byte(`{"a":1}`))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := resp.Response.MarshalJSON(); resp.Status != 0 || resp.ID != 7 || string(b) != `{"a":1}` {
+		t.Errorf("got %v", resp)
+	}
+	resp, err = rpc.Call(ctx, "", &frame.Command{Cmd: "Nope"})
+	if err != nil || resp.Status != 404 {
+		t.Errorf("got %v, %v", resp, err)
+	}
+}
+
+func TestServerAccept(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, tc := range []struct {
+		listen string
+		tcp    *TCPListenerConfig
+		opts   []ConnectOption
+	}{
+		{listen: "tcp://127.0.0.1:0"},
+		{listen: "tcp://127.0.0.1:0", opts: []ConnectOption{UBJSON(true), StreamChecksums(true)}},
+		{listen: "tcp://127.0.0.1:0", tcp: &TCPListenerConfig{DisableUBJSON: true, DisableChecksums: true},
+			opts: []ConnectOption{UBJSON(true), StreamChecksums(true)}},
+		{listen: "http://127.0.0.1:0"},
+		{listen: "ws://127.0.0.1:0"},
+		{listen: "ws://127.0.0.1:0", opts: []ConnectOption{UBJSON(true)}},
+	} {
+		lc, err := ListenerConfigFromURL(tc.listen)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.tcp != nil {
+			lc.TCP = tc.tcp
+		}
+		s, err := Listen(ctx, lc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		s.AddHandler("Echo", func(ctx context.Context, rpc MgRPC, src string, cmd *frame.Command) *frame.Response {
+			return &frame.Response{Response: cmd.Args}
+		})
+		go s.Serve(ctx)
+
+		addr := strings.Split(tc.listen, ":")[0] + "://" + s.Addr().String() + "/"
+		rpc, err := New(ctx, addr, tc.opts...)
+		if err != nil {
+			t.Fatalf("%s: %s", addr, err)
+		}
+		defer rpc.Disconnect(ctx)
+		resp, err := rpc.Call(ctx, "", &frame.Command{Cmd: "Echo", Args: ourjson.RawJSON([]byte(`[1,"a"]`))})
+		if err != nil {
+			t.Fatalf("%s: %s", addr, err)
+		}
+		if b, _ := resp.Response.MarshalJSON(); resp.Status != 0 || string(b) != `[1,"a"]` {
+			t.Errorf("%s: got %v", addr, resp)
+		}
+	}
+
+	so := (&TCPListenerConfig{}).streamOptions()
+	if !so.UBJSON || !so.Checksums {
+		t.Errorf("got %+v, want UBJSON and checksums by default", so)
+	}
+	so = (&TCPListenerConfig{DisableUBJSON: true, DisableChecksums: true}).streamOptions()
+	if so.UBJSON || so.Checksums {
+		t.Errorf("got %+v, want UBJSON and checksums disabled", so)
+	}
+}
+
+func TestConcurrentHTTPCalls(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	s, err := Listen(ctx, ListenerConfig{
+		Addr: "127.0.0.1:0",
+		HTTP: &HTTPListenerConfig{EnablePOST: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	// Each request is answered only once all of them have arrived.
+	const numCalls = 4
+	var arrived sync.WaitGroup
+	arrived.Add(numCalls)
+	s.AddHandler("Wait", func(ctx context.Context, rpc MgRPC, src string, cmd *frame.Command) *frame.Response {
+		arrived.Done()
+		arrived.Wait()
+		return nil
+	})
+	go s.Serve(ctx)
+
+	rpc, err := New(ctx, "http://"+s.Addr().String()+"/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rpc.Disconnect(ctx)
+	errs := make(chan error, numCalls)
+	for i := 0; i < numCalls; i++ {
+		go func() {
+			_, err := rpc.Call(ctx, "", &frame.Command{Cmd: "Wait"})
+			errs <- err
+		}()
+	}
+	for i := 0; i < numCalls; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Batches are sent at once too.
+	arrived.Add(numCalls)
+	var cmds []*frame.Command
+	for i := 0; i < numCalls; i++ {
+		cmds = append(cmds, &frame.Command{Cmd: "Wait"})
+	}
+	if _, err := rpc.CallBatch(ctx, "", cmds); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// listenEcho starts a server with an Echo handler and returns its address
+// with the scheme of the listen URL.
+func listenEcho(ctx context.Context, t *testing.T, listen string, opts ...ListenOption) (*Server, string) {
+	lc, err := ListenerConfigFromURL(listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := Listen(ctx, lc, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.AddHandler("Echo", func(ctx context.Context, rpc MgRPC, src string, cmd *frame.Command) *frame.Response {
+		return &frame.Response{Response: cmd.Args}
+	})
+	go s.Serve(ctx)
+	return s, strings.Split(listen, ":")[0] + "://" + s.Addr().String() + "/"
+}
+
+func TestServerPSK(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, listen := range []string{"tcp://127.0.0.1:0", "http://127.0.0.1:0", "ws://127.0.0.1:0"} {
+		s, addr := listenEcho(ctx, t, listen, ExpectPSK("secret"))
+		defer s.Close()
+		for _, tc := range []struct {
+			key        string
+			wantStatus int
+		}{
+			{"", 403},
+			{"bad", 403},
+			{"secret", 0},
+		} {
+			rpc, err := New(ctx, addr, SendPSK(tc.key), MTU(300))
+			if err != nil {
+				t.Fatalf("%s: %s", addr, err)
+			}
+			defer rpc.Disconnect(ctx)
+			// Big requests are sent in fragments, which are checked too.
+			for _, args := range []string{"", strings.Repeat("x", 1000)} {
+				cmd := &frame.Command{Cmd: "Echo"}
+				if args != "" {
+					cmd.Args = ourjson.RawJSON([]byte(`"` + args + `"`))
+				}
+				resp, err := rpc.Call(ctx, "", cmd)
+				if err != nil || resp.Status != tc.wantStatus {
+					t.Errorf("%s, key %q, %d bytes: got %v, %v, want status %d", addr, tc.key, len(args), resp, err, tc.wantStatus)
+				}
+			}
+		}
+	}
+}
+
+// selfSignedCert returns a certificate for 127.0.0.1 along with a pool that
+// trusts it.
+func selfSignedCert(t *testing.T) (*tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	x509Cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(x509Cert)
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+func TestTCPS(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	cert, pool := selfSignedCert(t)
+	s, addr := listenEcho(ctx, t, "tcps://127.0.0.1:0", ServerCert(cert))
+	defer s.Close()
+
+	rpc, err := New(ctx, addr, VerifyServerWith(pool))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rpc.Disconnect(ctx)
+	resp, err := rpc.Call(ctx, "", &frame.Command{Cmd: "Echo", Args: ourjson.RawJSON([]byte(`"hi"`))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := resp.Response.MarshalJSON(); resp.Status != 0 || string(b) != `"hi"` {
+		t.Errorf("got %v", resp)
+	}
+	info := rpc.(*mgRPCImpl).codec.Info()
+	if !info.TLS || len(info.PeerCertificates) != 1 || !bytes.Equal(info.PeerCertificates[0].Raw, cert.Certificate[0]) {
+		t.Errorf("got connection info %+v", info)
+	}
+
+	// The certificate is not trusted by default.
+	cctx, ccancel := context.WithTimeout(ctx, time.Second)
+	defer ccancel()
+	rpc, err = New(cctx, addr)
+	if err == nil {
+		defer rpc.Disconnect(ctx)
+		if _, err := rpc.Call(cctx, "", &frame.Command{Cmd: "Echo"}); err == nil {
+			t.Errorf("server with an untrusted certificate has been accepted")
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package mgrpc
+
+import (
+	"context"
+	"math/rand"
+
+	"cesanta.com/common/go/mgrpc/frame"
+	"cesanta.com/common/go/ourtrace"
+	"golang.org/x/net/trace"
+)
+
+// rpcTrace records the life of a single call or served request.
+// A nil *rpcTrace is valid and does nothing, so that callers don't have to
+// check whether tracing is enabled.
+type rpcTrace struct {
+	tr *ourtrace.Trace
+}
+
+// newSpan starts a trace span with the given parent span info, or a new
+// trace if there's no parent. Returns the span and a context carrying it.
+func newSpan(ctx context.Context, family, title string, parent *frame.Trace) (*rpcTrace, context.Context) {
+	tr := ourtrace.New(family, title)
+	var traceID, parentSpanID uint64
+	if parent != nil && parent.TraceID != 0 {
+		traceID, parentSpanID = uint64(parent.TraceID), uint64(parent.SpanID)
+	} else {
+		traceID = uint64(rand.Int63())
+	}
+	tr.SetSpan(traceID, uint64(rand.Int63()), parentSpanID)
+	return &rpcTrace{tr: tr}, trace.NewContext(ctx, tr)
+}
+
+// newCallTrace starts a span for an outgoing call and puts its IDs into cmd.
+// If ctx carries a span, e.g. the one of a request being served, the new span
+// becomes its child.
+func newCallTrace(ctx context.Context, dst string, cmd *frame.Command) *rpcTrace {
+	var parent *frame.Trace
+	if ptr, ok := trace.FromContext(ctx); ok {
+		if p, ok := ptr.(*ourtrace.Trace); ok {
+			parent = &frame.Trace{TraceID: int64(p.TraceID), SpanID: int64(p.SpanID)}
+		}
+	}
+	t, _ := newSpan(ctx, "mgrpc.Call", cmd.Cmd, parent)
+	cmd.Trace = &frame.Trace{TraceID: int64(t.tr.TraceID), SpanID: int64(t.tr.SpanID)}
+	t.tr.LazyPrintf("dst=%q id=%d", dst, cmd.ID)
+	return t
+}
+
+// newServeTrace starts a span for a request received from the peer, as a
+// child of the caller's span. Returns the context to serve the request in.
+func newServeTrace(ctx context.Context, f *frame.Frame) (*rpcTrace, context.Context) {
+	t, ctx := newSpan(ctx, "mgrpc.Serve", f.Method, f.Trace)
+	t.tr.LazyPrintf("src=%q id=%d, received %d bytes", f.Src, f.ID, f.SizeHint)
+	return t, ctx
+}
+
+// frameSent records the frame that has been sent to the peer.
+func (t *rpcTrace) frameSent(f *frame.Frame) {
+	if t == nil {
+		return
+	}
+	b, err := frame.MarshalJSON(f)
+	if err != nil {
+		t.tr.LazyPrintf("sent, failed to determine size: %s", err)
+		return
+	}
+	t.tr.LazyPrintf("sent %d bytes", len(b))
+}
+
+// frameReceived records the response frame received from the peer.
+func (t *rpcTrace) frameReceived(f *frame.Frame) {
+	if t == nil {
+		return
+	}
+	t.tr.LazyPrintf("received %d bytes", f.SizeHint)
+}
+
+// response records the response to the call, or the one sent for the request.
+func (t *rpcTrace) response(resp *frame.Response) {
+	if t == nil {
+		return
+	}
+	t.tr.LazyPrintf("status=%d msg=%q", resp.Status, resp.StatusMsg)
+	if resp.Status != 0 {
+		t.tr.SetError()
+	}
+}
+
+// error records the failure of the call.
+func (t *rpcTrace) error(err error) {
+	if t == nil {
+		return
+	}
+	t.tr.LazyPrintf("error: %s", err)
+	t.tr.SetError()
+}
+
+func (t *rpcTrace) finish() {
+	if t == nil {
+		return
+	}
+	t.tr.Finish()
+}
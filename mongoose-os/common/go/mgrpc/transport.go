@@ -17,4 +17,29 @@ const (
 	// tSerial creates a permanent connection to the destination over serial port.
 	tSerial
 	tMQTT
+	// tUnix creates a permanent connection to the destination over a Unix
+	// domain socket.
+	tUnix
+	// tExec runs a command and talks to it over its stdin and stdout.
+	tExec
+	// tUDP sends each frame in a separate UDP datagram.
+	tUDP
 )
+
+// defaultMaxInFlight returns how many requests may be sent over the transport
+// before the peer has responded to the earlier ones, negative if there is no
+// limit. Devices read frames from serial ports and datagrams into small
+// buffers and serve them one by one, so only a few requests are sent ahead
+// there. Stream sockets are buffered by the OS, HTTP requests don't share a
+// connection, and MQTT brokers queue messages for the device.
+func (t transport) defaultMaxInFlight() int {
+	switch t {
+	case tSerial:
+		return 2
+	case tUDP:
+		return 4
+	case tPlainTCP, tWebSocket, tUnix, tExec:
+		return 16
+	}
+	return -1
+}
@@ -0,0 +1,112 @@
+package mgrpc
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"cesanta.com/common/go/mgrpc/codec"
+	"cesanta.com/common/go/mgrpc/frame"
+	"cesanta.com/common/go/ourjson"
+)
+
+// execEchoEnv makes the test binary serve Echo over its stdin and stdout
+// instead of running the tests, see TestExec.
+const execEchoEnv = "MGRPC_TEST_EXEC_ECHO"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(execEchoEnv) != "" {
+		serveStdio()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// stdio is a stream connection over the stdin and stdout of the process.
+type stdio struct{}
+
+func (stdio) Read(b []byte) (int, error)                { return os.Stdin.Read(b) }
+func (stdio) Write(b []byte) (int, error)               { return os.Stdout.Write(b) }
+func (stdio) Close() error                              { return os.Stdin.Close() }
+func (stdio) RemoteAddr() string                        { return "stdio" }
+func (stdio) PreprocessFrame(data []byte) (bool, error) { return false, nil }
+
+func serveStdio() {
+	ctx := context.Background()
+	c := codec.StreamConn(stdio{}, codec.StreamOptions{UBJSON: true, Checksums: true})
+	serveEcho(ctx, c)
+	<-c.CloseNotify()
+}
+
+// serveEcho serves Echo over the connection.
+func serveEcho(ctx context.Context, c codec.Codec) (MgRPC, error) {
+	rpc, err := NewWithCodec(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	rpc.AddHandler("Echo", func(ctx context.Context, rpc MgRPC, src string, cmd *frame.Command) *frame.Response {
+		return &frame.Response{Response: cmd.Args}
+	})
+	return rpc, nil
+}
+
+// callEcho checks that Echo, both small and big enough to be sent in
+// several writes, works over the connection.
+func callEcho(ctx context.Context, t *testing.T, rpc MgRPC) {
+	t.Helper()
+	for _, args := range []string{`{"a":1}`, `"` + strings.Repeat("x", 100000) + `"`} {
+		resp, err := rpc.Call(ctx, "", &frame.Command{Cmd: "Echo", Args: ourjson.RawJSON([]byte(args))})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := resp.Response.MarshalJSON(); string(got) != args {
+			t.Errorf("got %d bytes back, want %d", len(got), len(args))
+		}
+	}
+}
+
+func TestUnix(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	path := filepath.Join(t.TempDir(), "rpc.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		serveEcho(ctx, codec.Unix(conn, codec.StreamOptions{UBJSON: true, Checksums: true}))
+	}()
+
+	rpc, err := New(ctx, "unix://"+path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rpc.Disconnect(ctx)
+	callEcho(ctx, t, rpc)
+}
+
+func TestExec(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	bin, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The command inherits the environment.
+	t.Setenv(execEchoEnv, "1")
+	rpc, err := New(ctx, "exec://"+bin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rpc.Disconnect(ctx)
+	callEcho(ctx, t, rpc)
+}
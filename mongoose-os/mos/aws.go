@@ -447,25 +447,24 @@ func awsIoTSetup(ctx context.Context, devConn *dev.DevConn) error {
 		return errors.Annotatef(err, "failed to determine CA for %s", certFile)
 	}
 
-	reportf("Uploading certificate...")
-	err = fsPutFile(ctx, devConn, certFile, filepath.Base(certFile))
+	certData, err := ioutil.ReadFile(certFile)
 	if err != nil {
-		return errors.Annotatef(err, "failed to upload %s", filepath.Base(certFile))
+		return errors.Trace(err)
 	}
-
+	uploads := []fsUpload{{r: bytes.NewReader(certData), devFilename: filepath.Base(certFile)}}
 	if !strings.HasPrefix(keyFile, atca.KeyFilePrefix) {
-		reportf("Uploading key...")
-		err = fsPutFile(ctx, devConn, keyFile, filepath.Base(keyFile))
+		keyData, err := ioutil.ReadFile(keyFile)
 		if err != nil {
-			return errors.Annotatef(err, "failed to upload %s", filepath.Base(keyFile))
+			return errors.Trace(err)
 		}
+		uploads = append(uploads, fsUpload{r: bytes.NewReader(keyData), devFilename: filepath.Base(keyFile)})
 	}
-
 	caCertData := MustAsset(caCertFile)
-	reportf("Uploading CA certificate...")
-	err = fsPutData(ctx, devConn, bytes.NewBuffer(caCertData), filepath.Base(caCertFile))
-	if err != nil {
-		return errors.Annotatef(err, "failed to upload %s", filepath.Base(caCertFile))
+	uploads = append(uploads, fsUpload{r: bytes.NewReader(caCertData), devFilename: filepath.Base(caCertFile)})
+
+	reportf("Uploading certificates...")
+	if err := fsPutMany(ctx, devConn, uploads); err != nil {
+		return errors.Trace(err)
 	}
 
 	settings := map[string]string{
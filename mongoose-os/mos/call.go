@@ -4,7 +4,10 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"os"
+	"strings"
 
+	"cesanta.com/common/go/mgrpc"
 	"cesanta.com/common/go/mgrpc/frame"
 	"cesanta.com/common/go/ourjson"
 	"cesanta.com/mos/dev"
@@ -70,7 +73,10 @@ func call(ctx context.Context, devConn *dev.DevConn) error {
 		params = args[1]
 	}
 
+	var pp progressPrinter
+	ctx = mgrpc.WithProgress(ctx, pp.print)
 	result, err := callDeviceService(ctx, devConn, args[0], params)
+	pp.finish()
 	if err != nil {
 		return err
 	}
@@ -78,3 +84,58 @@ func call(ctx context.Context, devConn *dev.DevConn) error {
 	fmt.Println(result)
 	return nil
 }
+
+// Width of the progress bar, in characters.
+const progressBarWidth = 40
+
+// deviceProgress is the conventional format of the progress reported by
+// devices.
+type deviceProgress struct {
+	Done  *int64 `json:"done"`
+	Total *int64 `json:"total"`
+}
+
+// progressBar renders the progress as a bar, if it's in the conventional
+// format.
+func progressBar(progress ourjson.RawMessage) (string, bool) {
+	var p deviceProgress
+	if err := progress.UnmarshalInto(&p); err != nil || p.Done == nil || p.Total == nil || *p.Total <= 0 {
+		return "", false
+	}
+	done := *p.Done
+	switch {
+	case done < 0:
+		done = 0
+	case done > *p.Total:
+		done = *p.Total
+	}
+	n := int(done * progressBarWidth / *p.Total)
+	return fmt.Sprintf("[%s%s] %3d%% (%d/%d)",
+		strings.Repeat("=", n), strings.Repeat(" ", progressBarWidth-n),
+		done*100 / *p.Total, *p.Done, *p.Total), true
+}
+
+// progressPrinter shows the progress reported by the device on stderr.
+// Progress bars are redrawn in place, other progress is printed as is.
+type progressPrinter struct {
+	inBar bool
+}
+
+func (pp *progressPrinter) print(id int64, progress ourjson.RawMessage) {
+	if bar, ok := progressBar(progress); ok {
+		fmt.Fprintf(os.Stderr, "\r%s", bar)
+		pp.inBar = true
+		return
+	}
+	pp.finish()
+	b, _ := progress.MarshalJSON()
+	reportf("Progress: %s", b)
+}
+
+// finish ends the line of the progress bar, if there is one.
+func (pp *progressPrinter) finish() {
+	if pp.inBar {
+		fmt.Fprintln(os.Stderr)
+		pp.inBar = false
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"cesanta.com/common/go/mgrpc"
+	"cesanta.com/common/go/mgrpc/frame"
+	"cesanta.com/common/go/mgrpc/mgrpctest"
+	"cesanta.com/common/go/ourjson"
+	"cesanta.com/mos/dev"
+)
+
+func TestCallDeviceService(t *testing.T) {
+	cases := []struct {
+		name      string
+		method    string
+		args      string
+		want      string
+		wantErr   bool
+		wantCalls int
+	}{
+		{name: "no args", method: "Echo", want: "", wantCalls: 1},
+		{name: "object", method: "Echo", args: `{"a":1}`, want: "{\n  \"a\": 1\n}", wantCalls: 1},
+		{name: "string", method: "Echo", args: `"foo"`, want: `"foo"`, wantCalls: 1},
+		{name: "invalid args", method: "Echo", args: `{"a":`, wantErr: true},
+		{name: "remote error", method: "Fail", wantErr: true, wantCalls: 1},
+		{name: "no handler", method: "Nope", wantErr: true, wantCalls: 1},
+	}
+	for _, c := range cases {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		d := mgrpctest.NewFakeDevice("dev")
+		d.Handle("Echo", func(ctx context.Context, rpc mgrpc.MgRPC, src string, cmd *frame.Command) *frame.Response {
+			return &frame.Response{Response: cmd.Args}
+		})
+		d.Script("Fail", mgrpctest.Reply{Status: 500, StatusMsg: "failed"})
+		rpc, err := d.Connect(ctx)
+		if err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+		devConn := (&dev.Client{}).CreateDevConnWithRPC(rpc)
+
+		got, err := callDeviceService(ctx, devConn, c.method, c.args)
+		switch {
+		case c.wantErr && err == nil:
+			t.Errorf("%s: want error, got %q", c.name, got)
+		case !c.wantErr && err != nil:
+			t.Errorf("%s: %s", c.name, err)
+		case !c.wantErr && got != c.want:
+			t.Errorf("%s: got %q, want %q", c.name, got, c.want)
+		}
+		if calls := d.Calls(); len(calls) != c.wantCalls {
+			t.Errorf("%s: device got %d calls, want %d", c.name, len(calls), c.wantCalls)
+		}
+		rpc.Disconnect(ctx)
+		cancel()
+	}
+}
+
+func TestCallProgress(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	d := mgrpctest.NewFakeDevice("dev")
+	d.Script("OTA.Update", mgrpctest.Reply{Progress: []interface{}{
+		map[string]int{"done": 0, "total": 200},
+		map[string]int{"done": 50, "total": 200},
+		"verifying",
+		map[string]int{"done": 250, "total": 200},
+	}})
+	rpc, err := d.Connect(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rpc.Disconnect(ctx)
+	devConn := (&dev.Client{}).CreateDevConnWithRPC(rpc)
+
+	var got []string
+	ctx = mgrpc.WithProgress(ctx, func(id int64, progress ourjson.RawMessage) {
+		if bar, ok := progressBar(progress); ok {
+			got = append(got, bar)
+		} else {
+			b, _ := progress.MarshalJSON()
+			got = append(got, string(b))
+		}
+	})
+	if _, err := callDeviceService(ctx, devConn, "OTA.Update", ""); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"[                                        ]   0% (0/200)",
+		"[==========                              ]  25% (50/200)",
+		`"verifying"`,
+		"[========================================] 100% (250/200)",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
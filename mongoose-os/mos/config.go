@@ -6,6 +6,8 @@ import (
 	"strings"
 
 	"cesanta.com/clubby"
+	"cesanta.com/common/go/mgrpc"
+	"cesanta.com/common/go/mgrpc/frame"
 	fwconfig "cesanta.com/fw/defs/config"
 	"cesanta.com/mos/dev"
 	"github.com/cesanta/errors"
@@ -96,27 +98,41 @@ func internalConfigSet(
 func configSetAndSave(ctx context.Context, devConn *dev.DevConn, devConf *dev.DevConf) error {
 	// save changed conf
 	reportf("Setting new configuration...")
-	err := devConn.SetConfig(ctx, devConf)
+	if noSave {
+		return errors.Trace(devConn.SetConfig(ctx, devConf))
+	}
+
+	// Set and Save are sent in one batch where the device gets requests in
+	// the order they are sent, and serves them in order. Otherwise, e.g. over
+	// HTTP, Save has to wait for Set.
+	var rec mgrpc.CommandRecorder
+	cc := fwconfig.NewClient(&rec, devConn.Dest)
+	if err := cc.Set(ctx, dev.SetConfigArgs(devConf)); err != nil {
+		return errors.Trace(err)
+	}
+	if noReboot {
+		reportf("Saving...")
+	} else {
+		reportf("Saving and rebooting...")
+	}
+	err := cc.Save(ctx, &fwconfig.SaveArgs{
+		Reboot: clubby.Bool(!noReboot),
+	})
 	if err != nil {
 		return errors.Trace(err)
 	}
-
-	if !noSave {
-		if noReboot {
-			reportf("Saving...")
-		} else {
-			reportf("Saving and rebooting...")
-		}
-		err = devConn.CConf.Save(ctx, &fwconfig.SaveArgs{
-			Reboot: clubby.Bool(!noReboot),
-		})
-		if err != nil {
-			return errors.Trace(err)
+	if !devConn.RPC.ConnectionInfo().Ordered {
+		for _, cmd := range rec.Commands {
+			if _, err := devConn.RPC.CallBatch(ctx, devConn.Dest, []*frame.Command{cmd}); err != nil {
+				return errors.Trace(err)
+			}
 		}
+	} else if _, err := devConn.RPC.CallBatch(ctx, devConn.Dest, rec.Commands); err != nil {
+		return errors.Trace(err)
+	}
 
-		if !noReboot {
-			waitForReboot()
-		}
+	if !noReboot {
+		waitForReboot()
 	}
 
 	return nil
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"cesanta.com/common/go/mgrpc"
+	"cesanta.com/common/go/mgrpc/mgrpctest"
+	"cesanta.com/mos/dev"
+)
+
+func TestConfigSetAndSave(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	defer func(s, r bool) { noSave, noReboot = s, r }(noSave, noReboot)
+	noSave, noReboot = false, true
+
+	d := mgrpctest.NewFakeDevice("dev")
+	d.Script("Config.Get", mgrpctest.Reply{Result: map[string]interface{}{"wifi": map[string]string{"ssid": "old"}}})
+	// Save must be sent without waiting for Set to complete.
+	d.Script("Config.Set", mgrpctest.Reply{Delay: 100 * time.Millisecond})
+	d.Script("Config.Save", mgrpctest.Reply{})
+	c, err := d.Dial(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ifc := &inFlightCodec{Codec: c}
+	rpc, err := mgrpc.NewWithCodec(ctx, ifc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rpc.Disconnect(ctx)
+	devConn := (&dev.Client{}).CreateDevConnWithRPC(rpc)
+
+	devConf, err := devConn.GetConfig(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := devConf.Set("wifi.ssid", "new"); err != nil {
+		t.Fatal(err)
+	}
+	if err := configSetAndSave(ctx, devConn, devConf); err != nil {
+		t.Fatal(err)
+	}
+	if ifc.max != 2 {
+		t.Errorf("%d requests in flight, want Set and Save", ifc.max)
+	}
+	args := map[string]string{}
+	for _, c := range d.Calls() {
+		b, _ := c.Args.MarshalJSON()
+		args[c.Cmd] = string(b)
+	}
+	if len(args) != 3 {
+		t.Fatalf("got calls %v", d.Calls())
+	}
+	if got := args["Config.Set"]; got != `{"config":{"wifi":{"ssid":"new"}}}` {
+		t.Errorf("got Set args %s", got)
+	}
+	if got := args["Config.Save"]; got != `{"reboot":false}` {
+		t.Errorf("got Save args %s", got)
+	}
+}
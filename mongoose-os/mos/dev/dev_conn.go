@@ -27,6 +27,8 @@ type DevConn struct {
 	Dest        string
 	JunkHandler func(junk []byte)
 	Reconnect   bool
+	// Additional options used when (re)connecting to the device.
+	ConnectOpts []mgrpc.ConnectOption
 
 	CConf       fwconfig.Service
 	CVars       fwvars.Service
@@ -50,9 +52,9 @@ func (c *Client) CreateDevConn(
 	return dc, nil
 }
 
-func (c *Client) CreateDevConnWithJunkHandler(ctx context.Context, connectAddr string, junkHandler func(junk []byte), reconnect bool, tlsConfig *tls.Config) (*DevConn, error) {
+func (c *Client) CreateDevConnWithJunkHandler(ctx context.Context, connectAddr string, junkHandler func(junk []byte), reconnect bool, tlsConfig *tls.Config, opts ...mgrpc.ConnectOption) (*DevConn, error) {
 
-	dc := &DevConn{c: c, ConnectAddr: connectAddr, Dest: debugDevId}
+	dc := &DevConn{c: c, ConnectAddr: connectAddr, Dest: debugDevId, ConnectOpts: opts}
 
 	err := dc.ConnectWithJunkHandler(ctx, junkHandler, reconnect, tlsConfig)
 	if err != nil {
@@ -62,6 +64,14 @@ func (c *Client) CreateDevConnWithJunkHandler(ctx context.Context, connectAddr s
 	return dc, nil
 }
 
+// CreateDevConnWithRPC creates a connection to the device over an already
+// established RPC channel, e.g. one to a fake device in tests.
+func (c *Client) CreateDevConnWithRPC(rpc mgrpc.MgRPC) *DevConn {
+	dc := &DevConn{c: c, Dest: debugDevId}
+	dc.setRPC(rpc)
+	return dc
+}
+
 func (dc *DevConn) GetConfig(ctx context.Context) (*DevConf, error) {
 	devConfRaw, err := dc.CConf.Get(ctx, &fwconfig.GetArgs{})
 	if err != nil {
@@ -80,9 +90,7 @@ func (dc *DevConn) GetConfig(ctx context.Context) (*DevConf, error) {
 }
 
 func (dc *DevConn) SetConfig(ctx context.Context, devConf *DevConf) error {
-	err := dc.CConf.Set(ctx, &fwconfig.SetArgs{
-		Config: ourjson.DelayMarshaling(devConf.data),
-	})
+	err := dc.CConf.Set(ctx, SetConfigArgs(devConf))
 	if err != nil {
 		return errors.Trace(err)
 	}
@@ -90,6 +98,13 @@ func (dc *DevConn) SetConfig(ctx context.Context, devConf *DevConf) error {
 	return nil
 }
 
+// SetConfigArgs returns the arguments of Config.Set that applies devConf.
+func SetConfigArgs(devConf *DevConf) *fwconfig.SetArgs {
+	return &fwconfig.SetArgs{
+		Config: ourjson.DelayMarshaling(devConf.data),
+	}
+}
+
 func (dc *DevConn) Disconnect(ctx context.Context) error {
 	glog.V(2).Infof("Disconnecting from %s", dc.ConnectAddr)
 	err := dc.RPC.Disconnect(ctx)
@@ -114,8 +129,6 @@ func (dc *DevConn) Connect(ctx context.Context, reconnect bool) error {
 }
 
 func (dc *DevConn) ConnectWithJunkHandler(ctx context.Context, junkHandler func(junk []byte), reconnect bool, tlsConfig *tls.Config) error {
-	var err error
-
 	if dc.RPC != nil {
 		return nil
 	}
@@ -129,14 +142,20 @@ func (dc *DevConn) ConnectWithJunkHandler(ctx context.Context, junkHandler func(
 		mgrpc.Reconnect(reconnect),
 		mgrpc.TlsConfig(tlsConfig),
 	}
+	opts = append(opts, dc.ConnectOpts...)
 
-	dc.RPC, err = mgrpc.New(ctx, dc.ConnectAddr, opts...)
+	rpc, err := mgrpc.New(ctx, dc.ConnectAddr, opts...)
 	if err != nil {
 		return errors.Trace(err)
 	}
 
+	dc.setRPC(rpc)
+	return nil
+}
+
+func (dc *DevConn) setRPC(rpc mgrpc.MgRPC) {
+	dc.RPC = rpc
 	dc.CConf = fwconfig.NewClient(dc.RPC, debugDevId)
 	dc.CVars = fwvars.NewClient(dc.RPC, debugDevId)
 	dc.CFilesystem = fwfilesystem.NewClient(dc.RPC, debugDevId)
-	return nil
 }
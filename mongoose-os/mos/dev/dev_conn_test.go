@@ -0,0 +1,94 @@
+package dev
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"cesanta.com/common/go/mgrpc/mgrpctest"
+)
+
+func TestGetConfig(t *testing.T) {
+	cases := []struct {
+		name    string
+		reply   mgrpctest.Reply
+		path    string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:  "string value",
+			reply: mgrpctest.Reply{Result: map[string]interface{}{"wifi": map[string]interface{}{"sta": map[string]interface{}{"ssid": "home"}}}},
+			path:  "wifi.sta.ssid",
+			want:  "home",
+		},
+		{
+			name:  "number value",
+			reply: mgrpctest.Reply{Result: map[string]interface{}{"debug": map[string]interface{}{"level": 2}}},
+			path:  "debug.level",
+			want:  "2",
+		},
+		{
+			name:  "bool value",
+			reply: mgrpctest.Reply{Result: map[string]interface{}{"http": map[string]interface{}{"enable": true}}},
+			path:  "http.enable",
+			want:  "true",
+		},
+		{
+			name:    "device error",
+			reply:   mgrpctest.Reply{Status: 500, StatusMsg: "out of memory"},
+			wantErr: true,
+		},
+		{
+			name:    "not an object",
+			reply:   mgrpctest.Reply{Result: "foo"},
+			wantErr: true,
+		},
+		{
+			name:    "no response in time",
+			reply:   mgrpctest.Reply{Result: map[string]interface{}{}, Delay: time.Second},
+			wantErr: true,
+		},
+	}
+	for _, c := range cases {
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		d := mgrpctest.NewFakeDevice("dev")
+		d.Script("Config.Get", c.reply)
+		rpc, err := d.Connect(ctx)
+		if err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+		dc := (&Client{}).CreateDevConnWithRPC(rpc)
+		conf, err := dc.GetConfig(ctx)
+		switch {
+		case c.wantErr && err == nil:
+			t.Errorf("%s: want error, got config %v", c.name, conf.data)
+		case !c.wantErr && err != nil:
+			t.Errorf("%s: %s", c.name, err)
+		case err == nil:
+			if v, err := conf.Get(c.path); err != nil || v != c.want {
+				t.Errorf("%s: %s = %q %v, want %q", c.name, c.path, v, err, c.want)
+			}
+		}
+		rpc.Disconnect(ctx)
+		cancel()
+	}
+}
+
+func TestGetConfigNoHandler(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	d := mgrpctest.NewFakeDevice("dev")
+	rpc, err := d.Connect(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rpc.Disconnect(ctx)
+	dc := (&Client{}).CreateDevConnWithRPC(rpc)
+	if _, err := dc.GetConfig(ctx); err == nil {
+		t.Errorf("want error")
+	}
+	if calls := d.Calls(); len(calls) != 1 || calls[0].Cmd != "Config.Get" {
+		t.Errorf("unexpected calls: %v", calls)
+	}
+}
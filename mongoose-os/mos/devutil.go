@@ -6,8 +6,10 @@ import (
 	"crypto/x509"
 	"flag"
 	"io/ioutil"
+	"os"
 	"strings"
 
+	"cesanta.com/common/go/mgrpc"
 	"cesanta.com/mos/dev"
 	"github.com/cesanta/errors"
 )
@@ -15,13 +17,38 @@ import (
 var (
 	// NOTE(lsm): we're reusing cert-file and key-file flags from aws.go
 	caFile = ""
+
+	recordSession = ""
+	httpREST      = false
+	checksums     = false
+	// Set once the session file has been created, later connections append to
+	// it.
+	sessionFileCreated = false
 )
 
 func init() {
 	flag.StringVar(&caFile, "ca-cert-file", "", "CA cert for TLS server verification")
+	flag.StringVar(&recordSession, "record-session", "", "Record RPC frames exchanged with the device to this file")
+	flag.BoolVar(&httpREST, "http-rest", false, "For http(s):// ports, call methods with REST-style requests (POST /Method) instead of posting RPC frames")
+	flag.BoolVar(&checksums, "checksums", false, "Protect frames sent over serial and TCP ports with CRC32, if the device supports it")
 	hiddenFlags = append(hiddenFlags, "ca-cert-file")
 }
 
+// openSessionFile opens the file a connection records the session to. It's
+// closed when the connection is.
+func openSessionFile() (*os.File, error) {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	if !sessionFileCreated {
+		flags |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(recordSession, flags, 0644)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	sessionFileCreated = true
+	return f, nil
+}
+
 func createDevConn(ctx context.Context) (*dev.DevConn, error) {
 	return createDevConnWithJunkHandler(ctx, func(junk []byte) {})
 }
@@ -42,7 +69,7 @@ func createDevConnWithJunkHandler(
 
 	// Init and pass TLS config if --cert-file and --key-file are specified
 	var tlsConfig *tls.Config = nil
-	if certFile != "" || strings.HasPrefix(port, "wss") || strings.HasPrefix(port, "https") || strings.HasPrefix(port, "mqtts") {
+	if certFile != "" || strings.HasPrefix(port, "wss") || strings.HasPrefix(port, "https") || strings.HasPrefix(port, "mqtts") || strings.HasPrefix(port, "tcps") {
 
 		tlsConfig = &tls.Config{
 			InsecureSkipVerify: caFile == "",
@@ -71,6 +98,32 @@ func createDevConnWithJunkHandler(
 		}
 	}
 
-	devConn, err := c.CreateDevConnWithJunkHandler(ctx, addr, junkHandler, *reconnect, tlsConfig)
+	opts := []mgrpc.ConnectOption{
+		mgrpc.SendPSK(*devicePass),
+		// In UI mode, traces of RPC calls are available at /debug/requests.
+		mgrpc.Tracing(isUI),
+	}
+	if isUI {
+		opts = append(opts, mgrpc.ConnectionStateHandler(reportConnectionState))
+	}
+	if httpREST {
+		opts = append(opts, mgrpc.UseHTTPREST())
+	}
+	if checksums {
+		opts = append(opts, mgrpc.StreamChecksums(true))
+	}
+	var sessionFile *os.File
+	if recordSession != "" {
+		sessionFile, err = openSessionFile()
+		if err != nil {
+			return nil, errors.Annotatef(err, "failed to open session file")
+		}
+		opts = append(opts, mgrpc.RecordSession(sessionFile))
+	}
+
+	devConn, err := c.CreateDevConnWithJunkHandler(ctx, addr, junkHandler, *reconnect, tlsConfig, opts...)
+	if err != nil && sessionFile != nil {
+		sessionFile.Close()
+	}
 	return devConn, errors.Trace(err)
 }
@@ -7,18 +7,61 @@ import (
 	"io"
 	"os"
 	"path"
+	"time"
 
 	"cesanta.com/clubby"
+	"cesanta.com/common/go/mgrpc"
 	fwfilesystem "cesanta.com/fw/defs/fs"
 	"cesanta.com/mos/dev"
 	"github.com/cesanta/errors"
+	"github.com/golang/glog"
 	flag "github.com/spf13/pflag"
 )
 
 const (
 	chunkSize = 512
+
+	// Limits for the chunk size picked for the devices that report the maximum
+	// frame size they accept.
+	minChunkSize = 64
+	maxChunkSize = 4096
+	// Room left in the frame for everything except the data.
+	putFrameOverhead = 256
+	// How long to wait for the device to report the maximum frame size.
+	putHelloTimeout = 3 * time.Second
+	// How many chunks are sent in one batch if the connection does not limit
+	// the number of requests in flight.
+	maxPutChunksInFlight = 16
 )
 
+// putChunkSize returns the size of the chunks that fit into the frames the
+// device accepts. The device is asked about it the first time; if it doesn't
+// say, the default chunk size is used.
+func putChunkSize(ctx context.Context, devConn *dev.DevConn) int {
+	info := devConn.RPC.PeerInfo()
+	if info == nil {
+		hctx, cancel := context.WithTimeout(ctx, putHelloTimeout)
+		defer cancel()
+		var err error
+		if info, err = devConn.RPC.SendHello(hctx, devConn.Dest); err != nil {
+			glog.Infof("hello failed, using the default chunk size: %s", err)
+			return chunkSize
+		}
+	}
+	if info.MaxFrameSize <= 0 {
+		return chunkSize
+	}
+	// Data is base64-encoded.
+	n := (info.MaxFrameSize - putFrameOverhead) / 4 * 3
+	switch {
+	case n < minChunkSize:
+		return minChunkSize
+	case n > maxChunkSize:
+		return maxChunkSize
+	}
+	return n
+}
+
 func listFiles(ctx context.Context, devConn *dev.DevConn) ([]string, error) {
 	// Get file list from the attached device
 	files, err := devConn.CFilesystem.List(ctx)
@@ -120,36 +163,89 @@ func fsPutFile(ctx context.Context, devConn *dev.DevConn, hostFilename, devFilen
 }
 
 func fsPutData(ctx context.Context, devConn *dev.DevConn, r io.Reader, devFilename string) error {
-	data := make([]byte, chunkSize)
-	appendFlag := false
+	return fsPutMany(ctx, devConn, []fsUpload{{r: r, devFilename: devFilename}})
+}
+
+// fsUpload is a file to upload to the device.
+type fsUpload struct {
+	r           io.Reader
+	devFilename string
+}
+
+// fsPutMany uploads the files in rounds, sending the next chunk of each file in
+// one batch. Chunks of a file have to be written in order, but different files
+// are independent, so uploading several files takes as many round trips as
+// the largest one does. If the device gets requests in order, several chunks
+// of a file go in one batch, as many as may be in flight.
+func fsPutMany(ctx context.Context, devConn *dev.DevConn, uploads []fsUpload) error {
+	data := make([]byte, putChunkSize(ctx, devConn))
+	done := make([]bool, len(uploads))
+	appendFlag := make([]bool, len(uploads))
+	inFlight := 1
+	if devConn.RPC.ConnectionInfo().Ordered {
+		inFlight = devConn.RPC.MaxInFlight()
+		if inFlight <= 0 {
+			inFlight = maxPutChunksInFlight
+		}
+	}
+	// Commands are made by the client and sent in a batch.
+	var rec mgrpc.CommandRecorder
+	fsc := fwfilesystem.NewClient(&rec, devConn.Dest)
 
 	for {
-		// Read the next chunk from the file.
-		n, readErr := r.Read(data)
-		if n > 0 {
-			err := devConn.CFilesystem.Put(ctx, &fwfilesystem.PutArgs{
-				Filename: &devFilename,
-				Data:     clubby.String(base64.StdEncoding.EncodeToString(data[:n])),
-				Append:   clubby.Bool(appendFlag),
-			})
-			if err != nil {
-				return errors.Trace(err)
+		rec.Commands = nil
+		var files []int
+		numFiles := 0
+		for i := range uploads {
+			if !done[i] {
+				numFiles++
 			}
 		}
-		if readErr != nil {
-			if errors.Cause(readErr) == io.EOF {
-				// Reached EOF, quit the loop normally.
-				break
+		chunksPerFile := 1
+		if numFiles > 0 && inFlight > numFiles {
+			chunksPerFile = inFlight / numFiles
+		}
+		for i, u := range uploads {
+			for j := 0; j < chunksPerFile && !done[i]; j++ {
+				// Read the next chunk from the file.
+				n, readErr := u.r.Read(data)
+				if n > 0 {
+					err := fsc.Put(ctx, &fwfilesystem.PutArgs{
+						Filename: clubby.String(u.devFilename),
+						Data:     clubby.String(base64.StdEncoding.EncodeToString(data[:n])),
+						Append:   clubby.Bool(appendFlag[i]),
+					})
+					if err != nil {
+						return errors.Trace(err)
+					}
+					files = append(files, i)
+					// All subsequent writes to this file will append the chunk.
+					appendFlag[i] = true
+				}
+				if readErr != nil {
+					if errors.Cause(readErr) != io.EOF {
+						// Some non-EOF error, return error.
+						return errors.Annotatef(readErr, "failed to read %s", u.devFilename)
+					}
+					// Reached EOF, the file is done.
+					done[i] = true
+				}
 			}
-			// Some non-EOF error, return error.
-			return errors.Trace(readErr)
+		}
+		if len(rec.Commands) == 0 {
+			return nil
 		}
 
-		// All subsequent writes to this file will append the chunk.
-		appendFlag = true
+		results, err := devConn.RPC.CallBatch(ctx, devConn.Dest, rec.Commands)
+		if err != nil {
+			for j, res := range results {
+				if res.Err != nil {
+					return errors.Annotatef(res.Err, "failed to upload %s", uploads[files[j]].devFilename)
+				}
+			}
+			return errors.Trace(err)
+		}
 	}
-
-	return nil
 }
 
 func fsRemoveFile(ctx context.Context, devConn *dev.DevConn, devFilename string) error {
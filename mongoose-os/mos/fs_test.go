@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"cesanta.com/common/go/mgrpc"
+	"cesanta.com/common/go/mgrpc/codec"
+	"cesanta.com/common/go/mgrpc/frame"
+	"cesanta.com/common/go/mgrpc/mgrpctest"
+	fwfilesystem "cesanta.com/fw/defs/fs"
+	"cesanta.com/mos/dev"
+)
+
+// fakeFS implements FS.Put on a fake device.
+type fakeFS struct {
+	lock  sync.Mutex
+	files map[string][]byte
+	puts  int
+	// If non-zero, the put with this number fails.
+	failPut int
+}
+
+func (fs *fakeFS) put(ctx context.Context, rpc mgrpc.MgRPC, src string, cmd *frame.Command) *frame.Response {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	fs.puts++
+	if fs.puts == fs.failPut {
+		return &frame.Response{Status: 500, StatusMsg: "disk full"}
+	}
+	var args fwfilesystem.PutArgs
+	if err := cmd.Args.UnmarshalInto(&args); err != nil || args.Filename == nil || args.Data == nil {
+		return &frame.Response{Status: 400, StatusMsg: "bad args"}
+	}
+	data, err := base64.StdEncoding.DecodeString(*args.Data)
+	if err != nil {
+		return &frame.Response{Status: 400, StatusMsg: err.Error()}
+	}
+	if args.Append != nil && *args.Append {
+		fs.files[*args.Filename] = append(fs.files[*args.Filename], data...)
+	} else {
+		fs.files[*args.Filename] = data
+	}
+	return nil
+}
+
+func TestFsPutData(t *testing.T) {
+	cases := []struct {
+		name     string
+		size     int
+		failPut  int
+		wantPuts int
+		wantErr  bool
+	}{
+		{name: "small", size: 10, wantPuts: 1},
+		{name: "one chunk", size: chunkSize, wantPuts: 1},
+		{name: "several chunks", size: 3*chunkSize + 1, wantPuts: 4},
+		// Chunks are sent without waiting for the earlier ones, so all of
+		// them arrive.
+		{name: "first put fails", size: 3 * chunkSize, failPut: 1, wantPuts: 3, wantErr: true},
+		{name: "second put fails", size: 3 * chunkSize, failPut: 2, wantPuts: 3, wantErr: true},
+	}
+	for _, c := range cases {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		data := make([]byte, c.size)
+		for i := range data {
+			data[i] = byte(i * 7)
+		}
+		fs := &fakeFS{
+			// Existing file must be overwritten.
+			files:   map[string][]byte{"foo.txt": []byte("old content")},
+			failPut: c.failPut,
+		}
+		d := mgrpctest.NewFakeDevice("dev")
+		d.Handle("FS.Put", fs.put)
+		rpc, err := d.Connect(ctx)
+		if err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+		devConn := (&dev.Client{}).CreateDevConnWithRPC(rpc)
+
+		err = fsPutData(ctx, devConn, bytes.NewReader(data), "foo.txt")
+		switch {
+		case c.wantErr && err == nil:
+			t.Errorf("%s: want error", c.name)
+		case !c.wantErr && err != nil:
+			t.Errorf("%s: %s", c.name, err)
+		case err == nil:
+			if got := fs.files["foo.txt"]; !bytes.Equal(got, data) {
+				t.Errorf("%s: device got %d bytes, want %d", c.name, len(got), len(data))
+			}
+		}
+		if fs.puts != c.wantPuts {
+			t.Errorf("%s: %d puts, want %d", c.name, fs.puts, c.wantPuts)
+		}
+		rpc.Disconnect(ctx)
+		cancel()
+	}
+}
+
+func TestPutChunkSize(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	d := mgrpctest.NewFakeDevice("dev")
+	d.Script("/v1/Hello", mgrpctest.Reply{Result: map[string]int{"protocol_version": 2, "max_frame_size": 1280}})
+	rpc, err := d.Connect(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rpc.Disconnect(ctx)
+	devConn := (&dev.Client{}).CreateDevConnWithRPC(rpc)
+
+	// The device is asked once, on first use.
+	if n := len(d.Calls()); n != 0 {
+		t.Errorf("%d calls before the first put", n)
+	}
+	for i := 0; i < 2; i++ {
+		if got, want := putChunkSize(ctx, devConn), (1280-putFrameOverhead)/4*3; got != want {
+			t.Errorf("got chunk size %d, want %d", got, want)
+		}
+	}
+	if n := len(d.Calls()); n != 1 {
+		t.Errorf("got %d calls, want one hello", n)
+	}
+
+	// Older firmware doesn't report the frame size.
+	old := mgrpctest.NewFakeDevice("old")
+	rpc, err = old.Connect(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rpc.Disconnect(ctx)
+	if got := putChunkSize(ctx, (&dev.Client{}).CreateDevConnWithRPC(rpc)); got != chunkSize {
+		t.Errorf("got chunk size %d, want %d", got, chunkSize)
+	}
+}
+
+func TestFsPutMany(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	fs := &fakeFS{files: map[string][]byte{}}
+	d := mgrpctest.NewFakeDevice("dev")
+	d.Handle("FS.Put", fs.put)
+	rpc, err := d.Connect(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rpc.Disconnect(ctx)
+	devConn := (&dev.Client{}).CreateDevConnWithRPC(rpc)
+
+	big := bytes.Repeat([]byte("b"), 2*chunkSize+1)
+	small := []byte("small")
+	err = fsPutMany(ctx, devConn, []fsUpload{
+		{r: bytes.NewReader(big), devFilename: "big.txt"},
+		{r: bytes.NewReader(small), devFilename: "small.txt"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(fs.files["big.txt"], big) || !bytes.Equal(fs.files["small.txt"], small) {
+		t.Errorf("device got %d and %d bytes", len(fs.files["big.txt"]), len(fs.files["small.txt"]))
+	}
+	if fs.puts != 4 {
+		t.Errorf("%d puts, want 4", fs.puts)
+	}
+
+	// A failure is reported for the file it belongs to.
+	fs.puts, fs.failPut = 0, 2
+	err = fsPutMany(ctx, devConn, []fsUpload{
+		{r: bytes.NewReader(small), devFilename: "a.txt"},
+		{r: bytes.NewReader(small), devFilename: "b.txt"},
+	})
+	if err == nil || !strings.Contains(err.Error(), "failed to upload") {
+		t.Errorf("got %v", err)
+	}
+}
+
+// inFlightCodec keeps track of how many requests wait for a response.
+type inFlightCodec struct {
+	codec.Codec
+	lock          sync.Mutex
+	inFlight, max int
+}
+
+func (c *inFlightCodec) Send(ctx context.Context, f *frame.Frame) error {
+	c.lock.Lock()
+	c.inFlight++
+	if c.inFlight > c.max {
+		c.max = c.inFlight
+	}
+	c.lock.Unlock()
+	return c.Codec.Send(ctx, f)
+}
+
+func (c *inFlightCodec) Recv(ctx context.Context) (*frame.Frame, error) {
+	f, err := c.Codec.Recv(ctx)
+	if err == nil && !f.IsProgress() {
+		c.lock.Lock()
+		c.inFlight--
+		c.lock.Unlock()
+	}
+	return f, err
+}
+
+func TestFsPutPipelined(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	fs := &fakeFS{files: map[string][]byte{}}
+	d := mgrpctest.NewFakeDevice("dev")
+	d.Handle("FS.Put", fs.put)
+	c, err := d.Dial(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ifc := &inFlightCodec{Codec: c}
+	rpc, err := mgrpc.NewWithCodec(ctx, ifc, mgrpc.MaxInFlight(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rpc.Disconnect(ctx)
+	devConn := (&dev.Client{}).CreateDevConnWithRPC(rpc)
+
+	// Chunks of one file are sent without waiting for the earlier ones, up to
+	// the limit, and are written in order.
+	data := make([]byte, 10*chunkSize)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	if err := fsPutData(ctx, devConn, bytes.NewReader(data), "foo.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if got := fs.files["foo.txt"]; !bytes.Equal(got, data) {
+		t.Errorf("device got %d bytes, want %d", len(got), len(data))
+	}
+	if ifc.max < 2 || ifc.max > 4 {
+		t.Errorf("%d requests in flight, want 2 to 4", ifc.max)
+	}
+}
@@ -34,9 +34,10 @@ var (
 	local      = flag.Bool("local", false, "Local build.")
 	mosRepo    = flag.String("repo", "", "Path to the mongoose-os repository; if omitted, the mongoose-os repository will be cloned as ./mongoose-os")
 	deviceID   = flag.String("device-id", "", "Device ID")
-	devicePass = flag.String("device-pass", "", "Device pass/key")
+	devicePass = flag.String("device-pass", "", "Device pass/key, must match device.password in the device config")
 	firmware   = flag.String("firmware", filepath.Join(buildDir, ide.FirmwareFileName), "Firmware .zip file location (file of HTTP URL)")
-	portFlag   = flag.String("port", "auto", "Serial port where the device is connected. "+
+	portFlag   = flag.String("port", "auto", "Serial port where the device is connected, "+
+		"or a URL like tcp://host:port, udp://host:port, unix:///path/to.sock or exec://command args. "+
 		"If set to 'auto', ports on the system will be enumerated and the first will be used.")
 	timeout   = flag.Duration("timeout", 10*time.Second, "Timeout for the device connection")
 	reconnect = flag.Bool("reconnect", false, "Enable reconnection")
@@ -188,7 +189,12 @@ func main() {
 		}
 	}
 
-	if err := run(cmd, ctx, devConn); err != nil {
+	err := run(cmd, ctx, devConn)
+	if devConn != nil {
+		// Closes the session recording, if any.
+		devConn.Disconnect(ctx)
+	}
+	if err != nil {
 		glog.Infof("Error: %+v", err)
 		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
 		os.Exit(1)
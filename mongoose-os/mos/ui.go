@@ -15,6 +15,9 @@ import (
 
 	yaml "gopkg.in/yaml.v2"
 
+	"cesanta.com/common/go/mgrpc"
+	"cesanta.com/common/go/mgrpc/codec"
+	"cesanta.com/common/go/ourjson"
 	"cesanta.com/mos/dev"
 	"github.com/cesanta/errors"
 	"github.com/elazarl/go-bindata-assetfs"
@@ -82,6 +85,25 @@ func reportConsoleLogs() {
 	}
 }
 
+// reportConnectionState lets the UI know when the device connection goes
+// up or down.
+func reportConnectionState(e codec.ConnStateEvent) {
+	wsBroadcast(wsmessage{"connection", e.String()})
+}
+
+// reportProgress lets the UI know about the progress of a call.
+func reportProgress(method string, progress ourjson.RawMessage) {
+	data, err := json.Marshal(struct {
+		Method   string             `json:"method"`
+		Progress ourjson.RawMessage `json:"progress"`
+	}{method, progress})
+	if err != nil {
+		glog.Errorf("failed to marshal progress of %s: %s", method, err)
+		return
+	}
+	wsBroadcast(wsmessage{"progress", string(data)})
+}
+
 func httpReply(w http.ResponseWriter, result interface{}, err error) {
 	var msg []byte
 	if err != nil {
@@ -321,6 +343,10 @@ func startUI(ctx context.Context, devConn *dev.DevConn) error {
 		devConnMtx.Lock()
 		defer devConnMtx.Unlock()
 
+		// Progress of the call is streamed to the UI while it waits for the result.
+		ctx2 = mgrpc.WithProgress(ctx2, func(id int64, progress ourjson.RawMessage) {
+			reportProgress(method, progress)
+		})
 		result, err := callDeviceService(ctx2, devConn, method, args)
 		httpReply(w, result, err)
 	})
@@ -338,6 +364,8 @@ func startUI(ctx context.Context, devConn *dev.DevConn) error {
 	url := fmt.Sprintf("http://%s", addr)
 	fmt.Printf("To get a list of available commands, start with --help\n")
 	fmt.Printf("Starting Web UI. If the browser does not start, navigate to %s\n", url)
+	// Handlers for /debug/requests are registered by golang.org/x/net/trace.
+	glog.Infof("RPC traces are available at %s/debug/requests", url)
 	open.Start(url)
 	log.Fatal(http.ListenAndServe(addr, nil))
 